@@ -0,0 +1,240 @@
+package bencode
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type testFile struct {
+	Length int      `bencode:"length"`
+	Path   []string `bencode:"path"`
+}
+
+type testInfo struct {
+	Name        string     `bencode:"name"`
+	PieceLength int64      `bencode:"piece length"`
+	Pieces      string     `bencode:"pieces"`
+	Private     int        `bencode:"private,omitempty"`
+	Files       []testFile `bencode:"files,omitempty"`
+	Hash        [4]byte    `bencode:"hash"`
+	Seed        bool       `bencode:"seed"`
+	Ignored     string     `bencode:"-"`
+}
+
+type testTorrent struct {
+	Announce string                 `bencode:"announce"`
+	Info     RawMessage             `bencode:"info"`
+	Comment  *string                `bencode:"comment"`
+	Extra    map[string]interface{} `bencode:"extra,omitempty"`
+}
+
+func TestRoundTrip(t *testing.T) {
+	info := testInfo{
+		Name:        "data",
+		PieceLength: 16384,
+		Pieces:      strings.Repeat("\x00\xff", 10),
+		Files:       []testFile{{Length: 5, Path: []string{"dir", "a.txt"}}, {Length: 0, Path: []string{"b"}}},
+		Hash:        [4]byte{1, 2, 3, 4},
+		Seed:        true,
+		Ignored:     "not encoded",
+	}
+	data, err := Marshal(info)
+	if err != nil {
+		t.Fatalf("failed to marshal: %v", err)
+	}
+	expected := "d5:filesld6:lengthi5e4:pathl3:dir5:a.txteed6:lengthi0e4:pathl1:beee4:hash4:\x01\x02\x03\x04" +
+		"4:name4:data12:piece lengthi16384e6:pieces20:" + info.Pieces + "4:seedi1ee"
+	if string(data) != expected {
+		t.Fatalf("unexpected encoding:\n%q\nexpected\n%q", data, expected)
+	}
+
+	decoded := testInfo{}
+	if err = UnmarshalStrict(data, &decoded); err != nil {
+		t.Fatalf("failed to unmarshal: %v", err)
+	}
+	info.Ignored = ""
+	if !reflect.DeepEqual(decoded, info) {
+		t.Fatalf("decoded %+v expected %+v", decoded, info)
+	}
+
+	comment := "comment"
+	torrent := testTorrent{
+		Announce: "udp://tracker:80",
+		Info:     data,
+		Comment:  &comment,
+		Extra:    map[string]interface{}{"list": []interface{}{int64(-1), "x"}, "dict": map[string]interface{}{"k": "v"}},
+	}
+	encodedTorrent, err := Marshal(torrent)
+	if err != nil {
+		t.Fatalf("failed to marshal: %v", err)
+	}
+	decodedTorrent := testTorrent{}
+	if err = UnmarshalStrict(encodedTorrent, &decodedTorrent); err != nil {
+		t.Fatalf("failed to unmarshal: %v", err)
+	}
+	if !bytes.Equal(decodedTorrent.Info, data) {
+		t.Errorf("raw message %q expected %q", decodedTorrent.Info, data)
+	}
+	if !reflect.DeepEqual(decodedTorrent, torrent) {
+		t.Errorf("decoded %+v expected %+v", decodedTorrent, torrent)
+	}
+}
+
+func TestUnmarshalSkipsUnknownKeys(t *testing.T) {
+	decoded := testFile{}
+	if err := Unmarshal([]byte("d7:unknownld1:xi1eee6:lengthi7e4:pathl1:aee"), &decoded); err != nil {
+		t.Fatalf("failed to unmarshal: %v", err)
+	}
+	if decoded.Length != 7 || !reflect.DeepEqual(decoded.Path, []string{"a"}) {
+		t.Errorf("unexpected value %+v", decoded)
+	}
+}
+
+func TestStrictMode(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{name: "unsorted keys", input: "d1:bi1e1:ai2ee"},
+		{name: "duplicated keys", input: "d1:ai1e1:ai2ee"},
+		{name: "leading zero in integer", input: "i012e"},
+		{name: "negative zero", input: "i-0e"},
+		{name: "leading zero in length", input: "01:a"},
+		{name: "trailing data", input: "i1ei2e"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var lenient interface{}
+			if err := Unmarshal([]byte(tt.input), &lenient); err != nil {
+				t.Errorf("lenient mode must accept %q: %v", tt.input, err)
+			}
+			var strict interface{}
+			var syntaxErr *SyntaxError
+			if err := UnmarshalStrict([]byte(tt.input), &strict); !errors.As(err, &syntaxErr) {
+				t.Errorf("strict mode must reject %q with syntax error, got %v", tt.input, err)
+			}
+		})
+	}
+}
+
+func TestSyntaxErrorOffset(t *testing.T) {
+	tests := []struct {
+		input  string
+		offset int64
+	}{
+		{input: "", offset: 0},
+		{input: "x", offset: 0},
+		{input: "i12", offset: 0},
+		{input: "i1x2e", offset: 0},
+		{input: "l1:ai1e", offset: 7},
+		{input: "d1:ai1ei2ei3ee", offset: 7},
+		{input: "l5:abce", offset: 1},
+		{input: "d3:keyl5:valuee3:badi1xee", offset: 20},
+	}
+	for _, tt := range tests {
+		var v interface{}
+		err := Unmarshal([]byte(tt.input), &v)
+		var syntaxErr *SyntaxError
+		if !errors.As(err, &syntaxErr) {
+			t.Errorf("%q: expected syntax error got %v", tt.input, err)
+			continue
+		}
+		if syntaxErr.Offset != tt.offset {
+			t.Errorf("%q: expected offset %d got %d (%v)", tt.input, tt.offset, syntaxErr.Offset, err)
+		}
+	}
+}
+
+func TestUnmarshalTypeError(t *testing.T) {
+	decoded := testFile{}
+	err := Unmarshal([]byte("d6:length3:abce"), &decoded)
+	var typeErr *UnmarshalTypeError
+	if !errors.As(err, &typeErr) || typeErr.Offset != 9 {
+		t.Fatalf("expected type error at offset 9 got %v", err)
+	}
+}
+
+func TestMaxDepth(t *testing.T) {
+	allowed := strings.Repeat("l", MaxDepth) + strings.Repeat("e", MaxDepth)
+	var v interface{}
+	if err := Unmarshal([]byte(allowed), &v); err != nil {
+		t.Fatalf("nesting of %d must be allowed: %v", MaxDepth, err)
+	}
+
+	tooDeep := []string{
+		strings.Repeat("l", MaxDepth+1) + strings.Repeat("e", MaxDepth+1),
+		strings.Repeat("d1:a", MaxDepth+1) + "i1e" + strings.Repeat("e", MaxDepth+1),
+		// input which isn't terminated must be rejected before stack grows
+		strings.Repeat("l", 1_000_000),
+	}
+	for _, input := range tooDeep {
+		var syntaxErr *SyntaxError
+		if err := Unmarshal([]byte(input), &v); !errors.As(err, &syntaxErr) {
+			t.Errorf("expected syntax error for generic value got %v", err)
+		}
+		var raw RawMessage
+		if err := Unmarshal([]byte(input), &raw); !errors.As(err, &syntaxErr) {
+			t.Errorf("expected syntax error for raw message got %v", err)
+		}
+		var nested [][]interface{}
+		if err := Unmarshal([]byte(input), &nested); err == nil {
+			t.Error("expected error for typed value")
+		}
+		if err := NewDecoder(strings.NewReader(input)).Decode(&v); !errors.As(err, &syntaxErr) {
+			t.Errorf("expected syntax error from stream decoder got %v", err)
+		}
+	}
+}
+
+func TestDecoderStream(t *testing.T) {
+	decoder := NewDecoder(strings.NewReader("i1e4:spamd1:ai2eei3xe"))
+	var n int
+	if err := decoder.Decode(&n); err != nil || n != 1 {
+		t.Fatalf("expected 1 got %d, %v", n, err)
+	}
+	var s string
+	if err := decoder.Decode(&s); err != nil || s != "spam" {
+		t.Fatalf("expected spam got %q, %v", s, err)
+	}
+	var m map[string]int
+	if err := decoder.Decode(&m); err != nil || m["a"] != 2 {
+		t.Fatalf("expected map got %v, %v", m, err)
+	}
+	if decoder.InputOffset() != 17 {
+		t.Errorf("expected offset 17 got %d", decoder.InputOffset())
+	}
+	// offset of error in the next value is counted from the beginning of the stream
+	err := decoder.Decode(&n)
+	var syntaxErr *SyntaxError
+	if !errors.As(err, &syntaxErr) || syntaxErr.Offset != 17 {
+		t.Fatalf("expected syntax error at offset 17 got %v", err)
+	}
+
+	if err = NewDecoder(strings.NewReader("")).Decode(&n); !errors.Is(err, io.EOF) {
+		t.Errorf("expected EOF got %v", err)
+	}
+	var list []string
+	if err = NewDecoder(strings.NewReader("l1:a")).Decode(&list); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("expected unexpected EOF got %v", err)
+	}
+}
+
+func TestMarshalErrors(t *testing.T) {
+	if _, err := Marshal(nil); err == nil {
+		t.Error("expected error for nil")
+	}
+	if _, err := Marshal(1.5); err == nil {
+		t.Error("expected error for float")
+	}
+	if _, err := Marshal(map[int]string{1: "a"}); err == nil {
+		t.Error("expected error for map with integer keys")
+	}
+	var unmarshalErr *InvalidUnmarshalError
+	if err := Unmarshal([]byte("i1e"), 1); !errors.As(err, &unmarshalErr) {
+		t.Errorf("expected invalid unmarshal error got %v", err)
+	}
+}
@@ -0,0 +1,521 @@
+package bencode
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strconv"
+)
+
+// RawMessage is a raw encoded bencode value. It can be used to delay decoding of a value
+// or to keep its exact bytes, for example to calculate info hash of a torrent.
+type RawMessage []byte
+
+var rawMessageType = reflect.TypeOf(RawMessage(nil))
+
+// MaxDepth limits nesting of lists and dictionaries, so malformed input from peers and trackers
+// can't overflow the stack of decoder.
+const MaxDepth = 256
+
+// SyntaxError describes malformed or non-canonical input, Offset is a position of the
+// problem in the input.
+type SyntaxError struct {
+	Offset int64
+	msg    string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("bencode: syntax error at offset %d: %s", e.Offset, e.msg)
+}
+
+// UnmarshalTypeError describes a value which can't be stored in Go value of specific type.
+type UnmarshalTypeError struct {
+	Value  string
+	Type   reflect.Type
+	Offset int64
+}
+
+func (e *UnmarshalTypeError) Error() string {
+	return fmt.Sprintf("bencode: cannot unmarshal %s into Go value of type %s at offset %d", e.Value, e.Type, e.Offset)
+}
+
+// InvalidUnmarshalError describes an invalid argument passed to Unmarshal.
+type InvalidUnmarshalError struct {
+	Type reflect.Type
+}
+
+func (e *InvalidUnmarshalError) Error() string {
+	if e.Type == nil {
+		return "bencode: Unmarshal(nil)"
+	}
+	return fmt.Sprintf("bencode: Unmarshal(non-pointer or nil %s)", e.Type)
+}
+
+// Unmarshal decodes the first bencoded value of data and stores it in the value pointed by v.
+// Data after the value is ignored. Unknown keys of dictionaries decoded into structs are skipped.
+func Unmarshal(data []byte, v interface{}) error {
+	_, err := unmarshal(data, v, false)
+	return err
+}
+
+// UnmarshalStrict is like Unmarshal but accepts only canonical encoding: keys of dictionaries
+// must be sorted and unique, integers and lengths of strings must not have leading zeros and
+// there must be no data after the value.
+func UnmarshalStrict(data []byte, v interface{}) error {
+	end, err := unmarshal(data, v, true)
+	if err != nil {
+		return err
+	}
+	if end != len(data) {
+		return &SyntaxError{Offset: int64(end), msg: "trailing data after top-level value"}
+	}
+	return nil
+}
+
+func unmarshal(data []byte, v interface{}, strict bool) (int, error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return 0, &InvalidUnmarshalError{Type: reflect.TypeOf(v)}
+	}
+	d := &decodeState{data: data, strict: strict}
+	if err := d.value(rv.Elem()); err != nil {
+		return 0, err
+	}
+	return d.pos, nil
+}
+
+type decodeState struct {
+	data []byte
+	pos  int
+	// base is an offset of data in the whole input, it's used only in errors
+	base   int64
+	strict bool
+	// depth is a count of lists and dictionaries which contain the current value
+	depth int
+}
+
+func (d *decodeState) syntaxError(pos int, format string, args ...interface{}) error {
+	return &SyntaxError{Offset: d.base + int64(pos), msg: fmt.Sprintf(format, args...)}
+}
+
+func (d *decodeState) typeError(pos int, value string, t reflect.Type) error {
+	return &UnmarshalTypeError{Value: value, Type: t, Offset: d.base + int64(pos)}
+}
+
+// enter must be called before decoding of list or dictionary at pos and leave after it.
+func (d *decodeState) enter(pos int) error {
+	d.depth++
+	if d.depth > MaxDepth {
+		return d.syntaxError(pos, "exceeded max depth of nesting %d", MaxDepth)
+	}
+	return nil
+}
+
+func (d *decodeState) leave() {
+	d.depth--
+}
+
+func (d *decodeState) peek() (byte, error) {
+	if d.pos >= len(d.data) {
+		return 0, d.syntaxError(d.pos, "unexpected end of data")
+	}
+	return d.data[d.pos], nil
+}
+
+func (d *decodeState) value(v reflect.Value) error {
+	start := d.pos
+	c, err := d.peek()
+	if err != nil {
+		return err
+	}
+
+	for v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		v = v.Elem()
+	}
+
+	if v.Type() == rawMessageType {
+		if err = d.skip(); err != nil {
+			return err
+		}
+		v.SetBytes(append([]byte(nil), d.data[start:d.pos]...))
+		return nil
+	}
+
+	if v.Kind() == reflect.Interface && v.NumMethod() == 0 {
+		generic, genericErr := d.generic()
+		if genericErr != nil {
+			return genericErr
+		}
+		v.Set(reflect.ValueOf(generic))
+		return nil
+	}
+
+	switch {
+	case c == 'i':
+		n, intErr := d.integer()
+		if intErr != nil {
+			return intErr
+		}
+		return d.storeInteger(v, n, start)
+	case c == 'l':
+		return d.list(v)
+	case c == 'd':
+		return d.dict(v)
+	case c >= '0' && c <= '9':
+		s, stringErr := d.string()
+		if stringErr != nil {
+			return stringErr
+		}
+		return d.storeString(v, s, start)
+	default:
+		return d.syntaxError(d.pos, "invalid character %q looking for beginning of value", c)
+	}
+}
+
+// integer reads integer in form i<digits>e.
+func (d *decodeState) integer() (int64, error) {
+	start := d.pos
+	d.pos++
+	end := bytes.IndexByte(d.data[d.pos:], 'e')
+	if end < 0 {
+		return 0, d.syntaxError(start, "unterminated integer")
+	}
+	digits := d.data[d.pos : d.pos+end]
+	if err := d.checkNumber(start, digits, true); err != nil {
+		return 0, err
+	}
+	n, err := strconv.ParseInt(string(digits), 10, 64)
+	if err != nil {
+		return 0, d.syntaxError(start, "invalid integer %q", digits)
+	}
+	d.pos += end + 1
+	return n, nil
+}
+
+// checkNumber validates digits of integer or length of string.
+func (d *decodeState) checkNumber(pos int, digits []byte, allowNegative bool) error {
+	unsigned := digits
+	if allowNegative && len(unsigned) > 0 && unsigned[0] == '-' {
+		unsigned = unsigned[1:]
+		if d.strict && len(unsigned) == 1 && unsigned[0] == '0' {
+			return d.syntaxError(pos, "negative zero is not allowed")
+		}
+	}
+	if len(unsigned) == 0 {
+		return d.syntaxError(pos, "empty number")
+	}
+	for _, c := range unsigned {
+		if c < '0' || c > '9' {
+			return d.syntaxError(pos, "invalid character %q in number", c)
+		}
+	}
+	if d.strict && len(unsigned) > 1 && unsigned[0] == '0' {
+		return d.syntaxError(pos, "number %q has leading zeros", digits)
+	}
+	return nil
+}
+
+// string reads string in form <length>:<data>, returned slice points to the input.
+func (d *decodeState) string() ([]byte, error) {
+	start := d.pos
+	colon := bytes.IndexByte(d.data[d.pos:], ':')
+	if colon < 0 {
+		return nil, d.syntaxError(start, "invalid string: no colon after length")
+	}
+	digits := d.data[d.pos : d.pos+colon]
+	if err := d.checkNumber(start, digits, false); err != nil {
+		return nil, err
+	}
+	length, err := strconv.Atoi(string(digits))
+	if err != nil {
+		return nil, d.syntaxError(start, "invalid string length %q", digits)
+	}
+	d.pos += colon + 1
+	if length > len(d.data)-d.pos {
+		return nil, d.syntaxError(start, "string of length %d is longer than the rest of data", length)
+	}
+	res := d.data[d.pos : d.pos+length]
+	d.pos += length
+	return res, nil
+}
+
+// dictKey reads key of dictionary and checks order of keys in strict mode.
+func (d *decodeState) dictKey(prevKey []byte, first bool) ([]byte, error) {
+	start := d.pos
+	c, err := d.peek()
+	if err != nil {
+		return nil, err
+	}
+	if c < '0' || c > '9' {
+		return nil, d.syntaxError(start, "key of dictionary must be a string")
+	}
+	key, err := d.string()
+	if err != nil {
+		return nil, err
+	}
+	if d.strict && !first && bytes.Compare(prevKey, key) >= 0 {
+		return nil, d.syntaxError(start, "key %q is not sorted or duplicated", key)
+	}
+	return key, nil
+}
+
+// skip validates the next value and moves position after it.
+func (d *decodeState) skip() error {
+	c, err := d.peek()
+	if err != nil {
+		return err
+	}
+	switch {
+	case c == 'i':
+		_, err = d.integer()
+		return err
+	case c >= '0' && c <= '9':
+		_, err = d.string()
+		return err
+	case c == 'l':
+		if err = d.enter(d.pos); err != nil {
+			return err
+		}
+		defer d.leave()
+		d.pos++
+		for {
+			if c, err = d.peek(); err != nil {
+				return err
+			}
+			if c == 'e' {
+				d.pos++
+				return nil
+			}
+			if err = d.skip(); err != nil {
+				return err
+			}
+		}
+	case c == 'd':
+		if err = d.enter(d.pos); err != nil {
+			return err
+		}
+		defer d.leave()
+		d.pos++
+		var prevKey []byte
+		for first := true; ; first = false {
+			if c, err = d.peek(); err != nil {
+				return err
+			}
+			if c == 'e' {
+				d.pos++
+				return nil
+			}
+			if prevKey, err = d.dictKey(prevKey, first); err != nil {
+				return err
+			}
+			if err = d.skip(); err != nil {
+				return err
+			}
+		}
+	default:
+		return d.syntaxError(d.pos, "invalid character %q looking for beginning of value", c)
+	}
+}
+
+// generic decodes the next value into int64, string, []interface{} or map[string]interface{}.
+func (d *decodeState) generic() (interface{}, error) {
+	c, err := d.peek()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case c == 'i':
+		return d.integer()
+	case c >= '0' && c <= '9':
+		s, stringErr := d.string()
+		return string(s), stringErr
+	case c == 'l':
+		if err = d.enter(d.pos); err != nil {
+			return nil, err
+		}
+		defer d.leave()
+		d.pos++
+		res := make([]interface{}, 0)
+		for {
+			if c, err = d.peek(); err != nil {
+				return nil, err
+			}
+			if c == 'e' {
+				d.pos++
+				return res, nil
+			}
+			elem, elemErr := d.generic()
+			if elemErr != nil {
+				return nil, elemErr
+			}
+			res = append(res, elem)
+		}
+	case c == 'd':
+		if err = d.enter(d.pos); err != nil {
+			return nil, err
+		}
+		defer d.leave()
+		d.pos++
+		res := make(map[string]interface{})
+		var key []byte
+		for first := true; ; first = false {
+			if c, err = d.peek(); err != nil {
+				return nil, err
+			}
+			if c == 'e' {
+				d.pos++
+				return res, nil
+			}
+			if key, err = d.dictKey(key, first); err != nil {
+				return nil, err
+			}
+			elem, elemErr := d.generic()
+			if elemErr != nil {
+				return nil, elemErr
+			}
+			res[string(key)] = elem
+		}
+	default:
+		return nil, d.syntaxError(d.pos, "invalid character %q looking for beginning of value", c)
+	}
+}
+
+func (d *decodeState) storeInteger(v reflect.Value, n int64, pos int) error {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if v.OverflowInt(n) {
+			return d.typeError(pos, "integer "+strconv.FormatInt(n, 10), v.Type())
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if n < 0 || v.OverflowUint(uint64(n)) {
+			return d.typeError(pos, "integer "+strconv.FormatInt(n, 10), v.Type())
+		}
+		v.SetUint(uint64(n))
+	case reflect.Bool:
+		v.SetBool(n != 0)
+	default:
+		return d.typeError(pos, "integer", v.Type())
+	}
+	return nil
+}
+
+func (d *decodeState) storeString(v reflect.Value, s []byte, pos int) error {
+	switch {
+	case v.Kind() == reflect.String:
+		v.SetString(string(s))
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+		v.SetBytes(append([]byte(nil), s...))
+	case v.Kind() == reflect.Array && v.Type().Elem().Kind() == reflect.Uint8:
+		if v.Len() != len(s) {
+			return d.typeError(pos, fmt.Sprintf("string of length %d", len(s)), v.Type())
+		}
+		reflect.Copy(v, reflect.ValueOf(s))
+	default:
+		return d.typeError(pos, "string", v.Type())
+	}
+	return nil
+}
+
+func (d *decodeState) list(v reflect.Value) error {
+	start := d.pos
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return d.typeError(start, "list", v.Type())
+	}
+	if err := d.enter(start); err != nil {
+		return err
+	}
+	defer d.leave()
+	d.pos++
+	if v.Kind() == reflect.Slice {
+		v.SetLen(0)
+	}
+	for idx := 0; ; idx++ {
+		c, err := d.peek()
+		if err != nil {
+			return err
+		}
+		if c == 'e' {
+			d.pos++
+			if v.Kind() == reflect.Array && idx != v.Len() {
+				return d.typeError(start, fmt.Sprintf("list of length %d", idx), v.Type())
+			}
+			if v.Kind() == reflect.Slice && v.IsNil() {
+				v.Set(reflect.MakeSlice(v.Type(), 0, 0))
+			}
+			return nil
+		}
+		if v.Kind() == reflect.Array {
+			if idx >= v.Len() {
+				return d.typeError(start, "list longer than array", v.Type())
+			}
+			if err = d.value(v.Index(idx)); err != nil {
+				return err
+			}
+			continue
+		}
+		elem := reflect.New(v.Type().Elem()).Elem()
+		if err = d.value(elem); err != nil {
+			return err
+		}
+		v.Set(reflect.Append(v, elem))
+	}
+}
+
+func (d *decodeState) dict(v reflect.Value) error {
+	start := d.pos
+	var fields map[string]field
+	switch {
+	case v.Kind() == reflect.Struct:
+		fields = cachedFields(v.Type()).byName
+	case v.Kind() == reflect.Map && v.Type().Key().Kind() == reflect.String:
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+	default:
+		return d.typeError(start, "dictionary", v.Type())
+	}
+	if err := d.enter(start); err != nil {
+		return err
+	}
+	defer d.leave()
+
+	d.pos++
+	var key []byte
+	for first := true; ; first = false {
+		c, err := d.peek()
+		if err != nil {
+			return err
+		}
+		if c == 'e' {
+			d.pos++
+			return nil
+		}
+		if key, err = d.dictKey(key, first); err != nil {
+			return err
+		}
+
+		if v.Kind() == reflect.Map {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if err = d.value(elem); err != nil {
+				return err
+			}
+			v.SetMapIndex(reflect.ValueOf(string(key)).Convert(v.Type().Key()), elem)
+			continue
+		}
+
+		f, ok := fields[string(key)]
+		if !ok {
+			if err = d.skip(); err != nil {
+				return err
+			}
+			continue
+		}
+		if err = d.value(v.FieldByIndex(f.index)); err != nil {
+			return err
+		}
+	}
+}
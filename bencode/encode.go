@@ -0,0 +1,164 @@
+package bencode
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+)
+
+// UnsupportedTypeError is returned by Marshal for values which can't be encoded.
+type UnsupportedTypeError struct {
+	Type reflect.Type
+}
+
+func (e *UnsupportedTypeError) Error() string {
+	if e.Type == nil {
+		return "bencode: unsupported nil value"
+	}
+	return "bencode: unsupported type: " + e.Type.String()
+}
+
+// Marshal returns bencoding of v. Keys of dictionaries are sorted, nil pointers and interfaces
+// in structs and maps are skipped, fields with "omitempty" option are skipped when they are empty.
+func Marshal(v interface{}) ([]byte, error) {
+	e := &encodeState{}
+	if err := e.value(reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+	return e.Bytes(), nil
+}
+
+type encodeState struct {
+	bytes.Buffer
+}
+
+func (e *encodeState) value(v reflect.Value) error {
+	if !v.IsValid() {
+		return &UnsupportedTypeError{}
+	}
+
+	if v.Type() == rawMessageType {
+		if v.Len() == 0 {
+			return fmt.Errorf("bencode: empty RawMessage")
+		}
+		e.Write(v.Bytes())
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return &UnsupportedTypeError{Type: v.Type()}
+		}
+		return e.value(v.Elem())
+	case reflect.String:
+		e.string(v.String())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		e.WriteByte('i')
+		e.WriteString(strconv.FormatInt(v.Int(), 10))
+		e.WriteByte('e')
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		e.WriteByte('i')
+		e.WriteString(strconv.FormatUint(v.Uint(), 10))
+		e.WriteByte('e')
+	case reflect.Bool:
+		if v.Bool() {
+			e.WriteString("i1e")
+		} else {
+			e.WriteString("i0e")
+		}
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			buf := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(buf), v)
+			e.string(string(buf))
+			return nil
+		}
+		e.WriteByte('l')
+		for idx := 0; idx < v.Len(); idx++ {
+			if err := e.value(v.Index(idx)); err != nil {
+				return err
+			}
+		}
+		e.WriteByte('e')
+	case reflect.Map:
+		return e.dict(v)
+	case reflect.Struct:
+		return e.structure(v)
+	default:
+		return &UnsupportedTypeError{Type: v.Type()}
+	}
+	return nil
+}
+
+func (e *encodeState) string(s string) {
+	e.WriteString(strconv.Itoa(len(s)))
+	e.WriteByte(':')
+	e.WriteString(s)
+}
+
+func (e *encodeState) dict(v reflect.Value) error {
+	if v.Type().Key().Kind() != reflect.String {
+		return &UnsupportedTypeError{Type: v.Type()}
+	}
+	keys := v.MapKeys()
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].String() < keys[j].String()
+	})
+	e.WriteByte('d')
+	for _, key := range keys {
+		elem := v.MapIndex(key)
+		if isNil(elem) {
+			continue
+		}
+		e.string(key.String())
+		if err := e.value(elem); err != nil {
+			return err
+		}
+	}
+	e.WriteByte('e')
+	return nil
+}
+
+func (e *encodeState) structure(v reflect.Value) error {
+	e.WriteByte('d')
+	for _, f := range cachedFields(v.Type()).sorted {
+		fieldValue := v.FieldByIndex(f.index)
+		if isNil(fieldValue) || (f.omitEmpty && isEmptyValue(fieldValue)) {
+			continue
+		}
+		e.string(f.name)
+		if err := e.value(fieldValue); err != nil {
+			return err
+		}
+	}
+	e.WriteByte('e')
+	return nil
+}
+
+func isNil(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		return v.IsNil()
+	default:
+		return false
+	}
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return v.Uint() == 0
+	case reflect.Pointer, reflect.Interface:
+		return v.IsNil()
+	}
+	return false
+}
@@ -0,0 +1,61 @@
+package bencode
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type field struct {
+	name      string
+	index     []int
+	omitEmpty bool
+}
+
+type structFields struct {
+	// sorted are fields sorted by name as bencode requires for keys of dictionaries
+	sorted []field
+	byName map[string]field
+}
+
+var fieldsCache sync.Map
+
+// cachedFields returns fields of struct type which are encoded and decoded. Name of a field is taken
+// from "bencode" tag, fields with tag "-" and unexported fields are ignored.
+func cachedFields(t reflect.Type) *structFields {
+	if cached, ok := fieldsCache.Load(t); ok {
+		return cached.(*structFields)
+	}
+
+	res := &structFields{
+		byName: make(map[string]field),
+	}
+	for idx := 0; idx < t.NumField(); idx++ {
+		structField := t.Field(idx)
+		if !structField.IsExported() {
+			continue
+		}
+		tag := structField.Tag.Get("bencode")
+		if tag == "-" {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = structField.Name
+		}
+		f := field{
+			name:      name,
+			index:     structField.Index,
+			omitEmpty: options == "omitempty",
+		}
+		res.sorted = append(res.sorted, f)
+		res.byName[name] = f
+	}
+	sort.Slice(res.sorted, func(i, j int) bool {
+		return res.sorted[i].name < res.sorted[j].name
+	})
+
+	cached, _ := fieldsCache.LoadOrStore(t, res)
+	return cached.(*structFields)
+}
@@ -0,0 +1,173 @@
+package bencode
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"reflect"
+	"strconv"
+)
+
+// maxStreamStringLength limits length of a single string read by Decoder to protect from
+// allocation of huge buffers because of malformed input.
+const maxStreamStringLength = 64 * 1024 * 1024
+
+// Decoder reads and decodes bencoded values from an input stream.
+type Decoder struct {
+	r      *bufio.Reader
+	offset int64
+	strict bool
+	buf    []byte
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: bufio.NewReader(r)}
+}
+
+// SetStrict makes decoder accept only canonical encoding, see UnmarshalStrict.
+func (d *Decoder) SetStrict(strict bool) {
+	d.strict = strict
+}
+
+// InputOffset returns count of bytes consumed by decoded values.
+func (d *Decoder) InputOffset() int64 {
+	return d.offset
+}
+
+// Decode reads the next bencoded value from the input and stores it in the value pointed by v.
+// io.EOF is returned if there are no more values in the input.
+func (d *Decoder) Decode(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return &InvalidUnmarshalError{Type: reflect.TypeOf(v)}
+	}
+
+	start := d.offset
+	d.buf = d.buf[:0]
+	if err := d.readValue(); err != nil {
+		return err
+	}
+
+	state := &decodeState{data: d.buf, base: start, strict: d.strict}
+	return state.value(rv.Elem())
+}
+
+func (d *Decoder) readByte() (byte, error) {
+	c, err := d.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	d.offset++
+	d.buf = append(d.buf, c)
+	return c, nil
+}
+
+func (d *Decoder) syntaxError(msg string) error {
+	return &SyntaxError{Offset: d.offset, msg: msg}
+}
+
+// readValue reads bytes of a single value to the buffer, validation of the value is done by decodeState.
+func (d *Decoder) readValue() error {
+	depth := 0
+	for {
+		c, err := d.readByte()
+		if err != nil {
+			if errors.Is(err, io.EOF) && len(d.buf) > 0 {
+				return io.ErrUnexpectedEOF
+			}
+			return err
+		}
+
+		switch {
+		case c == 'i':
+			if err = d.readUntil('e'); err != nil {
+				return err
+			}
+		case c >= '0' && c <= '9':
+			if err = d.readString(c); err != nil {
+				return err
+			}
+		case c == 'l' || c == 'd':
+			depth++
+			if depth > MaxDepth {
+				return d.syntaxError("exceeded max depth of nesting " + strconv.Itoa(MaxDepth))
+			}
+		case c == 'e' && depth > 0:
+			depth--
+		default:
+			return d.syntaxError("invalid character " + strconv.QuoteRune(rune(c)))
+		}
+
+		if depth == 0 {
+			return nil
+		}
+	}
+}
+
+func (d *Decoder) readUntil(delim byte) error {
+	for {
+		c, err := d.readByte()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		if c == delim {
+			return nil
+		}
+	}
+}
+
+func (d *Decoder) readString(first byte) error {
+	length := int(first - '0')
+	for {
+		c, err := d.readByte()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		if c == ':' {
+			break
+		}
+		if c < '0' || c > '9' {
+			return d.syntaxError("invalid character " + strconv.QuoteRune(rune(c)) + " in length of string")
+		}
+		length = length*10 + int(c-'0')
+		if length > maxStreamStringLength {
+			return d.syntaxError("string is too long")
+		}
+	}
+
+	start := len(d.buf)
+	d.buf = append(d.buf, make([]byte, length)...)
+	n, err := io.ReadFull(d.r, d.buf[start:])
+	d.offset += int64(n)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return nil
+}
+
+// Encoder writes bencoded values to an output stream.
+type Encoder struct {
+	w io.Writer
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+func (e *Encoder) Encode(v interface{}) error {
+	data, err := Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = e.w.Write(data)
+	return err
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	torrent_decoder "github.com/hihoak/torrent-cli/services/torrent-file-decoder"
+	"github.com/rs/zerolog"
+	log "github.com/rs/zerolog/log"
+	"os"
+	"strings"
+)
+
+const (
+	exitOK      = 0
+	exitFailure = 1
+	exitUsage   = 2
+)
+
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+type command struct {
+	name        string
+	description string
+	run         func(args []string) int
+}
+
+// commonFlags are flags accepted by every command.
+type commonFlags struct {
+	logLevel string
+	output   string
+	json     bool
+}
+
+func newFlagSet(name, usage string) (*flag.FlagSet, *commonFlags) {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	common := &commonFlags{}
+	flags.StringVar(&common.logLevel, "log-level", "info", "log level: trace, debug, info, warn, error")
+	flags.StringVar(&common.output, "output", outputText, "output format: text or json")
+	flags.BoolVar(&common.json, "json", false, "shortcut for --output json")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: torrent-cli %s %s\n\nflags:\n", name, usage)
+		flags.PrintDefaults()
+	}
+	return flags, common
+}
+
+// parseFlags parses arguments and applies common flags. If ok is false command must exit with returned code.
+func parseFlags(flags *flag.FlagSet, common *commonFlags, args []string, expectedArgs int) (code int, ok bool) {
+	// flags may follow arguments, so parsing continues after every argument
+	var arguments []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			if errors.Is(err, flag.ErrHelp) {
+				return exitOK, false
+			}
+			return exitUsage, false
+		}
+		if flags.NArg() == 0 {
+			break
+		}
+		arguments = append(arguments, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+	if err := flags.Parse(arguments); err != nil {
+		return exitUsage, false
+	}
+	if flags.NArg() != expectedArgs {
+		fmt.Fprintf(flags.Output(), "expected %d arguments got %d\n", expectedArgs, flags.NArg())
+		flags.Usage()
+		return exitUsage, false
+	}
+	if common.json {
+		common.output = outputJSON
+	}
+	if common.output != outputText && common.output != outputJSON {
+		fmt.Fprintf(flags.Output(), "unknown output format %q\n", common.output)
+		return exitUsage, false
+	}
+	level, err := zerolog.ParseLevel(common.logLevel)
+	if err != nil {
+		fmt.Fprintf(flags.Output(), "unknown log level %q\n", common.logLevel)
+		return exitUsage, false
+	}
+	zerolog.SetGlobalLevel(level)
+	if common.output == outputText {
+		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	}
+	return exitOK, true
+}
+
+func openTorrentFile(path string) (*torrent_decoder.TorrentFile, error) {
+	data, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open torrent file: %w", err)
+	}
+	defer func() {
+		if closeErr := data.Close(); closeErr != nil {
+			log.Error().Err(closeErr).Msg("failed to close torrent file")
+		}
+	}()
+	file, err := torrent_decoder.Unmarshall(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode torrent file %q: %w", path, err)
+	}
+	return file, nil
+}
+
+func printJSON(value interface{}) int {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(value); err != nil {
+		log.Error().Err(err).Msg("failed to encode output")
+		return exitFailure
+	}
+	return exitOK
+}
+
+// stringsFlag is a flag which can be passed several times.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringsFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
@@ -2,14 +2,43 @@ package torrent
 
 type Bitfield []byte
 
+func NewBitfield(piecesCount int) Bitfield {
+	return make(Bitfield, (piecesCount+7)/8)
+}
+
 func (b Bitfield) HasPiece(id int) bool {
 	byteID := id / 8
 	bitOffset := id % 8
+	if id < 0 || byteID >= len(b) {
+		return false
+	}
 	return b[byteID]>>(7-bitOffset)&1 != 0
 }
 
 func (b Bitfield) SetPiece(id int) {
 	byteID := id / 8
 	bitOffset := id % 8
+	if id < 0 || byteID >= len(b) {
+		return
+	}
 	b[byteID] |= 1 << (7 - bitOffset)
 }
+
+func (b Bitfield) ClearPiece(id int) {
+	byteID := id / 8
+	bitOffset := id % 8
+	if id < 0 || byteID >= len(b) {
+		return
+	}
+	b[byteID] &^= 1 << (7 - bitOffset)
+}
+
+// IsEmpty reports that no piece is set.
+func (b Bitfield) IsEmpty() bool {
+	for _, bits := range b {
+		if bits != 0 {
+			return false
+		}
+	}
+	return true
+}
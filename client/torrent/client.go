@@ -6,10 +6,18 @@ import (
 	torrent_file_decoder "github.com/hihoak/torrent-cli/services/torrent-file-decoder"
 	log "github.com/rs/zerolog/log"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
+	// keepAliveInterval is how long connection may have no outgoing messages before keep-alive is sent,
+	// peers usually drop connections which are silent for two minutes
+	keepAliveInterval = 90 * time.Second
+	// IdleTimeout is how long peer may send nothing, including keep-alives, before connection is dropped
+	IdleTimeout = 3 * time.Minute
+
 	torrentIdentifier       = "BitTorrent protocol"
 	additionalOptionsLength = 8
 	fileVerifyHashLength    = 20
@@ -18,10 +26,43 @@ const (
 
 type Client struct {
 	conn     net.Conn
+	infoHash [20]byte
 	bitfield Bitfield
 	PeerID   string
 
 	Chocked bool
+
+	supportsExtensions bool
+	// supportsFast is set when both sides support fast extension (BEP 6)
+	supportsFast bool
+	extensions   *ExtensionRegistry
+	// peerExtensions are IDs of extensions announced by peer in extended handshake
+	peerExtensions map[string]int
+	// ExtendedHandshakeReceived is set when peer sent its extended handshake
+	ExtendedHandshakeReceived bool
+	// MetadataSize is a size of info dictionary announced by peer in extended handshake
+	MetadataSize int
+	// RequestQueueSize is a count of outstanding requests which peer accepts, 0 if peer didn't announce it
+	RequestQueueSize int
+	// ClientVersion is a name and version of peer's client
+	ClientVersion string
+	// ListenPort is a port on which peer accepts connections, 0 if peer didn't announce it
+	ListenPort uint16
+	// ExternalIP is our IP address as peer sees it
+	ExternalIP net.IP
+
+	// pending is a message which was read while waiting for bitfield
+	pending *Message
+
+	// writeMu serializes messages which are sent from different goroutines
+	writeMu sync.Mutex
+	// downloaded and uploaded are counters of payload bytes of blocks
+	downloaded int64
+	uploaded   int64
+	// lastWrite is unix time in nanoseconds when the last message was sent
+	lastWrite int64
+	// idleTimeout is a read deadline which is set before every message, 0 means no deadline
+	idleTimeout time.Duration
 }
 
 func processHandshake(conn net.Conn, verifyHash [20]byte) (*torrentProtocolHandshake, error) {
@@ -46,43 +87,172 @@ func processHandshake(conn net.Conn, verifyHash [20]byte) (*torrentProtocolHands
 	return handshake, nil
 }
 
-func getPeersBitfield(conn net.Conn) (Bitfield, error) {
-	message, err := UnmarshallMessage(conn)
+// ReceiveBitfield reads messages until bitfield, extended handshake sent before it is handled by client.
+// HAVE ALL and HAVE NONE are accepted instead of bitfield if fast extension is supported.
+// Peer which has no pieces may not send bitfield, in that case the first other message is kept
+// and returned by the next ReadMessage. Bitfield must arrive during idle timeout or IdleTimeout if
+// it isn't set, keep-alives don't extend it.
+func (c *Client) ReceiveBitfield(piecesCount int) error {
+	timeout := c.idleTimeout
+	if timeout <= 0 {
+		timeout = IdleTimeout
+	}
+	if err := c.conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return fmt.Errorf("failed to set read deadline: %w", err)
+	}
+	bitField, err := c.getPeersBitfield(piecesCount)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read bitfield message: %w", err)
+		return err
 	}
-
-	if message.ID != MsgBitfield {
-		return nil, fmt.Errorf("wrong message ID %s expect %s", message.ID, MsgBitfield)
+	if deadlineErr := c.conn.SetReadDeadline(time.Time{}); deadlineErr != nil {
+		return fmt.Errorf("failed to reset read deadline: %w", deadlineErr)
 	}
+	c.bitfield = bitField
+	return nil
+}
+
+func (c *Client) getPeersBitfield(piecesCount int) (Bitfield, error) {
+	for {
+		message, err := UnmarshallMessage(c.conn)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read bitfield message: %w", err)
+		}
+
+		if message == nil {
+			continue
+		}
+		if message.ID == MsgExtended && len(message.Payload) > 0 && message.Payload[0] == extendedHandshakeID {
+			if _, _, extendedErr := c.HandleExtended(message); extendedErr != nil {
+				return nil, fmt.Errorf("failed to handle extended handshake: %w", extendedErr)
+			}
+			continue
+		}
+
+		if c.supportsFast && message.ID == MsgHaveAll {
+			bitfield := NewBitfield(piecesCount)
+			for idx := 0; idx < piecesCount; idx++ {
+				bitfield.SetPiece(idx)
+			}
+			return bitfield, nil
+		}
+		if c.supportsFast && message.ID == MsgHaveNone {
+			return NewBitfield(piecesCount), nil
+		}
+		if message.ID != MsgBitfield {
+			c.pending = message
+			return NewBitfield(piecesCount), nil
+		}
+		if len(message.Payload) != len(NewBitfield(piecesCount)) {
+			return nil, fmt.Errorf("wrong length of bitfield %d expect %d", len(message.Payload), len(NewBitfield(piecesCount)))
+		}
 
-	return message.Payload, nil
+		return message.Payload, nil
+	}
 }
 
-func NewClient(torrentFile *torrent_file_decoder.TorrentFile, peer *peers.Peer) (*Client, error) {
+// Connect establishes connection to peer and exchanges handshakes, peer's bitfield is not read.
+// Our pieces are sent to peer right after handshake if have is not empty.
+func Connect(infoHash [20]byte, peer *peers.Peer, have Bitfield) (*Client, error) {
 	fmt.Println("start initializing connect to:", peer.IP.String())
-	conn, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%d", peer.IP.String(), peer.Port), 3*time.Second)
+	conn, err := net.DialTimeout("tcp", peer.String(), 3*time.Second)
 	if err != nil {
 		return nil, fmt.Errorf("failed to init connection to peer %v: %w", peer, err)
 	}
 
-	handshake, handshakeErr := processHandshake(conn, torrentFile.VerifyHash)
+	handshake, handshakeErr := processHandshake(conn, infoHash)
 	if handshakeErr != nil {
+		_ = conn.Close()
 		return nil, fmt.Errorf("failed to process handshake: %w", handshakeErr)
 	}
 
-	bitField, bitFieldErr := getPeersBitfield(conn)
-	if bitFieldErr != nil {
+	return newClient(conn, handshake, have)
+}
+
+func newClient(conn net.Conn, handshake *torrentProtocolHandshake, have Bitfield) (*Client, error) {
+	client := &Client{
+		conn:               conn,
+		infoHash:           handshake.fileVerifyHash,
+		PeerID:             string(handshake.PeerID[:]),
+		Chocked:            true,
+		supportsExtensions: handshake.supportsExtensionProtocol(),
+		supportsFast:       handshake.supportsFastExtension(),
+		extensions:         DefaultExtensions,
+		lastWrite:          time.Now().UnixNano(),
+	}
+	if err := client.sendHave(have); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if client.supportsExtensions {
+		if extendedErr := client.sendExtendedHandshake(); extendedErr != nil {
+			_ = conn.Close()
+			return nil, extendedErr
+		}
+	}
+	return client, nil
+}
+
+// sendHave sends our pieces right after handshake. Peer with fast extension expects one of
+// BITFIELD, HAVE NONE or HAVE ALL, otherwise bitfield is sent only if we have something.
+func (c *Client) sendHave(have Bitfield) error {
+	if len(have) > 0 && !have.IsEmpty() {
+		return c.SendBitfield(have)
+	}
+	if c.supportsFast {
+		return c.SendHaveNone()
+	}
+	return nil
+}
+
+// Accept performs responder side of handshake on incoming connection: handshake of the peer is read
+// first and our handshake is sent back only if lookup reports that we serve requested info hash.
+// lookup returns our pieces of the torrent.
+func Accept(conn net.Conn, lookup func(infoHash [20]byte) (Bitfield, bool)) (*Client, [20]byte, error) {
+	if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		return nil, [20]byte{}, fmt.Errorf("failed to send deadline timeout: %w", err)
+	}
+
+	handshake, err := readHandshake(conn)
+	if err != nil {
+		return nil, [20]byte{}, fmt.Errorf("failed to recv handshake: %w", err)
+	}
+	infoHash := handshake.fileVerifyHash
+	have, ok := lookup(infoHash)
+	if !ok {
+		return nil, infoHash, fmt.Errorf("unknown info hash %x", infoHash)
+	}
+	if handshakeErr := SendHandshake(conn, infoHash, peers.MyPeerID); handshakeErr != nil {
+		return nil, infoHash, fmt.Errorf("failed to send handshake: %w", handshakeErr)
+	}
+
+	if deadlineErr := conn.SetDeadline(time.Time{}); deadlineErr != nil {
+		return nil, infoHash, fmt.Errorf("failed to reset deadline: %w", deadlineErr)
+	}
+	client, err := newClient(conn, handshake, have)
+	return client, infoHash, err
+}
+
+func NewClient(torrentFile *torrent_file_decoder.TorrentFile, peer *peers.Peer, have Bitfield) (*Client, error) {
+	client, err := Connect(torrentFile.VerifyHash, peer, have)
+	if err != nil {
+		return nil, err
+	}
+
+	if bitFieldErr := client.ReceiveBitfield(len(torrentFile.PieceHashes)); bitFieldErr != nil {
+		_ = client.Close()
 		return nil, fmt.Errorf("failed to retrieve bitfield: %w", bitFieldErr)
 	}
 
 	fmt.Println("successfully established connection to:", peer.IP.String())
-	return &Client{
-		conn:     conn,
-		bitfield: bitField,
-		PeerID:   string(handshake.PeerID[:]),
-		Chocked:  true,
-	}, nil
+	return client, nil
+}
+
+func (c *Client) SetDeadline(deadline time.Time) error {
+	return c.conn.SetDeadline(deadline)
+}
+
+func (c *Client) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
 }
 
 func (c *Client) Close() error {
@@ -97,17 +267,92 @@ func (c *Client) SetPieceToDownload(id int) {
 	c.bitfield.SetPiece(id)
 }
 
+// send writes message to peer, it is safe to call it from different goroutines.
+func (c *Client) send(msg *Message) error {
+	return c.write(Marshall(msg))
+}
+
+func (c *Client) write(data []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if _, err := c.conn.Write(data); err != nil {
+		return err
+	}
+	atomic.StoreInt64(&c.lastWrite, time.Now().UnixNano())
+	return nil
+}
+
+// SetIdleTimeout makes ReadMessage fail when peer sends nothing during timeout.
+// It must be called before messages are read.
+func (c *Client) SetIdleTimeout(timeout time.Duration) {
+	c.idleTimeout = timeout
+}
+
+// SendKeepAlive sends message of zero length which keeps connection open.
+func (c *Client) SendKeepAlive() error {
+	if err := c.write(make([]byte, messageBytesSizeLength)); err != nil {
+		return fmt.Errorf("failed to send keep-alive to client: %w", err)
+	}
+	return nil
+}
+
+// KeepAlive sends keep-alive when nothing was sent to peer for a while, until stop is closed
+// or connection fails.
+func (c *Client) KeepAlive(stop <-chan struct{}) {
+	ticker := time.NewTicker(keepAliveInterval / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			lastWrite := time.Unix(0, atomic.LoadInt64(&c.lastWrite))
+			if now.Sub(lastWrite) < keepAliveInterval {
+				continue
+			}
+			if err := c.SendKeepAlive(); err != nil {
+				log.Debug().Err(err).Msgf("stop sending keep-alives to %s", c.RemoteAddr())
+				return
+			}
+		}
+	}
+}
+
+// Downloaded returns count of bytes of blocks received from peer.
+func (c *Client) Downloaded() int64 {
+	return atomic.LoadInt64(&c.downloaded)
+}
+
+// Uploaded returns count of bytes of blocks sent to peer.
+func (c *Client) Uploaded() int64 {
+	return atomic.LoadInt64(&c.uploaded)
+}
+
 func (c *Client) SendHave(pieceID int) error {
 	msg := CreateHaveMessage(pieceID)
-	if _, err := c.conn.Write(Marshall(msg)); err != nil {
+	if err := c.send(msg); err != nil {
 		return fmt.Errorf("failed to send %q message to client: %w", MsgHave, err)
 	}
 	return nil
 }
 
+func (c *Client) SendBitfield(bitfield Bitfield) error {
+	if err := c.send(CreateBitfieldMessage(bitfield)); err != nil {
+		return fmt.Errorf("failed to send %d message to client: %w", MsgBitfield, err)
+	}
+	return nil
+}
+
+func (c *Client) SendChoke() error {
+	if err := c.send(CreateChokeMessage()); err != nil {
+		return fmt.Errorf("failed to send %d message to client: %w", MsgChoke, err)
+	}
+	return nil
+}
+
 func (c *Client) SendUnchoke() error {
 	msg := CreateUnchokeMessage()
-	if _, err := c.conn.Write(Marshall(msg)); err != nil {
+	if err := c.send(msg); err != nil {
 		return fmt.Errorf("failed to send %q message to client: %w", MsgUnchoke, err)
 	}
 	return nil
@@ -115,7 +360,7 @@ func (c *Client) SendUnchoke() error {
 
 func (c *Client) SendInterested() error {
 	msg := CreateInterestedMessage()
-	if _, err := c.conn.Write(Marshall(msg)); err != nil {
+	if err := c.send(msg); err != nil {
 		return fmt.Errorf("failed to send %q message to client: %w", MsgInterested, err)
 	}
 	return nil
@@ -123,10 +368,41 @@ func (c *Client) SendInterested() error {
 
 func (c *Client) SendRequest(index, begin, length int) error {
 	message := CreateRequestMessage(index, begin, length)
-	_, err := c.conn.Write(Marshall(message))
-	return err
+	return c.send(message)
+}
+
+func (c *Client) SendCancel(index, begin, length int) error {
+	if err := c.send(CreateCancelMessage(index, begin, length)); err != nil {
+		return fmt.Errorf("failed to send %d message to client: %w", MsgCancel, err)
+	}
+	return nil
+}
+
+func (c *Client) SendPiece(index, begin int, block []byte) error {
+	if err := c.send(CreatePieceMessage(index, begin, block)); err != nil {
+		return fmt.Errorf("failed to send %d message to client: %w", MsgPiece, err)
+	}
+	atomic.AddInt64(&c.uploaded, int64(len(block)))
+	return nil
 }
 
 func (c *Client) ReadMessage() (*Message, error) {
-	return UnmarshallMessage(c.conn)
+	if c.pending != nil {
+		msg := c.pending
+		c.pending = nil
+		return msg, nil
+	}
+	if c.idleTimeout > 0 {
+		if err := c.conn.SetReadDeadline(time.Now().Add(c.idleTimeout)); err != nil {
+			return nil, fmt.Errorf("failed to set read deadline: %w", err)
+		}
+	}
+	msg, err := UnmarshallMessage(c.conn)
+	if err != nil {
+		return nil, err
+	}
+	if msg != nil && msg.ID == MsgPiece && len(msg.Payload) > 8 {
+		atomic.AddInt64(&c.downloaded, int64(len(msg.Payload)-8))
+	}
+	return msg, nil
 }
@@ -0,0 +1,55 @@
+package torrent
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// acceptSilentPeer accepts connection of peer which sends handshake and then nothing but keep-alives
+// if keepAlives is set.
+func acceptSilentPeer(t *testing.T, keepAlives bool) *Client {
+	local, remote := net.Pipe()
+	t.Cleanup(func() {
+		_ = local.Close()
+		_ = remote.Close()
+	})
+	infoHash := [20]byte{1}
+	go func() {
+		if err := SendHandshake(remote, infoHash, [20]byte{2}); err != nil {
+			return
+		}
+		// our handshake and messages after it are read, so writes of the client don't block
+		go func() { _, _ = io.Copy(io.Discard, remote) }()
+		for keepAlives {
+			if _, err := remote.Write(make([]byte, messageBytesSizeLength)); err != nil {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	client, _, err := Accept(local, func([20]byte) (Bitfield, bool) { return NewBitfield(8), true })
+	if err != nil {
+		t.Fatalf("failed to accept: %v", err)
+	}
+	return client
+}
+
+func TestReceiveBitfieldTimesOutOnSilentPeer(t *testing.T) {
+	for _, keepAlives := range []bool{false, true} {
+		client := acceptSilentPeer(t, keepAlives)
+		client.SetIdleTimeout(50 * time.Millisecond)
+
+		start := time.Now()
+		err := client.ReceiveBitfield(8)
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("keep-alives %t: expected deadline error got %v", keepAlives, err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("keep-alives %t: expected bitfield to be awaited for idle timeout, waited %s", keepAlives, elapsed)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package torrent
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/hihoak/torrent-cli/bencode"
+	"net"
+	"sync"
+)
+
+const (
+	extensionProtocolReservedByte = 5
+	extensionProtocolReservedBit  = 0x10
+
+	extendedHandshakeID = 0
+	clientVersion       = "torrent-cli"
+
+	// ExtensionMetadata is a name of metadata exchange extension (BEP 9)
+	ExtensionMetadata = "ut_metadata"
+	// ExtensionPEX is a name of peer exchange extension
+	ExtensionPEX = "ut_pex"
+
+	// LocalRequestQueueSize is a count of outstanding requests which we accept from one peer,
+	// it is announced as reqq in extended handshake
+	LocalRequestQueueSize = 256
+)
+
+type extendedHandshake struct {
+	M            map[string]int `bencode:"m"`
+	V            string         `bencode:"v,omitempty"`
+	P            int            `bencode:"p,omitempty"`
+	MetadataSize int            `bencode:"metadata_size,omitempty"`
+	// Reqq is a count of outstanding requests which peer accepts without dropping
+	Reqq int `bencode:"reqq,omitempty"`
+	// YourIP is IP address of the receiver as the sender sees it, 4 or 16 bytes
+	YourIP string `bencode:"yourip,omitempty"`
+}
+
+// ExtensionHandler processes payload of extended message which peer sent to client.
+type ExtensionHandler func(client *Client, payload []byte) error
+
+// ExtensionRegistry keeps extensions which we support: IDs which we announce in extended handshake,
+// peers use them in messages sent to us, and handlers of their messages. It also keeps our listen port
+// which is announced in the handshake.
+type ExtensionRegistry struct {
+	mu       sync.RWMutex
+	ids      map[string]int
+	handlers map[string]ExtensionHandler
+	// disabled are extensions which aren't used in connections of the torrent
+	disabled map[[20]byte]map[string]bool
+	// metadata are info dictionaries which we serve to peers with ut_metadata extension
+	metadata   map[[20]byte][]byte
+	listenPort uint16
+}
+
+// DefaultExtensions is a registry which is used by all clients.
+var DefaultExtensions = NewExtensionRegistry()
+
+// NewExtensionRegistry creates registry with metadata exchange and peer exchange extensions. Requests of
+// metadata are answered by the registry, other messages are returned by HandleExtended to the caller.
+func NewExtensionRegistry() *ExtensionRegistry {
+	r := &ExtensionRegistry{
+		ids:      make(map[string]int),
+		handlers: make(map[string]ExtensionHandler),
+		disabled: make(map[[20]byte]map[string]bool),
+		metadata: make(map[[20]byte][]byte),
+	}
+	r.Register(ExtensionMetadata, r.handleMetadata)
+	r.Register(ExtensionPEX, nil)
+	return r
+}
+
+// Register adds extension and returns its local ID. Handler of already registered extension is replaced,
+// nil handler means that messages are only returned by HandleExtended.
+func (r *ExtensionRegistry) Register(name string, handler ExtensionHandler) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	id, ok := r.ids[name]
+	if !ok {
+		id = len(r.ids) + 1
+		r.ids[name] = id
+	}
+	if handler != nil {
+		r.handlers[name] = handler
+	} else {
+		delete(r.handlers, name)
+	}
+	return id
+}
+
+// Disable stops announcing extension in connections of the torrent, its messages are rejected as unknown.
+// For example peer exchange must not be used for private torrents.
+func (r *ExtensionRegistry) Disable(infoHash [20]byte, name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.disabled[infoHash] == nil {
+		r.disabled[infoHash] = make(map[string]bool)
+	}
+	r.disabled[infoHash][name] = true
+}
+
+// SetMetadata sets info dictionary of the torrent, its size is announced in extended handshake and
+// it is sent to peers which request it. Requests of metadata which isn't set are rejected.
+func (r *ExtensionRegistry) SetMetadata(infoHash [20]byte, info []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metadata[infoHash] = info
+}
+
+// getMetadata returns info dictionary of the torrent, nil is returned if it isn't set.
+func (r *ExtensionRegistry) getMetadata(infoHash [20]byte) []byte {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.metadata[infoHash]
+}
+
+// SetListenPort sets port which is announced to peers as "p" in extended handshake.
+func (r *ExtensionRegistry) SetListenPort(port uint16) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.listenPort = port
+}
+
+// lookup returns name and handler of extension by our local ID.
+func (r *ExtensionRegistry) lookup(infoHash [20]byte, localID int) (string, ExtensionHandler, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for name, id := range r.ids {
+		if id == localID && !r.disabled[infoHash][name] {
+			return name, r.handlers[name], true
+		}
+	}
+	return "", nil, false
+}
+
+// handshake builds our extended handshake for peer of the torrent with remoteIP.
+func (r *ExtensionRegistry) handshake(infoHash [20]byte, remoteIP net.IP) extendedHandshake {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	ids := make(map[string]int, len(r.ids))
+	for name, id := range r.ids {
+		if !r.disabled[infoHash][name] {
+			ids[name] = id
+		}
+	}
+	res := extendedHandshake{
+		M:            ids,
+		V:            clientVersion,
+		P:            int(r.listenPort),
+		MetadataSize: len(r.metadata[infoHash]),
+		Reqq:         LocalRequestQueueSize,
+	}
+	if ip4 := remoteIP.To4(); ip4 != nil {
+		res.YourIP = string(ip4)
+	} else if len(remoteIP) == net.IPv6len {
+		res.YourIP = string(remoteIP)
+	}
+	return res
+}
+
+// decodeBencodePrefix unmarshalls bencoded value from the beginning of data and returns
+// length of the value, the rest of data is left untouched.
+func decodeBencodePrefix(data []byte, val interface{}) (int, error) {
+	decoder := bencode.NewDecoder(bytes.NewReader(data))
+	if err := decoder.Decode(val); err != nil {
+		return 0, err
+	}
+	return int(decoder.InputOffset()), nil
+}
+
+func CreateExtendedMessage(extendedID int, payload []byte) *Message {
+	res := make([]byte, 1+len(payload))
+	res[0] = byte(extendedID)
+	copy(res[1:], payload)
+	return &Message{ID: MsgExtended, Payload: res}
+}
+
+// ParseExtended returns ID of extended message and its payload.
+func (m *Message) ParseExtended() (int, []byte, error) {
+	if m.ID != MsgExtended {
+		return 0, nil, fmt.Errorf("ParseExtended: failed to parse message expected type %d current %d", MsgExtended, m.ID)
+	}
+	if len(m.Payload) < 1 {
+		return 0, nil, fmt.Errorf("ParseExtended: empty payload of type %d", MsgExtended)
+	}
+	return int(m.Payload[0]), m.Payload[1:], nil
+}
+
+func (c *Client) SupportsExtensionProtocol() bool {
+	return c.supportsExtensions
+}
+
+// SupportsExtension reports whether peer announced extension in its extended handshake.
+func (c *Client) SupportsExtension(name string) bool {
+	return c.peerExtensions[name] != 0
+}
+
+func (c *Client) sendExtendedHandshake() error {
+	var remoteIP net.IP
+	if addr, ok := c.conn.RemoteAddr().(*net.TCPAddr); ok {
+		remoteIP = addr.IP
+	}
+	payload, err := bencode.Marshal(c.extensions.handshake(c.infoHash, remoteIP))
+	if err != nil {
+		return fmt.Errorf("failed to marshall extended handshake: %w", err)
+	}
+	if err = c.send(CreateExtendedMessage(extendedHandshakeID, payload)); err != nil {
+		return fmt.Errorf("failed to send extended handshake: %w", err)
+	}
+	return nil
+}
+
+// SendExtended sends message of extension using ID which peer announced for it.
+func (c *Client) SendExtended(name string, payload []byte) error {
+	extendedID := c.peerExtensions[name]
+	if extendedID == 0 {
+		return fmt.Errorf("peer %s doesn't support extension %q", c.PeerID, name)
+	}
+	if err := c.send(CreateExtendedMessage(extendedID, payload)); err != nil {
+		return fmt.Errorf("failed to send %q message to client: %w", name, err)
+	}
+	return nil
+}
+
+// HandleExtended processes extended message. Extended handshake is applied to the client and
+// empty name is returned, for other messages name of the extension and its payload are returned.
+// If handler of the extension is registered, it is called before return.
+func (c *Client) HandleExtended(msg *Message) (string, []byte, error) {
+	extendedID, payload, err := msg.ParseExtended()
+	if err != nil {
+		return "", nil, err
+	}
+
+	if extendedID == extendedHandshakeID {
+		handshake := extendedHandshake{}
+		if _, decodeErr := decodeBencodePrefix(payload, &handshake); decodeErr != nil {
+			return "", nil, fmt.Errorf("failed to unmarshall extended handshake: %w", decodeErr)
+		}
+		c.applyExtendedHandshake(handshake)
+		return "", nil, nil
+	}
+
+	name, handler, ok := c.extensions.lookup(c.infoHash, extendedID)
+	if !ok {
+		return "", nil, fmt.Errorf("unknown extended message ID %d", extendedID)
+	}
+	if handler != nil {
+		if handlerErr := handler(c, payload); handlerErr != nil {
+			return name, payload, fmt.Errorf("failed to handle %q message: %w", name, handlerErr)
+		}
+	}
+	return name, payload, nil
+}
+
+// applyExtendedHandshake stores capabilities which peer announced. Handshake may be sent again
+// to update them, extensions with ID 0 are disabled by peer.
+func (c *Client) applyExtendedHandshake(handshake extendedHandshake) {
+	if c.peerExtensions == nil {
+		c.peerExtensions = make(map[string]int, len(handshake.M))
+	}
+	for name, id := range handshake.M {
+		if id == 0 {
+			delete(c.peerExtensions, name)
+			continue
+		}
+		c.peerExtensions[name] = id
+	}
+	if handshake.V != "" {
+		c.ClientVersion = handshake.V
+	}
+	if handshake.P > 0 && handshake.P <= 65535 {
+		c.ListenPort = uint16(handshake.P)
+	}
+	if handshake.MetadataSize > 0 {
+		c.MetadataSize = handshake.MetadataSize
+	}
+	if handshake.Reqq > 0 {
+		c.RequestQueueSize = handshake.Reqq
+	}
+	if len(handshake.YourIP) == net.IPv4len || len(handshake.YourIP) == net.IPv6len {
+		c.ExternalIP = net.IP(handshake.YourIP)
+	}
+	c.ExtendedHandshakeReceived = true
+}
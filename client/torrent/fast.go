@@ -0,0 +1,86 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+const (
+	fastExtensionReservedByte = 7
+	fastExtensionReservedBit  = 0x04
+
+	// AllowedFastSetSize is a count of pieces which peer may request from us while it is choked
+	AllowedFastSetSize = 10
+)
+
+// AllowedFastSet returns pieces which peer with IP may download while it is choked. The set is
+// generated by canonical algorithm of BEP 6, so it doesn't change when peer reconnects.
+func AllowedFastSet(ip net.IP, infoHash [20]byte, piecesCount, size int) []int {
+	ip4 := ip.To4()
+	if ip4 == nil || piecesCount == 0 {
+		return nil
+	}
+	if size > piecesCount {
+		size = piecesCount
+	}
+
+	x := make([]byte, 0, 4+len(infoHash))
+	x = append(x, ip4[0], ip4[1], ip4[2], 0)
+	x = append(x, infoHash[:]...)
+	res := make([]int, 0, size)
+	seen := make(map[int]bool, size)
+	for len(res) < size {
+		hash := sha1.Sum(x)
+		x = hash[:]
+		for idx := 0; idx < 5 && len(res) < size; idx++ {
+			piece := int(binary.BigEndian.Uint32(x[idx*4:idx*4+4]) % uint32(piecesCount))
+			if !seen[piece] {
+				seen[piece] = true
+				res = append(res, piece)
+			}
+		}
+	}
+	return res
+}
+
+// SupportsFastExtension reports whether both sides set reserved bit of fast extension.
+func (c *Client) SupportsFastExtension() bool {
+	return c.supportsFast
+}
+
+func (c *Client) SendHaveAll() error {
+	if err := c.send(CreateHaveAllMessage()); err != nil {
+		return fmt.Errorf("failed to send %d message to client: %w", MsgHaveAll, err)
+	}
+	return nil
+}
+
+func (c *Client) SendHaveNone() error {
+	if err := c.send(CreateHaveNoneMessage()); err != nil {
+		return fmt.Errorf("failed to send %d message to client: %w", MsgHaveNone, err)
+	}
+	return nil
+}
+
+func (c *Client) SendReject(index, begin, length int) error {
+	if err := c.send(CreateRejectMessage(index, begin, length)); err != nil {
+		return fmt.Errorf("failed to send %d message to client: %w", MsgReject, err)
+	}
+	return nil
+}
+
+func (c *Client) SendSuggest(pieceID int) error {
+	if err := c.send(CreateSuggestMessage(pieceID)); err != nil {
+		return fmt.Errorf("failed to send %d message to client: %w", MsgSuggest, err)
+	}
+	return nil
+}
+
+func (c *Client) SendAllowedFast(pieceID int) error {
+	if err := c.send(CreateAllowedFastMessage(pieceID)); err != nil {
+		return fmt.Errorf("failed to send %d message to client: %w", MsgAllowedFast, err)
+	}
+	return nil
+}
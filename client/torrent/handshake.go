@@ -25,17 +25,44 @@ func MarshallHandshake(t torrentProtocolHandshake) []byte {
 	return res
 }
 
+// supportsExtensionProtocol reports whether peer set reserved bit of extension protocol (BEP 10).
+func (t *torrentProtocolHandshake) supportsExtensionProtocol() bool {
+	return t.additionalOptions[extensionProtocolReservedByte]&extensionProtocolReservedBit != 0
+}
+
+// supportsFastExtension reports whether peer set reserved bit of fast extension (BEP 6).
+func (t *torrentProtocolHandshake) supportsFastExtension() bool {
+	return t.additionalOptions[fastExtensionReservedByte]&fastExtensionReservedBit != 0
+}
+
 func SendHandshake(conn net.Conn, fileVerifyHash, peerID [20]byte) error {
-	if _, handshakeErr := conn.Write(MarshallHandshake(torrentProtocolHandshake{
+	handshake := torrentProtocolHandshake{
 		fileVerifyHash: fileVerifyHash,
 		PeerID:         peerID,
-	})); handshakeErr != nil {
+	}
+	handshake.additionalOptions[extensionProtocolReservedByte] |= extensionProtocolReservedBit
+	handshake.additionalOptions[fastExtensionReservedByte] |= fastExtensionReservedBit
+	if _, handshakeErr := conn.Write(MarshallHandshake(handshake)); handshakeErr != nil {
 		return fmt.Errorf("failed to start handshake: %w", handshakeErr)
 	}
 	return nil
 }
 
 func RecvHandshake(reader io.Reader, fileVerifyHash [20]byte) (*torrentProtocolHandshake, error) {
+	resHandshake, err := readHandshake(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(resHandshake.fileVerifyHash[:], fileVerifyHash[:]) {
+		return nil, fmt.Errorf("got wrong file hash in handshake response: got %q expect %q", string(resHandshake.fileVerifyHash[:]), string(fileVerifyHash[:]))
+	}
+
+	return resHandshake, nil
+}
+
+// readHandshake reads handshake of the peer without checking of info hash.
+func readHandshake(reader io.Reader) (*torrentProtocolHandshake, error) {
 	torrentHandshakeRaw := make([]byte, 1)
 	n, err := io.ReadFull(reader, torrentHandshakeRaw)
 	if err != nil {
@@ -68,9 +95,5 @@ func RecvHandshake(reader io.Reader, fileVerifyHash [20]byte) (*torrentProtocolH
 		return nil, fmt.Errorf("wrong protocol identifier got %q expect %q", string(respTorrentIdentifier), torrentIdentifier)
 	}
 
-	if !bytes.Equal(resHandshake.fileVerifyHash[:], fileVerifyHash[:]) {
-		return nil, fmt.Errorf("got wrong file hash in handshake response: got %q expect %q", string(resHandshake.fileVerifyHash[:]), string(fileVerifyHash[:]))
-	}
-
 	return &resHandshake, nil
 }
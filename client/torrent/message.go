@@ -19,6 +19,16 @@ const (
 	MsgPiece
 	MsgCancel
 
+	// Messages of fast extension (BEP 6)
+	MsgSuggest     messageID = 13
+	MsgHaveAll     messageID = 14
+	MsgHaveNone    messageID = 15
+	MsgReject      messageID = 16
+	MsgAllowedFast messageID = 17
+
+	// MsgExtended is a message of extension protocol (BEP 10)
+	MsgExtended messageID = 20
+
 	messageBytesSizeLength = 4
 	messageIDLength        = 1
 )
@@ -70,8 +80,26 @@ func CreateRequestMessage(index, begin, length int) *Message {
 	return &Message{ID: MsgRequest, Payload: payload}
 }
 
-func CreateBitfieldMessage() *Message {
-	return &Message{ID: MsgBitfield}
+// CreateCancelMessage creates a CANCEL message for a block which was requested by REQUEST message
+func CreateCancelMessage(index, begin, length int) *Message {
+	message := CreateRequestMessage(index, begin, length)
+	message.ID = MsgCancel
+	return message
+}
+
+// CreateRejectMessage creates a REJECT REQUEST message which tells that requested block won't be sent
+func CreateRejectMessage(index, begin, length int) *Message {
+	message := CreateRequestMessage(index, begin, length)
+	message.ID = MsgReject
+	return message
+}
+
+func CreateBitfieldMessage(bitfield Bitfield) *Message {
+	return &Message{ID: MsgBitfield, Payload: bitfield}
+}
+
+func CreateChokeMessage() *Message {
+	return &Message{ID: MsgChoke}
 }
 
 func CreateInterestedMessage() *Message {
@@ -82,12 +110,43 @@ func CreateUnchokeMessage() *Message {
 	return &Message{ID: MsgUnchoke}
 }
 
+// CreatePieceMessage creates a PIECE message with a block of data which starts at begin of the piece
+func CreatePieceMessage(index, begin int, block []byte) *Message {
+	payload := make([]byte, 8+len(block))
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	copy(payload[8:], block)
+	return &Message{ID: MsgPiece, Payload: payload}
+}
+
 func CreateHaveMessage(pieceID int) *Message {
 	payload := make([]byte, 4)
 	binary.BigEndian.PutUint32(payload, uint32(pieceID))
 	return &Message{ID: MsgHave, Payload: payload}
 }
 
+func CreateHaveAllMessage() *Message {
+	return &Message{ID: MsgHaveAll}
+}
+
+func CreateHaveNoneMessage() *Message {
+	return &Message{ID: MsgHaveNone}
+}
+
+// CreateSuggestMessage creates a SUGGEST PIECE message which advises peer to download the piece
+func CreateSuggestMessage(pieceID int) *Message {
+	message := CreateHaveMessage(pieceID)
+	message.ID = MsgSuggest
+	return message
+}
+
+// CreateAllowedFastMessage creates an ALLOWED FAST message, the piece may be requested while peer is choked
+func CreateAllowedFastMessage(pieceID int) *Message {
+	message := CreateHaveMessage(pieceID)
+	message.ID = MsgAllowedFast
+	return message
+}
+
 func (m *Message) ParseHave() (int, error) {
 	if m.ID != MsgHave {
 		return 0, fmt.Errorf("ParseHave: failed to parse message expected type %q current %q", MsgHave, m.ID)
@@ -98,6 +157,44 @@ func (m *Message) ParseHave() (int, error) {
 	return int(binary.BigEndian.Uint32(m.Payload)), nil
 }
 
+// ParsePieceIndex returns index of the piece from SUGGEST PIECE or ALLOWED FAST message
+func (m *Message) ParsePieceIndex() (int, error) {
+	if m.ID != MsgSuggest && m.ID != MsgAllowedFast {
+		return 0, fmt.Errorf("ParsePieceIndex: failed to parse message expected type %d or %d current %d", MsgSuggest, MsgAllowedFast, m.ID)
+	}
+	if len(m.Payload) != 4 {
+		return 0, fmt.Errorf("ParsePieceIndex: expected payload of length 4 of type %d", m.ID)
+	}
+	return int(binary.BigEndian.Uint32(m.Payload)), nil
+}
+
+// ParseRequest returns index, begin and length of the block from REQUEST, CANCEL or REJECT REQUEST message
+func (m *Message) ParseRequest() (int, int, int, error) {
+	if m.ID != MsgRequest && m.ID != MsgCancel && m.ID != MsgReject {
+		return 0, 0, 0, fmt.Errorf("ParseRequest: failed to parse message expected type %d, %d or %d current %d", MsgRequest, MsgCancel, MsgReject, m.ID)
+	}
+	if len(m.Payload) != 12 {
+		return 0, 0, 0, fmt.Errorf("ParseRequest: expected payload of length 12 of type %d", m.ID)
+	}
+	index := int(binary.BigEndian.Uint32(m.Payload[0:4]))
+	begin := int(binary.BigEndian.Uint32(m.Payload[4:8]))
+	length := int(binary.BigEndian.Uint32(m.Payload[8:12]))
+	return index, begin, length, nil
+}
+
+// ParseBlock returns index of the piece, offset of the block in the piece and data of the block from PIECE message
+func (m *Message) ParseBlock() (int, int, []byte, error) {
+	if m.ID != MsgPiece {
+		return 0, 0, nil, fmt.Errorf("ParseBlock: failed to parse message expected type %d current %d", MsgPiece, m.ID)
+	}
+	if len(m.Payload) < 8 {
+		return 0, 0, nil, fmt.Errorf("ParseBlock: payload length must be more than 8 for type %d", MsgPiece)
+	}
+	index := int(binary.BigEndian.Uint32(m.Payload[:4]))
+	begin := int(binary.BigEndian.Uint32(m.Payload[4:8]))
+	return index, begin, m.Payload[8:], nil
+}
+
 func (m *Message) ParsePiece(expectedPieceIndex int, buf []byte) (int, error) {
 	if m.ID != MsgPiece {
 		return 0, fmt.Errorf("ParsePiece: failed to parse message expected type %q current %q", MsgPiece, m.ID)
@@ -0,0 +1,82 @@
+package torrent
+
+import (
+	"fmt"
+	"github.com/hihoak/torrent-cli/bencode"
+)
+
+const (
+	// MetadataPieceSize is a size of every piece of metadata except the last one (BEP 9)
+	MetadataPieceSize = 16384
+
+	MetadataRequest = 0
+	MetadataData    = 1
+	MetadataReject  = 2
+)
+
+type metadataMessage struct {
+	MsgType   int `bencode:"msg_type"`
+	Piece     int `bencode:"piece"`
+	TotalSize int `bencode:"total_size,omitempty"`
+}
+
+// MetadataPiece is a parsed ut_metadata message. Data is set only for MetadataData messages.
+type MetadataPiece struct {
+	Type      int
+	Index     int
+	TotalSize int
+	Data      []byte
+}
+
+func (c *Client) SendMetadataRequest(index int) error {
+	payload, err := bencode.Marshal(metadataMessage{MsgType: MetadataRequest, Piece: index})
+	if err != nil {
+		return fmt.Errorf("failed to marshall metadata request: %w", err)
+	}
+	return c.SendExtended(ExtensionMetadata, payload)
+}
+
+// handleMetadata answers request of metadata piece with data from the registry or with reject if
+// metadata of the torrent isn't known, other ut_metadata messages are left to the caller.
+func (r *ExtensionRegistry) handleMetadata(client *Client, payload []byte) error {
+	piece, err := ParseMetadataPiece(payload)
+	if err != nil {
+		return err
+	}
+	if piece.Type != MetadataRequest {
+		return nil
+	}
+	info := r.getMetadata(client.infoHash)
+	start := piece.Index * MetadataPieceSize
+	if piece.Index < 0 || start >= len(info) {
+		return client.sendMetadataMessage(metadataMessage{MsgType: MetadataReject, Piece: piece.Index}, nil)
+	}
+	end := start + MetadataPieceSize
+	if end > len(info) {
+		end = len(info)
+	}
+	return client.sendMetadataMessage(metadataMessage{MsgType: MetadataData, Piece: piece.Index, TotalSize: len(info)}, info[start:end])
+}
+
+// sendMetadataMessage sends ut_metadata message, data of the piece follows bencoded dictionary.
+func (c *Client) sendMetadataMessage(msg metadataMessage, data []byte) error {
+	payload, err := bencode.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to marshall metadata message: %w", err)
+	}
+	return c.SendExtended(ExtensionMetadata, append(payload, data...))
+}
+
+func ParseMetadataPiece(payload []byte) (*MetadataPiece, error) {
+	msg := metadataMessage{}
+	length, err := decodeBencodePrefix(payload, &msg)
+	if err != nil {
+		return nil, fmt.Errorf("ParseMetadataPiece: failed to unmarshall message: %w", err)
+	}
+	return &MetadataPiece{
+		Type:      msg.MsgType,
+		Index:     msg.Piece,
+		TotalSize: msg.TotalSize,
+		Data:      payload[length:],
+	}, nil
+}
@@ -0,0 +1,82 @@
+package torrent
+
+import (
+	"bytes"
+	"github.com/hihoak/torrent-cli/bencode"
+	"net"
+	"testing"
+)
+
+// newTestMetadataClient returns client which peer announced ut_metadata with ID 3 and connection of the peer.
+func newTestMetadataClient(t *testing.T, registry *ExtensionRegistry, infoHash [20]byte) (*Client, net.Conn) {
+	local, remote := net.Pipe()
+	t.Cleanup(func() {
+		_ = local.Close()
+		_ = remote.Close()
+	})
+	client := &Client{
+		conn:           local,
+		infoHash:       infoHash,
+		extensions:     registry,
+		peerExtensions: map[string]int{ExtensionMetadata: 3},
+	}
+	return client, remote
+}
+
+func requestMetadata(t *testing.T, client *Client, remote net.Conn, index int) *MetadataPiece {
+	payload, err := bencode.Marshal(metadataMessage{MsgType: MetadataRequest, Piece: index})
+	if err != nil {
+		t.Fatalf("failed to marshall request: %v", err)
+	}
+	errs := make(chan error, 1)
+	go func() {
+		_, _, handleErr := client.HandleExtended(CreateExtendedMessage(client.extensions.ids[ExtensionMetadata], payload))
+		errs <- handleErr
+	}()
+	msg, err := UnmarshallMessage(remote)
+	if err != nil {
+		t.Fatalf("failed to read answer: %v", err)
+	}
+	if err = <-errs; err != nil {
+		t.Fatalf("failed to handle request: %v", err)
+	}
+	extendedID, answer, err := msg.ParseExtended()
+	if err != nil || extendedID != 3 {
+		t.Fatalf("expected ut_metadata message got ID %d, %v", extendedID, err)
+	}
+	piece, err := ParseMetadataPiece(answer)
+	if err != nil {
+		t.Fatalf("failed to parse answer: %v", err)
+	}
+	return piece
+}
+
+func TestMetadataRequestsAreServed(t *testing.T) {
+	registry := NewExtensionRegistry()
+	infoHash := [20]byte{1}
+	info := bytes.Repeat([]byte{'x'}, MetadataPieceSize+100)
+	registry.SetMetadata(infoHash, info)
+	if size := registry.handshake(infoHash, nil).MetadataSize; size != len(info) {
+		t.Fatalf("expected metadata size %d in handshake got %d", len(info), size)
+	}
+	client, remote := newTestMetadataClient(t, registry, infoHash)
+
+	last := requestMetadata(t, client, remote, 1)
+	if last.Type != MetadataData || last.Index != 1 || last.TotalSize != len(info) || !bytes.Equal(last.Data, info[MetadataPieceSize:]) {
+		t.Errorf("unexpected last piece %+v", last)
+	}
+	if rejected := requestMetadata(t, client, remote, 2); rejected.Type != MetadataReject || rejected.Index != 2 {
+		t.Errorf("expected reject of piece out of bounds got %+v", rejected)
+	}
+}
+
+func TestMetadataRequestsAreRejectedWithoutMetadata(t *testing.T) {
+	registry := NewExtensionRegistry()
+	if size := registry.handshake([20]byte{2}, nil).MetadataSize; size != 0 {
+		t.Fatalf("expected no metadata size in handshake got %d", size)
+	}
+	client, remote := newTestMetadataClient(t, registry, [20]byte{2})
+	if rejected := requestMetadata(t, client, remote, 0); rejected.Type != MetadataReject {
+		t.Errorf("expected reject got %+v", rejected)
+	}
+}
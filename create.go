@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"github.com/hihoak/torrent-cli/services/creator"
+	torrent_decoder "github.com/hihoak/torrent-cli/services/torrent-file-decoder"
+	log "github.com/rs/zerolog/log"
+	"os"
+	"strings"
+	"time"
+)
+
+const defaultCreatedBy = "torrent-cli"
+
+type createSummary struct {
+	Path        string `json:"path"`
+	Name        string `json:"name"`
+	InfoHash    string `json:"info_hash"`
+	PieceLength int    `json:"piece_length"`
+	Pieces      int    `json:"pieces"`
+	SizeBytes   int    `json:"size_bytes"`
+}
+
+func runCreate(args []string) int {
+	flags, common := newFlagSet("create", "[flags] <file or directory>")
+	output := flags.String("o", "", "path of created torrent file, by default <name>.torrent")
+	pieceLength := flags.Int("piece-length", 0, "piece length in bytes, must be a power of two, by default selected automatically")
+	comment := flags.String("comment", "", "comment of the torrent")
+	createdBy := flags.String("created-by", defaultCreatedBy, "name of the program which created the torrent")
+	noDate := flags.Bool("no-date", false, "don't write creation date")
+	private := flags.Bool("private", false, "set private flag, peers can be received only from trackers")
+	workers := flags.Int("workers", 0, "count of hashing workers, by default count of CPUs")
+	var trackers, webSeeds stringsFlag
+	flags.Var(&trackers, "tracker", "announce URL, repeat the flag for every tier, separate trackers of the same tier by comma")
+	flags.Var(&webSeeds, "web-seed", "URL of web seed, can be repeated")
+	if code, ok := parseFlags(flags, common, args, 1); !ok {
+		return code
+	}
+
+	opts := creator.Options{
+		PieceLength: *pieceLength,
+		Comment:     *comment,
+		CreatedBy:   *createdBy,
+		Private:     *private,
+		WebSeeds:    webSeeds,
+		Workers:     *workers,
+	}
+	if !*noDate {
+		opts.CreationDate = time.Now()
+	}
+	for _, tier := range trackers {
+		opts.AnnounceList = append(opts.AnnounceList, strings.Split(tier, ","))
+	}
+
+	torrentFile, err := creator.Create(flags.Arg(0), opts)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to create torrent")
+		return exitFailure
+	}
+	data, err := torrent_decoder.Marshall(torrentFile)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to encode torrent")
+		return exitFailure
+	}
+
+	path := *output
+	if path == "" {
+		path = torrentFile.Name + ".torrent"
+	}
+	if err = os.WriteFile(path, data, 0644); err != nil {
+		log.Error().Err(err).Msg("failed to write torrent file")
+		return exitFailure
+	}
+
+	summary := createSummary{
+		Path:        path,
+		Name:        torrentFile.Name,
+		InfoHash:    fmt.Sprintf("%x", torrentFile.VerifyHash),
+		PieceLength: torrentFile.PieceLength,
+		Pieces:      len(torrentFile.PieceHashes),
+		SizeBytes:   torrentFile.Length,
+	}
+	if common.output == outputJSON {
+		return printJSON(summary)
+	}
+	fmt.Printf("created %s: info hash %s, %d pieces of %d bytes\n", summary.Path, summary.InfoHash, summary.Pieces, summary.PieceLength)
+	return exitOK
+}
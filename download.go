@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"github.com/hihoak/torrent-cli/services/dht"
+	"github.com/hihoak/torrent-cli/services/downloader"
+	"github.com/hihoak/torrent-cli/services/listener"
+	"github.com/hihoak/torrent-cli/services/lsd"
+	"github.com/hihoak/torrent-cli/services/magnet"
+	"github.com/hihoak/torrent-cli/services/peers"
+	"github.com/hihoak/torrent-cli/services/resume"
+	"github.com/hihoak/torrent-cli/services/storage"
+	torrent_decoder "github.com/hihoak/torrent-cli/services/torrent-file-decoder"
+	log "github.com/rs/zerolog/log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type downloadSummary struct {
+	Name            string  `json:"name"`
+	OutputDir       string  `json:"output_dir"`
+	SizeBytes       int     `json:"size_bytes"`
+	DurationSeconds float64 `json:"duration_seconds"`
+	SpeedMbPerSec   float64 `json:"speed_mb_per_second"`
+}
+
+func runDownload(args []string) int {
+	flags, common := newFlagSet("download", "[flags] <torrent file or magnet link>")
+	outputDir := flags.String("out", ".", "directory where downloaded data is saved")
+	listenPort := flags.Uint("listen-port", 6881, "port which accepts incoming peers and is announced to trackers")
+	maxPeers := flags.Int("max-peers", 50, "maximum count of peers to download from, 0 means no limit")
+	verifyOnResume := flags.Bool("verify-resume", true, "re-hash pieces which are marked as completed in resume file")
+	enableDHT := flags.Bool("dht", true, "find peers in DHT on UDP port equal to listen port, it isn't used for private torrents")
+	var dhtBootstrap stringsFlag
+	flags.Var(&dhtBootstrap, "dht-bootstrap", "host:port of DHT node which is used to join DHT, can be repeated (default well known routers)")
+	dhtState := flags.String("dht-state", defaultDHTStatePath(), "file where DHT routing table is kept between runs, empty disables it")
+	enableLSD := flags.Bool("lsd", true, "announce torrent and find peers in local network by multicast, it isn't used for private torrents")
+	if code, ok := parseFlags(flags, common, args, 1); !ok {
+		return code
+	}
+	if *listenPort == 0 || *listenPort > 65535 {
+		fmt.Fprintf(flags.Output(), "invalid listen port %d\n", *listenPort)
+		return exitUsage
+	}
+
+	peerListener, err := listener.Listen(uint16(*listenPort), *maxPeers)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to accept incoming peers")
+		return exitFailure
+	}
+	defer func() {
+		if closeErr := peerListener.Close(); closeErr != nil {
+			log.Error().Err(closeErr).Msg("failed to close listener")
+		}
+	}()
+	go func() {
+		if serveErr := peerListener.Serve(); serveErr != nil {
+			log.Error().Err(serveErr).Msg("stop accepting incoming peers")
+		}
+	}()
+
+	var dhtNode *dht.Node
+	if *enableDHT {
+		if len(dhtBootstrap) == 0 {
+			dhtBootstrap = dht.DefaultBootstrapNodes
+		}
+		dhtNode = startDHT(dht.Config{
+			Addr:           fmt.Sprintf(":%d", *listenPort),
+			BootstrapNodes: dhtBootstrap,
+			StatePath:      *dhtState,
+		})
+		if dhtNode != nil {
+			defer closeDHT(dhtNode)
+		}
+	}
+
+	var discovery *lsd.Service
+	if *enableLSD {
+		if discovery = startLSD(peerListener.Port()); discovery != nil {
+			defer closeLSD(discovery)
+		}
+	}
+
+	startOfDownload := time.Now()
+	file, trackers, torrentPeers, err := loadTorrentAndPeers(flags.Arg(0), uint16(*listenPort), dhtNode, discovery)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to prepare download")
+		return exitFailure
+	}
+
+	fileStorage, err := storage.NewFileStorage(file, *outputDir)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to prepare storage")
+		return exitFailure
+	}
+	defer func() {
+		if closeErr := fileStorage.Close(); closeErr != nil {
+			log.Error().Err(closeErr).Msg("failed to close storage")
+		}
+	}()
+
+	download := downloader.NewDownloader(file, torrentPeers, fileStorage, downloader.Config{
+		ResumePath:     resume.Path(file, *outputDir),
+		VerifyOnResume: *verifyOnResume,
+		MaxPeers:       *maxPeers,
+		Trackers:       trackers,
+		Port:           uint16(*listenPort),
+	})
+	peerListener.Register(file.VerifyHash, download)
+	defer peerListener.Unregister(file.VerifyHash)
+	if discovery != nil {
+		if file.Private {
+			// privacy of magnet link is known only after metadata is fetched
+			discovery.Unregister(file.VerifyHash)
+		} else {
+			discovery.Register(file.VerifyHash, download)
+			defer discovery.Unregister(file.VerifyHash)
+		}
+	}
+	if downloadErr := download.Download(); downloadErr != nil {
+		log.Error().Err(downloadErr).Msg("failed to download file")
+		return exitFailure
+	}
+
+	duration := time.Since(startOfDownload).Seconds()
+	summary := downloadSummary{
+		Name:            file.Name,
+		OutputDir:       *outputDir,
+		SizeBytes:       file.Length,
+		DurationSeconds: duration,
+		SpeedMbPerSec:   float64(file.Length) / 1024 / 1024 / duration,
+	}
+	if common.output == outputJSON {
+		return printJSON(summary)
+	}
+	log.Info().Msgf("downloaded %s for %f second. Downloaded %f Mb. Average speed: %f Mb/second",
+		summary.Name, summary.DurationSeconds, float64(summary.SizeBytes)/1024/1024, summary.SpeedMbPerSec)
+	return exitOK
+}
+
+// loadTorrentAndPeers reads torrent file and gets peers from its trackers, DHT if dhtNode isn't nil and
+// local network if discovery isn't nil. For magnet link torrent file is built from metadata fetched from peers.
+// Returned tracker list must be used for the next announces of the torrent.
+func loadTorrentAndPeers(source string, port uint16, dhtNode *dht.Node, discovery *lsd.Service) (*torrent_decoder.TorrentFile, *peers.TrackerList, []*peers.Peer, error) {
+	var sources []peers.PeerSource
+	if dhtNode != nil {
+		sources = append(sources, dhtNode)
+	}
+	if discovery != nil {
+		sources = append(sources, discovery)
+	}
+	if !magnet.IsMagnetLink(source) {
+		file, err := openTorrentFile(source)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if dhtNode != nil && !file.Private {
+			dhtNode.AddNodes(file.Nodes)
+		}
+		trackers := peers.NewTrackerList(file.AnnounceList)
+		torrentPeers, err := peers.GetPeers(file, trackers, port, sources...)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to get peers: %w", err)
+		}
+		return file, trackers, torrentPeers, nil
+	}
+
+	link, err := magnet.Parse(source)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	trackers := peers.NewTrackerList(link.AnnounceList())
+	torrentPeers, err := link.GetPeers(trackers, port, sources...)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to get peers: %w", err)
+	}
+	log.Info().Msgf("fetch metadata of %x from %d peers", link.InfoHash, len(torrentPeers))
+	file, err := link.FetchTorrentFile(torrentPeers)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to fetch metadata: %w", err)
+	}
+	return file, trackers, torrentPeers, nil
+}
+
+// defaultDHTStatePath returns location of DHT state in user's cache directory, empty if it is unknown.
+func defaultDHTStatePath() string {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(cacheDir, "torrent-cli", "dht.state")
+}
+
+// startDHT starts DHT node, nil is returned if its UDP socket can't be bound, because peers can still be
+// found by trackers and local service discovery.
+func startDHT(config dht.Config) *dht.Node {
+	dhtNode, err := dht.NewNode(config)
+	if err != nil {
+		log.Warn().Err(err).Msg("DHT is disabled")
+		return nil
+	}
+	go func() {
+		if serveErr := dhtNode.Serve(); serveErr != nil {
+			log.Error().Err(serveErr).Msg("stop serving DHT")
+		}
+	}()
+	return dhtNode
+}
+
+func closeDHT(dhtNode *dht.Node) {
+	if err := dhtNode.Close(); err != nil {
+		log.Error().Err(err).Msg("failed to close DHT node")
+	}
+}
+
+// startLSD starts local service discovery, nil is returned if multicast isn't available, because
+// peers can still be found by trackers and DHT.
+func startLSD(port uint16) *lsd.Service {
+	discovery, err := lsd.Listen(port)
+	if err != nil {
+		log.Warn().Err(err).Msg("local service discovery is disabled")
+		return nil
+	}
+	go func() {
+		if serveErr := discovery.Serve(); serveErr != nil {
+			log.Error().Err(serveErr).Msg("stop local service discovery")
+		}
+	}()
+	return discovery
+}
+
+func closeLSD(discovery *lsd.Service) {
+	if err := discovery.Close(); err != nil {
+		log.Error().Err(err).Msg("failed to close local service discovery")
+	}
+}
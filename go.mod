@@ -2,6 +2,4 @@ module github.com/hihoak/torrent-cli
 
 go 1.20
 
-require github.com/jackpal/bencode-go v1.0.0
-
-require github.com/rs/zerolog v1.26.1 // indirect
+require github.com/rs/zerolog v1.26.1
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"github.com/hihoak/torrent-cli/services/magnet"
+	torrent_decoder "github.com/hihoak/torrent-cli/services/torrent-file-decoder"
+	log "github.com/rs/zerolog/log"
+	"path"
+	"strings"
+	"time"
+)
+
+type infoFile struct {
+	Path      string `json:"path"`
+	SizeBytes int    `json:"size_bytes"`
+}
+
+type torrentInfo struct {
+	Name           string     `json:"name"`
+	InfoHash       string     `json:"info_hash"`
+	InfoHashBase32 string     `json:"info_hash_base32"`
+	PieceLength    int        `json:"piece_length"`
+	Pieces         int        `json:"pieces"`
+	SizeBytes      int        `json:"size_bytes"`
+	Private        bool       `json:"private"`
+	Files          []infoFile `json:"files"`
+	Trackers       [][]string `json:"trackers"`
+	WebSeeds       []string   `json:"web_seeds"`
+	DHTNodes       []string   `json:"dht_nodes"`
+	Comment        string     `json:"comment,omitempty"`
+	CreatedBy      string     `json:"created_by,omitempty"`
+	CreationDate   *time.Time `json:"creation_date,omitempty"`
+	Magnet         string     `json:"magnet"`
+}
+
+func newTorrentInfo(file *torrent_decoder.TorrentFile) *torrentInfo {
+	res := &torrentInfo{
+		Name:           file.Name,
+		InfoHash:       hex.EncodeToString(file.VerifyHash[:]),
+		InfoHashBase32: base32.StdEncoding.EncodeToString(file.VerifyHash[:]),
+		PieceLength:    file.PieceLength,
+		Pieces:         len(file.PieceHashes),
+		SizeBytes:      file.Length,
+		Private:        file.Private,
+		Files:          make([]infoFile, 0, len(file.Files)),
+		Trackers:       file.AnnounceList,
+		WebSeeds:       file.WebSeeds,
+		DHTNodes:       file.Nodes,
+		Comment:        file.Comment,
+		CreatedBy:      file.CreatedBy,
+		Magnet:         magnet.FromTorrentFile(file).String(),
+	}
+	if res.Trackers == nil {
+		res.Trackers = [][]string{}
+	}
+	if res.WebSeeds == nil {
+		res.WebSeeds = []string{}
+	}
+	if res.DHTNodes == nil {
+		res.DHTNodes = []string{}
+	}
+	if !file.CreationDate.IsZero() {
+		res.CreationDate = &file.CreationDate
+	}
+	for _, torrentFile := range file.Files {
+		res.Files = append(res.Files, infoFile{
+			Path:      path.Join(torrentFile.Path...),
+			SizeBytes: torrentFile.Length,
+		})
+	}
+	return res
+}
+
+func runInfo(args []string) int {
+	flags, common := newFlagSet("info", "[flags] <torrent file>")
+	if code, ok := parseFlags(flags, common, args, 1); !ok {
+		return code
+	}
+
+	file, err := openTorrentFile(flags.Arg(0))
+	if err != nil {
+		log.Error().Err(err).Msg("failed to read torrent")
+		return exitFailure
+	}
+
+	info := newTorrentInfo(file)
+	if common.output == outputJSON {
+		return printJSON(info)
+	}
+	printTorrentInfo(info)
+	return exitOK
+}
+
+func printTorrentInfo(info *torrentInfo) {
+	fmt.Printf("name:          %s\n", info.Name)
+	fmt.Printf("info hash:     %s\n", info.InfoHash)
+	fmt.Printf("base32 hash:   %s\n", info.InfoHashBase32)
+	fmt.Printf("size:          %d bytes\n", info.SizeBytes)
+	fmt.Printf("pieces:        %d x %d bytes\n", info.Pieces, info.PieceLength)
+	fmt.Printf("private:       %t\n", info.Private)
+	if info.Comment != "" {
+		fmt.Printf("comment:       %s\n", info.Comment)
+	}
+	if info.CreatedBy != "" {
+		fmt.Printf("created by:    %s\n", info.CreatedBy)
+	}
+	if info.CreationDate != nil {
+		fmt.Printf("creation date: %s\n", info.CreationDate.Format(time.RFC3339))
+	}
+	fmt.Printf("magnet:        %s\n", info.Magnet)
+
+	fmt.Println("trackers:")
+	for idx, tier := range info.Trackers {
+		fmt.Printf("  tier %d: %s\n", idx, strings.Join(tier, ", "))
+	}
+	if len(info.WebSeeds) > 0 {
+		fmt.Println("web seeds:")
+		for _, webSeed := range info.WebSeeds {
+			fmt.Printf("  %s\n", webSeed)
+		}
+	}
+	if len(info.DHTNodes) > 0 {
+		fmt.Println("DHT nodes:")
+		for _, node := range info.DHTNodes {
+			fmt.Printf("  %s\n", node)
+		}
+	}
+	fmt.Printf("files (%d):\n", len(info.Files))
+	for _, file := range info.Files {
+		fmt.Printf("  %s (%d bytes)\n", file.Path, file.SizeBytes)
+	}
+}
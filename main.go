@@ -1,33 +1,45 @@
 package main
 
 import (
-	"github.com/hihoak/torrent-cli/services/downloader"
-	"github.com/hihoak/torrent-cli/services/peers"
-	torrent_decoder "github.com/hihoak/torrent-cli/services/torrent-file-decoder"
-	log "github.com/rs/zerolog/log"
+	"fmt"
 	"os"
-	"time"
 )
 
-func main() {
-	startOfProgram := time.Now()
-	data, _ := os.Open("RPG_End_of_Aspiration.rar.torrent")
-	file, err := torrent_decoder.Unmarshall(data)
-	if err != nil {
-		log.Fatal().Err(err).Msg("failed to create torrent file")
+var commands = []command{
+	{name: "download", description: "download content of a torrent", run: runDownload},
+	{name: "seed", description: "verify existing data and upload it to peers", run: runSeed},
+	{name: "verify", description: "hash-check existing data against a torrent", run: runVerify},
+	{name: "info", description: "print information about a torrent file", run: runInfo},
+	{name: "create", description: "create a torrent from a file or directory", run: runCreate},
+}
+
+func printUsage() {
+	fmt.Fprintln(os.Stderr, "usage: torrent-cli <command> [flags] [arguments]")
+	fmt.Fprintln(os.Stderr, "\ncommands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", cmd.name, cmd.description)
 	}
+	fmt.Fprintln(os.Stderr, "\nrun 'torrent-cli <command> --help' for flags of the command")
+}
 
-	torrentPeers, err := peers.GetPeers(file)
-	if err != nil {
-		log.Fatal().Err(err).Msg("failed to get peers")
+func main() {
+	if len(os.Args) < 2 {
+		printUsage()
+		os.Exit(exitUsage)
 	}
 
-	download := downloader.NewDownloader(file, torrentPeers)
-	if downloadErr := download.Download(); downloadErr != nil {
-		log.Fatal().Err(downloadErr).Msg("failed to download file")
+	name := os.Args[1]
+	if name == "help" || name == "-h" || name == "--help" {
+		printUsage()
+		os.Exit(exitOK)
+	}
+	for _, cmd := range commands {
+		if cmd.name == name {
+			os.Exit(cmd.run(os.Args[2:]))
+		}
 	}
-	timeOfExecutionSeconds := time.Now().Sub(startOfProgram).Seconds()
-	fileSizeMb := float64(file.Length) / 1024 / 1024
-	averageSpeedMbPerSecond := fileSizeMb / timeOfExecutionSeconds
-	log.Info().Msgf("program executed for %f second. Downloaded %f Mb. Average speed: %f Mb/second", timeOfExecutionSeconds, fileSizeMb, averageSpeedMbPerSecond)
+
+	fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+	printUsage()
+	os.Exit(exitUsage)
 }
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"github.com/hihoak/torrent-cli/services/listener"
+	"github.com/hihoak/torrent-cli/services/seeder"
+	"github.com/hihoak/torrent-cli/services/storage"
+	"github.com/hihoak/torrent-cli/services/verifier"
+	log "github.com/rs/zerolog/log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+type seedSummary struct {
+	Name            string  `json:"name"`
+	UploadedBytes   int64   `json:"uploaded_bytes"`
+	Ratio           float64 `json:"ratio"`
+	DurationSeconds float64 `json:"duration_seconds"`
+}
+
+func runSeed(args []string) int {
+	flags, common := newFlagSet("seed", "[flags] <torrent file> <data directory>")
+	listenPort := flags.Uint("listen-port", 6881, "port which accepts incoming peers and is announced to trackers")
+	maxRatio := flags.Float64("ratio", 0, "stop when uploaded size reaches ratio of torrent size, 0 means no limit")
+	maxDuration := flags.Duration("duration", 0, "stop after this time, 0 means no limit")
+	workers := flags.Int("workers", 0, "count of hashing workers, by default count of CPUs")
+	enableLSD := flags.Bool("lsd", true, "announce torrent to local network by multicast, it isn't used for private torrents")
+	if code, ok := parseFlags(flags, common, args, 2); !ok {
+		return code
+	}
+	if *listenPort == 0 || *listenPort > 65535 {
+		fmt.Fprintf(flags.Output(), "invalid listen port %d\n", *listenPort)
+		return exitUsage
+	}
+	if *maxRatio < 0 || *maxDuration < 0 {
+		fmt.Fprintln(flags.Output(), "ratio and duration must not be negative")
+		return exitUsage
+	}
+
+	file, err := openTorrentFile(flags.Arg(0))
+	if err != nil {
+		log.Error().Err(err).Msg("failed to read torrent")
+		return exitFailure
+	}
+
+	dataStorage, err := storage.OpenFileStorage(file, flags.Arg(1))
+	if err != nil {
+		log.Error().Err(err).Msg("failed to open data")
+		return exitFailure
+	}
+	defer func() {
+		if closeErr := dataStorage.Close(); closeErr != nil {
+			log.Error().Err(closeErr).Msg("failed to close data")
+		}
+	}()
+
+	log.Info().Msgf("verify data of %s", file.Name)
+	report, err := verifier.Verify(file, dataStorage, *workers)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to verify data")
+		return exitFailure
+	}
+	if !report.IsComplete() {
+		log.Error().Msgf("can't seed incomplete data: %d missing and %d corrupt pieces of %d", report.Missing, report.Corrupt, report.TotalPieces)
+		return exitFailure
+	}
+
+	peerListener, err := listener.Listen(uint16(*listenPort), 0)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to accept incoming peers")
+		return exitFailure
+	}
+	defer func() {
+		if closeErr := peerListener.Close(); closeErr != nil {
+			log.Error().Err(closeErr).Msg("failed to close listener")
+		}
+	}()
+	go func() {
+		if serveErr := peerListener.Serve(); serveErr != nil {
+			log.Error().Err(serveErr).Msg("stop accepting incoming peers")
+		}
+	}()
+
+	seed := seeder.NewSeeder(file, dataStorage, seeder.Config{
+		Port:        uint16(*listenPort),
+		MaxRatio:    *maxRatio,
+		MaxDuration: *maxDuration,
+	})
+	peerListener.Register(file.VerifyHash, seed)
+	defer peerListener.Unregister(file.VerifyHash)
+	if *enableLSD && !file.Private {
+		if discovery := startLSD(peerListener.Port()); discovery != nil {
+			defer closeLSD(discovery)
+			// seeder doesn't need peers, it only tells downloaders in local network where to connect
+			discovery.Register(file.VerifyHash, nil)
+			defer discovery.Unregister(file.VerifyHash)
+		}
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	stop := make(chan struct{})
+	go func() {
+		<-signals
+		close(stop)
+	}()
+
+	log.Info().Msgf("seeding %s on port %d", file.Name, *listenPort)
+	startOfSeeding := time.Now()
+	seed.Seed(stop)
+
+	summary := seedSummary{
+		Name:            file.Name,
+		UploadedBytes:   seed.Uploaded(),
+		Ratio:           seed.Ratio(),
+		DurationSeconds: time.Since(startOfSeeding).Seconds(),
+	}
+	if common.output == outputJSON {
+		return printJSON(summary)
+	}
+	log.Info().Msgf("seeded %s for %f second. Uploaded %f Mb, ratio %.2f",
+		summary.Name, summary.DurationSeconds, float64(summary.UploadedBytes)/1024/1024, summary.Ratio)
+	return exitOK
+}
@@ -0,0 +1,196 @@
+package creator
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"github.com/hihoak/torrent-cli/services/storage"
+	torrent_file_decoder "github.com/hihoak/torrent-cli/services/torrent-file-decoder"
+	log "github.com/rs/zerolog/log"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	minPieceLength = 16 * 1024
+	maxPieceLength = 16 * 1024 * 1024
+	// targetPiecesCount is a count of pieces which automatically selected piece length aims for
+	targetPiecesCount = 1500
+)
+
+type Options struct {
+	// PieceLength must be a power of two, zero means automatic selection
+	PieceLength  int
+	AnnounceList [][]string
+	Comment      string
+	CreatedBy    string
+	CreationDate time.Time
+	Private      bool
+	WebSeeds     []string
+	// Workers is a count of hashing goroutines, if it's not positive count of CPUs is used
+	Workers int
+}
+
+// Create builds torrent of the file or directory at path.
+func Create(path string, opts Options) (*torrent_file_decoder.TorrentFile, error) {
+	// absolute path gives real name of directory for paths like "." or ".."
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get absolute path of %q: %w", path, err)
+	}
+	path = absPath
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat %q: %w", path, err)
+	}
+	name := filepath.Base(path)
+	if !torrent_file_decoder.IsValidPathSegment(name) {
+		return nil, fmt.Errorf("invalid torrent name %q of %q", name, path)
+	}
+
+	torrentFile := &torrent_file_decoder.TorrentFile{
+		AnnounceList: opts.AnnounceList,
+		Name:         name,
+		MultiFile:    stat.IsDir(),
+		Private:      opts.Private,
+		Comment:      opts.Comment,
+		CreatedBy:    opts.CreatedBy,
+		CreationDate: opts.CreationDate,
+		WebSeeds:     opts.WebSeeds,
+	}
+	if len(opts.AnnounceList) > 0 && len(opts.AnnounceList[0]) > 0 {
+		torrentFile.Announce = opts.AnnounceList[0][0]
+	}
+
+	if stat.IsDir() {
+		if torrentFile.Files, err = collectFiles(path); err != nil {
+			return nil, err
+		}
+	} else {
+		torrentFile.Files = []torrent_file_decoder.File{{Path: []string{torrentFile.Name}, Length: int(stat.Size())}}
+	}
+	for _, file := range torrentFile.Files {
+		torrentFile.Length += file.Length
+	}
+	if torrentFile.Length == 0 {
+		return nil, fmt.Errorf("nothing to share: total size of files is zero")
+	}
+
+	torrentFile.PieceLength = opts.PieceLength
+	if torrentFile.PieceLength == 0 {
+		torrentFile.PieceLength = choosePieceLength(torrentFile.Length)
+	}
+	if torrentFile.PieceLength <= 0 || torrentFile.PieceLength&(torrentFile.PieceLength-1) != 0 {
+		return nil, fmt.Errorf("piece length %d is not a power of two", torrentFile.PieceLength)
+	}
+
+	if err = hashPieces(torrentFile, filepath.Dir(path), opts.Workers); err != nil {
+		return nil, err
+	}
+	if err = torrentFile.EncodeInfo(); err != nil {
+		return nil, err
+	}
+	return torrentFile, nil
+}
+
+// choosePieceLength returns the smallest power of two which gives no more than targetPiecesCount pieces.
+func choosePieceLength(totalLength int) int {
+	pieceLength := minPieceLength
+	for pieceLength < maxPieceLength && totalLength/pieceLength > targetPiecesCount {
+		pieceLength *= 2
+	}
+	return pieceLength
+}
+
+// collectFiles returns regular files of the directory in lexical order of their paths.
+func collectFiles(root string) ([]torrent_file_decoder.File, error) {
+	var files []torrent_file_decoder.File
+	offset := 0
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, walkErr error) error {
+		if walkErr != nil {
+			return walkErr
+		}
+		if !entry.Type().IsRegular() {
+			if !entry.IsDir() {
+				log.Warn().Msgf("skip %q: not a regular file", path)
+			}
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		relative, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, torrent_file_decoder.File{
+			Path:   strings.Split(filepath.ToSlash(relative), "/"),
+			Length: int(info.Size()),
+			Offset: offset,
+		})
+		offset += int(info.Size())
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to walk directory %q: %w", root, err)
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("directory %q has no files", root)
+	}
+	return files, nil
+}
+
+func hashPieces(torrentFile *torrent_file_decoder.TorrentFile, baseDir string, workers int) error {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	dataStorage, err := storage.OpenFileStorage(torrentFile, baseDir)
+	if err != nil {
+		return fmt.Errorf("failed to open files: %w", err)
+	}
+	defer func() {
+		if closeErr := dataStorage.Close(); closeErr != nil {
+			log.Error().Err(closeErr).Msg("failed to close files")
+		}
+	}()
+
+	countOfPieces := (torrentFile.Length + torrentFile.PieceLength - 1) / torrentFile.PieceLength
+	torrentFile.PieceHashes = make([][20]byte, countOfPieces)
+
+	idsChan := make(chan int, countOfPieces)
+	for id := 0; id < countOfPieces; id++ {
+		idsChan <- id
+	}
+	close(idsChan)
+
+	errs := make([]error, workers)
+	wg := &sync.WaitGroup{}
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func(worker int) {
+			defer wg.Done()
+			buf := make([]byte, torrentFile.PieceLength)
+			for id := range idsChan {
+				piece := buf[:torrentFile.PieceSize(id)]
+				if _, readErr := dataStorage.ReadAt(piece, torrentFile.PieceOffset(id)); readErr != nil {
+					errs[worker] = fmt.Errorf("failed to read piece %d: %w", id, readErr)
+					return
+				}
+				torrentFile.PieceHashes[id] = sha1.Sum(piece)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for _, hashErr := range errs {
+		if hashErr != nil {
+			return hashErr
+		}
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package dht
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"net"
+)
+
+const (
+	queryPing         = "ping"
+	queryFindNode     = "find_node"
+	queryGetPeers     = "get_peers"
+	queryAnnouncePeer = "announce_peer"
+
+	typeQuery    = "q"
+	typeResponse = "r"
+	typeError    = "e"
+
+	errorGeneric       = 201
+	errorProtocol      = 203
+	errorMethodUnknown = 204
+
+	// compactNodeLength is a length of node in compact format: 20 bytes of ID, 4 bytes of IP and 2 bytes of port
+	compactNodeLength = 26
+)
+
+// NodeID identifies node in DHT, it has the same space as info hashes.
+type NodeID [20]byte
+
+func randomNodeID() NodeID {
+	var res NodeID
+	if _, err := rand.Read(res[:]); err != nil {
+		panic(fmt.Sprintf("failed to generate node ID: %v", err))
+	}
+	return res
+}
+
+// distance returns XOR metric between IDs.
+func (id NodeID) distance(other NodeID) NodeID {
+	var res NodeID
+	for idx := range id {
+		res[idx] = id[idx] ^ other[idx]
+	}
+	return res
+}
+
+// less reports that distance a is smaller than distance b.
+func less(a, b NodeID) bool {
+	for idx := range a {
+		if a[idx] != b[idx] {
+			return a[idx] < b[idx]
+		}
+	}
+	return false
+}
+
+// commonPrefixLength returns count of leading bits which are equal in both IDs.
+func commonPrefixLength(a, b NodeID) int {
+	for idx := range a {
+		if diff := a[idx] ^ b[idx]; diff != 0 {
+			return idx*8 + bits.LeadingZeros8(diff)
+		}
+	}
+	return len(a) * 8
+}
+
+// nodeInfo is an ID of node with its UDP address.
+type nodeInfo struct {
+	ID   NodeID
+	Addr *net.UDPAddr
+}
+
+// parseCompactNodes converts nodes in compact format to node infos.
+func parseCompactNodes(data string) ([]nodeInfo, error) {
+	if len(data)%compactNodeLength != 0 {
+		return nil, fmt.Errorf("invalid nodes length %d: length must deviding by %d", len(data), compactNodeLength)
+	}
+	res := make([]nodeInfo, 0, len(data)/compactNodeLength)
+	for left := 0; left < len(data); left += compactNodeLength {
+		var info nodeInfo
+		copy(info.ID[:], data[left:left+20])
+		ip := []byte(data[left+20 : left+24])
+		info.Addr = &net.UDPAddr{
+			IP:   net.IPv4(ip[0], ip[1], ip[2], ip[3]),
+			Port: int(binary.BigEndian.Uint16([]byte(data[left+24 : left+26]))),
+		}
+		if info.Addr.Port == 0 {
+			continue
+		}
+		res = append(res, info)
+	}
+	return res, nil
+}
+
+// compactNodes converts node infos to compact format, nodes without IPv4 address are skipped.
+func compactNodes(nodes []nodeInfo) string {
+	res := make([]byte, 0, len(nodes)*compactNodeLength)
+	for _, node := range nodes {
+		ip := node.Addr.IP.To4()
+		if ip == nil {
+			continue
+		}
+		res = append(res, node.ID[:]...)
+		res = append(res, ip...)
+		res = binary.BigEndian.AppendUint16(res, uint16(node.Addr.Port))
+	}
+	return string(res)
+}
+
+// krpcMessage is a message of KRPC protocol: query, response or error.
+type krpcMessage struct {
+	T string        `bencode:"t"`
+	Y string        `bencode:"y"`
+	Q string        `bencode:"q,omitempty"`
+	A *krpcArgs     `bencode:"a,omitempty"`
+	R *krpcResponse `bencode:"r,omitempty"`
+	E []interface{} `bencode:"e,omitempty"`
+}
+
+type krpcArgs struct {
+	ID          string `bencode:"id"`
+	Target      string `bencode:"target,omitempty"`
+	InfoHash    string `bencode:"info_hash,omitempty"`
+	Port        int    `bencode:"port,omitempty"`
+	ImpliedPort int    `bencode:"implied_port,omitempty"`
+	Token       string `bencode:"token,omitempty"`
+}
+
+type krpcResponse struct {
+	ID     string   `bencode:"id"`
+	Nodes  string   `bencode:"nodes,omitempty"`
+	Values []string `bencode:"values,omitempty"`
+	Token  string   `bencode:"token,omitempty"`
+}
+
+// Error is an error which remote node returned on query.
+type Error struct {
+	Code    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("DHT error %d: %s", e.Code, e.Message)
+}
+
+func parseError(raw []interface{}) *Error {
+	res := &Error{Code: errorGeneric}
+	if len(raw) > 0 {
+		if code, ok := raw[0].(int64); ok {
+			res.Code = int(code)
+		}
+	}
+	if len(raw) > 1 {
+		if msg, ok := raw[1].(string); ok {
+			res.Message = msg
+		}
+	}
+	return res
+}
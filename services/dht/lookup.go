@@ -0,0 +1,209 @@
+package dht
+
+import (
+	"fmt"
+	"github.com/hihoak/torrent-cli/services/peers"
+	log "github.com/rs/zerolog/log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// alpha is a count of concurrent queries of one lookup
+	alpha = 3
+	// lookupTimeout limits duration of one lookup
+	lookupTimeout = 20 * time.Second
+)
+
+type lookupCandidate struct {
+	info      nodeInfo
+	queried   bool
+	responded bool
+	failed    bool
+}
+
+type lookupReply struct {
+	from nodeInfo
+	resp *krpcResponse
+	err  error
+}
+
+type lookupResult struct {
+	peers []*peers.Peer
+	// closest are the closest to target nodes which responded, tokens are given by them in get_peers
+	closest []nodeInfo
+	tokens  map[NodeID]string
+}
+
+// lookup iteratively queries nodes closer and closer to target until the closest known nodes are
+// all queried. With getPeers get_peers is used and peers of target info hash are collected.
+func (n *Node) lookup(target NodeID, getPeers bool) lookupResult {
+	res := lookupResult{tokens: make(map[NodeID]string)}
+	candidates := make(map[NodeID]*lookupCandidate)
+	addCandidates := func(infos []nodeInfo) {
+		for _, info := range infos {
+			if _, ok := candidates[info.ID]; !ok && info.ID != n.id {
+				candidates[info.ID] = &lookupCandidate{info: info}
+			}
+		}
+	}
+	addCandidates(n.table.closest(target, bucketSize))
+
+	seenPeers := make(map[string]bool)
+	// at most alpha queries are in flight, so replies never block after lookup is finished
+	replies := make(chan lookupReply, alpha)
+	inFlight := 0
+	deadline := time.NewTimer(lookupTimeout)
+	defer deadline.Stop()
+	for {
+		sorted := sortCandidates(candidates, target)
+		considered := 0
+		for _, candidate := range sorted {
+			if considered >= bucketSize || inFlight >= alpha {
+				break
+			}
+			if candidate.failed {
+				continue
+			}
+			considered++
+			if candidate.queried {
+				continue
+			}
+			candidate.queried = true
+			inFlight++
+			go func(info nodeInfo) {
+				resp, err := n.lookupQuery(info, target, getPeers)
+				replies <- lookupReply{from: info, resp: resp, err: err}
+			}(candidate.info)
+		}
+		if inFlight == 0 {
+			break
+		}
+
+		select {
+		case reply := <-replies:
+			inFlight--
+			candidate := candidates[reply.from.ID]
+			if reply.err != nil {
+				candidate.failed = true
+				continue
+			}
+			candidate.responded = true
+			if reply.resp.Token != "" {
+				res.tokens[reply.from.ID] = reply.resp.Token
+			}
+			if nodes, err := parseCompactNodes(reply.resp.Nodes); err == nil {
+				addCandidates(nodes)
+			}
+			for _, value := range reply.resp.Values {
+				found, err := peers.ParseCompactPeers([]byte(value))
+				if err != nil {
+					continue
+				}
+				for _, peer := range found {
+					if !seenPeers[peer.String()] {
+						seenPeers[peer.String()] = true
+						res.peers = append(res.peers, peer)
+					}
+				}
+			}
+		case <-deadline.C:
+			log.Debug().Msgf("DHT lookup of %x is timed out", target)
+			return n.finishLookup(res, candidates, target)
+		case <-n.closed:
+			return res
+		}
+	}
+	return n.finishLookup(res, candidates, target)
+}
+
+func (n *Node) finishLookup(res lookupResult, candidates map[NodeID]*lookupCandidate, target NodeID) lookupResult {
+	for _, candidate := range sortCandidates(candidates, target) {
+		if len(res.closest) >= bucketSize {
+			break
+		}
+		if candidate.responded {
+			res.closest = append(res.closest, candidate.info)
+		}
+	}
+	return res
+}
+
+func sortCandidates(candidates map[NodeID]*lookupCandidate, target NodeID) []*lookupCandidate {
+	res := make([]*lookupCandidate, 0, len(candidates))
+	for _, candidate := range candidates {
+		res = append(res, candidate)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return less(res[i].info.ID.distance(target), res[j].info.ID.distance(target))
+	})
+	return res
+}
+
+func (n *Node) lookupQuery(info nodeInfo, target NodeID, getPeers bool) (*krpcResponse, error) {
+	if getPeers {
+		return n.query(info, queryGetPeers, &krpcArgs{InfoHash: string(target[:])})
+	}
+	return n.query(info, queryFindNode, &krpcArgs{Target: string(target[:])})
+}
+
+// Bootstrap joins DHT. Bootstrap nodes are used if routing table is empty, then lookup of our own ID
+// fills the table with nodes close to us.
+func (n *Node) Bootstrap() {
+	n.mu.Lock()
+	n.bootstrapped = true
+	n.mu.Unlock()
+	if n.table.len() == 0 {
+		n.AddNodes(n.config.BootstrapNodes)
+	}
+	n.lookup(n.id, false)
+	log.Info().Msgf("DHT routing table has %d nodes", n.table.len())
+}
+
+func (n *Node) isBootstrapped() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.bootstrapped
+}
+
+// GetPeers finds peers of the torrent in DHT and announces to the closest nodes that we accept connections
+// on port, 0 port disables announce. Node is bootstrapped on the first call.
+func (n *Node) GetPeers(infoHash [20]byte, port uint16) ([]*peers.Peer, error) {
+	if !n.isBootstrapped() {
+		n.Bootstrap()
+	}
+	if n.table.len() == 0 {
+		return nil, fmt.Errorf("failed to find peers in DHT: no nodes are known")
+	}
+	res := n.lookup(NodeID(infoHash), true)
+	if port > 0 {
+		n.announce(infoHash, port, res)
+	}
+	log.Info().Msgf("found %d peers in DHT", len(res.peers))
+	return res.peers, nil
+}
+
+// announce tells the closest nodes which gave us tokens that we have the torrent.
+func (n *Node) announce(infoHash [20]byte, port uint16, res lookupResult) {
+	wg := &sync.WaitGroup{}
+	for _, info := range res.closest {
+		token, ok := res.tokens[info.ID]
+		if !ok {
+			continue
+		}
+		wg.Add(1)
+		go func(info nodeInfo, token string) {
+			defer wg.Done()
+			_, err := n.query(info, queryAnnouncePeer, &krpcArgs{
+				InfoHash: string(infoHash[:]),
+				Port:     int(port),
+				Token:    token,
+			})
+			if err != nil {
+				log.Debug().Err(err).Msgf("failed to announce to DHT node %s", info.Addr)
+			}
+		}(info, token)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,344 @@
+package dht
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"github.com/hihoak/torrent-cli/bencode"
+	"github.com/hihoak/torrent-cli/services/peers"
+	log "github.com/rs/zerolog/log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// queryTimeout is how long response of remote node is awaited
+	queryTimeout = 3 * time.Second
+	// maintenanceInterval is how often questionable nodes are pinged and stale buckets are refreshed
+	maintenanceInterval = time.Minute
+	maxPacketSize       = 65536
+	// transactionIDLength is a length of random transaction ID, so responses can't be guessed by other hosts
+	transactionIDLength = 4
+)
+
+// DefaultBootstrapNodes are well known nodes which are used to join DHT when routing table is empty.
+var DefaultBootstrapNodes = []string{
+	"router.bittorrent.com:6881",
+	"router.utorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+}
+
+var errClosed = errors.New("DHT node is closed")
+
+type Config struct {
+	// Addr is UDP address which node listens, for example ":6881" or "127.0.0.1:0"
+	Addr string
+	// BootstrapNodes are "host:port" addresses of nodes which are used to join DHT
+	BootstrapNodes []string
+	// StatePath is a file where ID and routing table are kept between runs, empty value disables it
+	StatePath string
+}
+
+// Node is a node of mainline DHT (BEP 5). It answers queries of other nodes and finds peers of
+// torrents by iterative lookups. Only IPv4 nodes are supported.
+type Node struct {
+	config Config
+	id     NodeID
+	conn   *net.UDPConn
+	table  *routingTable
+	tokens *tokens
+	store  *peerStore
+
+	mu           sync.Mutex
+	transactions map[string]*transaction
+	bootstrapped bool
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// transaction is a query which waits for response from addr.
+type transaction struct {
+	addr      *net.UDPAddr
+	responses chan *krpcMessage
+}
+
+// NewNode restores state of the node if it exists and starts listening, queries are processed by Serve.
+func NewNode(config Config) (*Node, error) {
+	id, nodes, err := loadState(config.StatePath)
+	if err != nil {
+		log.Warn().Err(err).Msg("ignore DHT state and start with empty routing table")
+		id, nodes = randomNodeID(), nil
+	}
+
+	addr, err := net.ResolveUDPAddr("udp4", config.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve DHT address %q: %w", config.Addr, err)
+	}
+	conn, err := net.ListenUDP("udp4", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen DHT address %q: %w", config.Addr, err)
+	}
+
+	n := &Node{
+		config:       config,
+		id:           id,
+		conn:         conn,
+		table:        newRoutingTable(id),
+		tokens:       newTokens(time.Now()),
+		store:        newPeerStore(),
+		transactions: make(map[string]*transaction),
+		closed:       make(chan struct{}),
+	}
+	for _, info := range nodes {
+		// restored nodes are questionable until they respond
+		n.table.add(info, time.Time{})
+	}
+	return n, nil
+}
+
+func (n *Node) ID() NodeID {
+	return n.id
+}
+
+// Addr returns UDP address which node is bound to.
+func (n *Node) Addr() *net.UDPAddr {
+	return n.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// Serve processes incoming messages and maintains routing table until node is closed.
+func (n *Node) Serve() error {
+	go n.maintain()
+	buf := make([]byte, maxPacketSize)
+	for {
+		size, from, err := n.conn.ReadFromUDP(buf)
+		if err != nil {
+			if n.isClosed() {
+				return nil
+			}
+			return fmt.Errorf("failed to read DHT packet: %w", err)
+		}
+		msg := &krpcMessage{}
+		if decodeErr := bencode.Unmarshal(buf[:size], msg); decodeErr != nil {
+			log.Debug().Err(decodeErr).Msgf("ignore malformed DHT packet from %s", from)
+			continue
+		}
+		n.handle(msg, from)
+	}
+}
+
+// Close stops node and saves its state.
+func (n *Node) Close() error {
+	var err error
+	n.closeOnce.Do(func() {
+		close(n.closed)
+		if saveErr := saveState(n.config.StatePath, n.id, n.table.all()); saveErr != nil {
+			log.Error().Err(saveErr).Msg("failed to save DHT state")
+		}
+		err = n.conn.Close()
+	})
+	return err
+}
+
+func (n *Node) isClosed() bool {
+	select {
+	case <-n.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (n *Node) handle(msg *krpcMessage, from *net.UDPAddr) {
+	switch msg.Y {
+	case typeQuery:
+		if msg.A == nil || len(msg.A.ID) != len(NodeID{}) {
+			n.sendError(msg.T, from, errorProtocol, "invalid arguments")
+			return
+		}
+		n.table.add(nodeInfo{ID: NodeID([]byte(msg.A.ID)), Addr: from}, time.Now())
+		n.handleQuery(msg, from)
+	case typeResponse, typeError:
+		n.mu.Lock()
+		t, ok := n.transactions[msg.T]
+		// response from another address is ignored, so it can't be spoofed with only transaction ID
+		if ok && t.addr.IP.Equal(from.IP) && t.addr.Port == from.Port {
+			delete(n.transactions, msg.T)
+		} else {
+			ok = false
+		}
+		n.mu.Unlock()
+		if !ok {
+			log.Debug().Msgf("ignore DHT response from %s to unknown transaction", from)
+			return
+		}
+		t.responses <- msg
+	}
+}
+
+func (n *Node) handleQuery(msg *krpcMessage, from *net.UDPAddr) {
+	now := time.Now()
+	resp := &krpcResponse{ID: string(n.id[:])}
+	switch msg.Q {
+	case queryPing:
+	case queryFindNode:
+		if len(msg.A.Target) != len(NodeID{}) {
+			n.sendError(msg.T, from, errorProtocol, "invalid target")
+			return
+		}
+		resp.Nodes = compactNodes(n.table.closest(NodeID([]byte(msg.A.Target)), bucketSize))
+	case queryGetPeers:
+		if len(msg.A.InfoHash) != len(NodeID{}) {
+			n.sendError(msg.T, from, errorProtocol, "invalid info hash")
+			return
+		}
+		infoHash := NodeID([]byte(msg.A.InfoHash))
+		resp.Token = n.tokens.token(from.IP, now)
+		for _, peer := range n.store.get(infoHash, now) {
+			resp.Values = append(resp.Values, string(peer.Compact()))
+		}
+		if len(resp.Values) == 0 {
+			resp.Nodes = compactNodes(n.table.closest(infoHash, bucketSize))
+		}
+	case queryAnnouncePeer:
+		if len(msg.A.InfoHash) != len(NodeID{}) {
+			n.sendError(msg.T, from, errorProtocol, "invalid info hash")
+			return
+		}
+		if !n.tokens.isValid(msg.A.Token, from.IP, now) {
+			n.sendError(msg.T, from, errorProtocol, "bad token")
+			return
+		}
+		port := msg.A.Port
+		if msg.A.ImpliedPort != 0 {
+			port = from.Port
+		}
+		if port <= 0 || port > 65535 {
+			n.sendError(msg.T, from, errorProtocol, "invalid port")
+			return
+		}
+		n.store.add(NodeID([]byte(msg.A.InfoHash)), &peers.Peer{IP: from.IP, Port: uint16(port)}, now)
+	default:
+		n.sendError(msg.T, from, errorMethodUnknown, "method unknown")
+		return
+	}
+	n.send(&krpcMessage{T: msg.T, Y: typeResponse, R: resp}, from)
+}
+
+func (n *Node) send(msg *krpcMessage, to *net.UDPAddr) {
+	data, err := bencode.Marshal(msg)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to marshall DHT message")
+		return
+	}
+	if _, err = n.conn.WriteToUDP(data, to); err != nil && !n.isClosed() {
+		log.Debug().Err(err).Msgf("failed to send DHT message to %s", to)
+	}
+}
+
+func (n *Node) sendError(transaction string, to *net.UDPAddr, code int, message string) {
+	n.send(&krpcMessage{T: transaction, Y: typeError, E: []interface{}{code, message}}, to)
+}
+
+// query sends query to node and waits for its response. Node which responded is added to routing table,
+// node with known ID which didn't respond is marked as failed.
+func (n *Node) query(to nodeInfo, method string, args *krpcArgs) (*krpcResponse, error) {
+	args.ID = string(n.id[:])
+	responses := make(chan *krpcMessage, 1)
+	transactionID, err := n.addTransaction(&transaction{addr: to.Addr, responses: responses})
+	if err != nil {
+		return nil, err
+	}
+
+	n.send(&krpcMessage{T: transactionID, Y: typeQuery, Q: method, A: args}, to.Addr)
+
+	timer := time.NewTimer(queryTimeout)
+	defer timer.Stop()
+	select {
+	case msg := <-responses:
+		if msg.Y == typeError {
+			return nil, parseError(msg.E)
+		}
+		if msg.R == nil || len(msg.R.ID) != len(NodeID{}) {
+			return nil, fmt.Errorf("invalid response of %s", to.Addr)
+		}
+		n.table.add(nodeInfo{ID: NodeID([]byte(msg.R.ID)), Addr: to.Addr}, time.Now())
+		return msg.R, nil
+	case <-timer.C:
+	case <-n.closed:
+		return nil, errClosed
+	}
+
+	n.mu.Lock()
+	delete(n.transactions, transactionID)
+	n.mu.Unlock()
+	if to.ID != (NodeID{}) {
+		n.table.failed(to.ID)
+	}
+	return nil, fmt.Errorf("node %s didn't respond to %s", to.Addr, method)
+}
+
+// addTransaction registers transaction with random ID which isn't used by other transactions.
+func (n *Node) addTransaction(t *transaction) (string, error) {
+	buf := make([]byte, transactionIDLength)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for {
+		if _, err := rand.Read(buf); err != nil {
+			return "", fmt.Errorf("failed to generate transaction ID: %w", err)
+		}
+		if _, ok := n.transactions[string(buf)]; !ok {
+			n.transactions[string(buf)] = t
+			return string(buf), nil
+		}
+	}
+}
+
+// Ping checks that node on addr is alive, it is added to routing table if it responds.
+func (n *Node) Ping(addr *net.UDPAddr) error {
+	_, err := n.query(nodeInfo{Addr: addr}, queryPing, &krpcArgs{})
+	return err
+}
+
+// AddNodes pings nodes in "host:port" form, for example from "nodes" of torrent file, so they get
+// into routing table.
+func (n *Node) AddNodes(addrs []string) {
+	wg := &sync.WaitGroup{}
+	for _, addr := range addrs {
+		udpAddr, err := net.ResolveUDPAddr("udp4", addr)
+		if err != nil {
+			log.Debug().Err(err).Msgf("failed to resolve DHT node %s", addr)
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if pingErr := n.Ping(udpAddr); pingErr != nil {
+				log.Debug().Err(pingErr).Msg("failed to add DHT node")
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// maintain pings questionable nodes and refreshes buckets which didn't change for a while.
+func (n *Node) maintain() {
+	ticker := time.NewTicker(maintenanceInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.closed:
+			return
+		case now := <-ticker.C:
+			for _, info := range n.table.questionable(now) {
+				go func(info nodeInfo) {
+					_, _ = n.query(info, queryPing, &krpcArgs{})
+				}(info)
+			}
+			for _, target := range n.table.staleTargets(now) {
+				n.lookup(target, false)
+			}
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package dht
+
+import (
+	"github.com/hihoak/torrent-cli/bencode"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestNode(t *testing.T, bootstrapNodes ...string) *Node {
+	node, err := NewNode(Config{Addr: "127.0.0.1:0", BootstrapNodes: bootstrapNodes})
+	if err != nil {
+		t.Fatalf("failed to create node: %v", err)
+	}
+	t.Cleanup(func() { _ = node.Close() })
+	go func() {
+		if err := node.Serve(); err != nil {
+			t.Errorf("failed to serve: %v", err)
+		}
+	}()
+	return node
+}
+
+func TestNodesFindAnnouncedPeers(t *testing.T) {
+	router := newTestNode(t)
+	nodes := make([]*Node, 5)
+	for idx := range nodes {
+		nodes[idx] = newTestNode(t, router.Addr().String())
+		nodes[idx].Bootstrap()
+		if nodes[idx].table.len() == 0 {
+			t.Fatalf("node %d has empty routing table after bootstrap", idx)
+		}
+	}
+	if router.table.len() != len(nodes) {
+		t.Errorf("expected %d nodes in routing table of bootstrap node got %d", len(nodes), router.table.len())
+	}
+
+	infoHash := [20]byte{1, 2, 3}
+	found, err := nodes[0].GetPeers(infoHash, 6881)
+	if err != nil {
+		t.Fatalf("failed to get peers: %v", err)
+	}
+	if len(found) != 0 {
+		t.Fatalf("expected no peers before announce got %v", found)
+	}
+
+	found, err = nodes[len(nodes)-1].GetPeers(infoHash, 0)
+	if err != nil {
+		t.Fatalf("failed to get peers: %v", err)
+	}
+	if len(found) != 1 || found[0].String() != "127.0.0.1:6881" {
+		t.Fatalf("expected announced peer got %v", found)
+	}
+}
+
+func TestNodeIgnoresResponseFromAnotherAddress(t *testing.T) {
+	node := newTestNode(t)
+	remote, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer remote.Close()
+	spoofer, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer spoofer.Close()
+
+	pingErr := make(chan error, 1)
+	go func() {
+		pingErr <- node.Ping(remote.LocalAddr().(*net.UDPAddr))
+	}()
+
+	buf := make([]byte, maxPacketSize)
+	if err = remote.SetReadDeadline(time.Now().Add(queryTimeout)); err != nil {
+		t.Fatalf("failed to set deadline: %v", err)
+	}
+	size, from, err := remote.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("failed to read query: %v", err)
+	}
+	query := &krpcMessage{}
+	if err = bencode.Unmarshal(buf[:size], query); err != nil {
+		t.Fatalf("failed to decode query: %v", err)
+	}
+	if len(query.T) != transactionIDLength {
+		t.Errorf("expected transaction ID of %d bytes got %q", transactionIDLength, query.T)
+	}
+
+	respond := func(conn *net.UDPConn, id NodeID) {
+		data, marshalErr := bencode.Marshal(&krpcMessage{T: query.T, Y: typeResponse, R: &krpcResponse{ID: string(id[:])}})
+		if marshalErr != nil {
+			t.Fatalf("failed to marshall response: %v", marshalErr)
+		}
+		if _, writeErr := conn.WriteToUDP(data, from); writeErr != nil {
+			t.Fatalf("failed to send response: %v", writeErr)
+		}
+	}
+	spoofedID, remoteID := NodeID{1}, NodeID{2}
+	respond(spoofer, spoofedID)
+	select {
+	case err = <-pingErr:
+		t.Fatalf("ping must ignore response from another address, got %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	respond(remote, remoteID)
+	if err = <-pingErr; err != nil {
+		t.Fatalf("failed to ping: %v", err)
+	}
+	closest := node.table.closest(remoteID, bucketSize)
+	if len(closest) != 1 || closest[0].ID != remoteID {
+		t.Errorf("expected only queried node in routing table got %v", closest)
+	}
+}
@@ -0,0 +1,192 @@
+package dht
+
+import (
+	"crypto/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// bucketSize is K of Kademlia: count of nodes in a bucket and count of closest nodes in lookups
+	bucketSize = 8
+	idBits     = len(NodeID{}) * 8
+	// questionableAfter is how long node may be silent before it is pinged
+	questionableAfter = 15 * time.Minute
+	// maxFailures is a count of unanswered queries in a row after which node is removed
+	maxFailures = 2
+)
+
+type node struct {
+	nodeInfo
+	lastSeen time.Time
+	failures int
+}
+
+// isGood reports that node responded recently and didn't fail since then.
+func (n *node) isGood(now time.Time) bool {
+	return n.failures == 0 && now.Sub(n.lastSeen) < questionableAfter
+}
+
+type bucket struct {
+	nodes       []*node
+	lastChanged time.Time
+}
+
+// routingTable keeps known nodes in buckets by length of common prefix of their IDs and our ID,
+// so the table knows many nodes close to us and few far ones.
+type routingTable struct {
+	mu      sync.Mutex
+	self    NodeID
+	buckets [idBits]bucket
+}
+
+func newRoutingTable(self NodeID) *routingTable {
+	return &routingTable{self: self}
+}
+
+func (t *routingTable) bucketIndex(id NodeID) int {
+	idx := commonPrefixLength(t.self, id)
+	if idx >= idBits {
+		idx = idBits - 1
+	}
+	return idx
+}
+
+// add puts node which we heard from at seen into its bucket. If bucket is full the new node replaces
+// a node which failed to respond, otherwise it is dropped. False is returned if node isn't added.
+func (t *routingTable) add(info nodeInfo, seen time.Time) bool {
+	if info.ID == t.self || info.Addr == nil || info.Addr.Port == 0 {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b := &t.buckets[t.bucketIndex(info.ID)]
+	for idx, existing := range b.nodes {
+		if existing.ID != info.ID {
+			continue
+		}
+		existing.Addr = info.Addr
+		if seen.After(existing.lastSeen) {
+			existing.lastSeen = seen
+		}
+		existing.failures = 0
+		// the most recently seen nodes are kept at the end
+		b.nodes = append(append(b.nodes[:idx:idx], b.nodes[idx+1:]...), existing)
+		b.lastChanged = time.Now()
+		return true
+	}
+
+	newNode := &node{nodeInfo: info, lastSeen: seen}
+	if len(b.nodes) < bucketSize {
+		b.nodes = append(b.nodes, newNode)
+		b.lastChanged = time.Now()
+		return true
+	}
+	for idx, existing := range b.nodes {
+		if existing.failures > 0 {
+			b.nodes = append(append(b.nodes[:idx:idx], b.nodes[idx+1:]...), newNode)
+			b.lastChanged = time.Now()
+			return true
+		}
+	}
+	return false
+}
+
+// failed marks that node didn't respond, node is removed after maxFailures in a row.
+func (t *routingTable) failed(id NodeID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b := &t.buckets[t.bucketIndex(id)]
+	for idx, existing := range b.nodes {
+		if existing.ID != id {
+			continue
+		}
+		existing.failures++
+		if existing.failures >= maxFailures {
+			b.nodes = append(b.nodes[:idx], b.nodes[idx+1:]...)
+		}
+		return
+	}
+}
+
+// closest returns up to count nodes which are the closest to target.
+func (t *routingTable) closest(target NodeID, count int) []nodeInfo {
+	res := t.all()
+	sort.Slice(res, func(i, j int) bool {
+		return less(res[i].ID.distance(target), res[j].ID.distance(target))
+	})
+	if len(res) > count {
+		res = res[:count]
+	}
+	return res
+}
+
+func (t *routingTable) all() []nodeInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var res []nodeInfo
+	for idx := range t.buckets {
+		for _, n := range t.buckets[idx].nodes {
+			res = append(res, n.nodeInfo)
+		}
+	}
+	return res
+}
+
+func (t *routingTable) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var res int
+	for idx := range t.buckets {
+		res += len(t.buckets[idx].nodes)
+	}
+	return res
+}
+
+// questionable returns nodes which weren't heard from for a while, they must be pinged.
+func (t *routingTable) questionable(now time.Time) []nodeInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var res []nodeInfo
+	for idx := range t.buckets {
+		for _, n := range t.buckets[idx].nodes {
+			if !n.isGood(now) {
+				res = append(res, n.nodeInfo)
+			}
+		}
+	}
+	return res
+}
+
+// staleTargets returns random IDs in ranges of non-empty buckets which didn't change for a while,
+// lookups of them refresh the buckets.
+func (t *routingTable) staleTargets(now time.Time) []NodeID {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var res []NodeID
+	for idx := range t.buckets {
+		b := &t.buckets[idx]
+		if len(b.nodes) > 0 && now.Sub(b.lastChanged) >= questionableAfter {
+			res = append(res, t.randomIDInBucket(idx))
+			b.lastChanged = now
+		}
+	}
+	return res
+}
+
+// randomIDInBucket returns ID which shares exactly idx leading bits with our ID.
+func (t *routingTable) randomIDInBucket(idx int) NodeID {
+	var random NodeID
+	_, _ = rand.Read(random[:])
+	res := t.self
+	for bit := idx; bit < idBits; bit++ {
+		mask := byte(1) << (7 - bit%8)
+		if bit == idx {
+			res[bit/8] ^= mask
+			continue
+		}
+		res[bit/8] = res[bit/8]&^mask | random[bit/8]&mask
+	}
+	return res
+}
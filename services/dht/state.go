@@ -0,0 +1,64 @@
+package dht
+
+import (
+	"errors"
+	"fmt"
+	"github.com/hihoak/torrent-cli/bencode"
+	"os"
+	"path/filepath"
+)
+
+type bencodeState struct {
+	ID    string `bencode:"id"`
+	Nodes string `bencode:"nodes"`
+}
+
+// loadState reads ID of the node and nodes of its routing table. If path is empty or file doesn't exist
+// new random ID is returned.
+func loadState(path string) (NodeID, []nodeInfo, error) {
+	if path == "" {
+		return randomNodeID(), nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return randomNodeID(), nil, nil
+	}
+	if err != nil {
+		return NodeID{}, nil, fmt.Errorf("failed to read DHT state %q: %w", path, err)
+	}
+
+	state := bencodeState{}
+	if err = bencode.Unmarshal(data, &state); err != nil {
+		return NodeID{}, nil, fmt.Errorf("failed to unmarshall DHT state %q: %w", path, err)
+	}
+	if len(state.ID) != len(NodeID{}) {
+		return NodeID{}, nil, fmt.Errorf("invalid node ID length %d in DHT state %q", len(state.ID), path)
+	}
+	nodes, err := parseCompactNodes(state.Nodes)
+	if err != nil {
+		return NodeID{}, nil, fmt.Errorf("failed to parse nodes of DHT state %q: %w", path, err)
+	}
+	return NodeID([]byte(state.ID)), nodes, nil
+}
+
+// saveState atomically writes ID of the node and nodes of its routing table, empty path disables saving.
+func saveState(path string, id NodeID, nodes []nodeInfo) error {
+	if path == "" {
+		return nil
+	}
+	data, err := bencode.Marshal(bencodeState{ID: string(id[:]), Nodes: compactNodes(nodes)})
+	if err != nil {
+		return fmt.Errorf("failed to marshall DHT state: %w", err)
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create directory of DHT state: %w", err)
+	}
+	tmpPath := path + ".tmp"
+	if err = os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write DHT state %q: %w", tmpPath, err)
+	}
+	if err = os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to replace DHT state %q: %w", path, err)
+	}
+	return nil
+}
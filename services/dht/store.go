@@ -0,0 +1,109 @@
+package dht
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"github.com/hihoak/torrent-cli/services/peers"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// tokenRotateInterval is how often secret of tokens changes, tokens of the previous secret are accepted too
+	tokenRotateInterval = 5 * time.Minute
+	// peerTTL is how long announced peer is kept without reannounce
+	peerTTL = 30 * time.Minute
+	// maxValuesPerResponse limits count of peers in get_peers response, so it fits into UDP packet
+	maxValuesPerResponse = 50
+)
+
+// tokens are given in get_peers responses and checked in announce_peer queries, so only nodes
+// which asked for peers from their IP can announce.
+type tokens struct {
+	mu         sync.Mutex
+	secret     [20]byte
+	prevSecret [20]byte
+	rotatedAt  time.Time
+}
+
+func newTokens(now time.Time) *tokens {
+	res := &tokens{rotatedAt: now}
+	_, _ = rand.Read(res.secret[:])
+	res.prevSecret = res.secret
+	return res
+}
+
+func (t *tokens) rotate(now time.Time) {
+	if now.Sub(t.rotatedAt) < tokenRotateInterval {
+		return
+	}
+	t.prevSecret = t.secret
+	_, _ = rand.Read(t.secret[:])
+	t.rotatedAt = now
+}
+
+func tokenFor(secret [20]byte, ip net.IP) string {
+	hash := sha1.Sum(append(secret[:], ip...))
+	return string(hash[:8])
+}
+
+func (t *tokens) token(ip net.IP, now time.Time) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rotate(now)
+	return tokenFor(t.secret, ip)
+}
+
+func (t *tokens) isValid(token string, ip net.IP, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rotate(now)
+	return token == tokenFor(t.secret, ip) || token == tokenFor(t.prevSecret, ip)
+}
+
+// peerStore keeps peers which announced torrents to us.
+type peerStore struct {
+	mu    sync.Mutex
+	peers map[[20]byte]map[string]storedPeer
+}
+
+type storedPeer struct {
+	peer      *peers.Peer
+	announced time.Time
+}
+
+func newPeerStore() *peerStore {
+	return &peerStore{
+		peers: make(map[[20]byte]map[string]storedPeer),
+	}
+}
+
+func (s *peerStore) add(infoHash [20]byte, peer *peers.Peer, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.peers[infoHash] == nil {
+		s.peers[infoHash] = make(map[string]storedPeer)
+	}
+	s.peers[infoHash][peer.String()] = storedPeer{peer: peer, announced: now}
+}
+
+// get returns up to maxValuesPerResponse peers of the torrent, expired peers are removed.
+func (s *peerStore) get(infoHash [20]byte, now time.Time) []*peers.Peer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var res []*peers.Peer
+	for addr, stored := range s.peers[infoHash] {
+		if now.Sub(stored.announced) > peerTTL {
+			delete(s.peers[infoHash], addr)
+			continue
+		}
+		if len(res) < maxValuesPerResponse {
+			res = append(res, stored.peer)
+		}
+	}
+	if len(s.peers[infoHash]) == 0 {
+		delete(s.peers, infoHash)
+	}
+	return res
+}
@@ -0,0 +1,69 @@
+package downloader
+
+import (
+	"github.com/hihoak/torrent-cli/services/peers"
+	log "github.com/rs/zerolog/log"
+	"time"
+)
+
+// announceRetryInterval is used when trackers failed or didn't return an interval
+const announceRetryInterval = time.Minute
+
+// announceLoop announces to trackers with interval which they requested until download is finished,
+// peers from responses are added to the download.
+func (d *Downloader) announceLoop() {
+	if d.config.Trackers == nil || len(d.torrentFile.AnnounceList) == 0 {
+		return
+	}
+	interval := d.config.Trackers.Interval()
+	if interval <= 0 {
+		interval = announceRetryInterval
+	}
+	nextAnnounce := time.NewTimer(interval)
+	defer nextAnnounce.Stop()
+	for {
+		select {
+		case <-d.stopChan:
+			return
+		case <-nextAnnounce.C:
+			nextAnnounce.Reset(d.announce(peers.EventNone))
+		}
+	}
+}
+
+// announce notifies trackers about progress of the download and returns interval after which next
+// announce must be sent.
+func (d *Downloader) announce(event peers.Event) time.Duration {
+	if d.config.Trackers == nil || len(d.torrentFile.AnnounceList) == 0 {
+		return announceRetryInterval
+	}
+	resp, err := d.config.Trackers.Announce(peers.AnnounceRequest{
+		InfoHash: d.torrentFile.VerifyHash,
+		PeerID:   peers.MyPeerID,
+		Port:     d.config.Port,
+		Left:     d.left(),
+		Event:    event,
+	})
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to announce to trackers")
+		return announceRetryInterval
+	}
+	if event != peers.EventCompleted && event != peers.EventStopped {
+		d.AddPeers(resp.Peers)
+	}
+	if resp.Interval <= 0 {
+		return announceRetryInterval
+	}
+	return resp.Interval
+}
+
+// left returns count of bytes which aren't downloaded yet.
+func (d *Downloader) left() int64 {
+	var res int64
+	for idx := range d.torrentFile.PieceHashes {
+		if !d.HasPiece(idx) {
+			res += int64(d.torrentFile.PieceSize(idx))
+		}
+	}
+	return res
+}
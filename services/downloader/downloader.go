@@ -1,21 +1,19 @@
 package downloader
 
 import (
-	"bytes"
-	"crypto/sha1"
+	"errors"
 	"fmt"
 	"github.com/hihoak/torrent-cli/client/torrent"
 	"github.com/hihoak/torrent-cli/services/peers"
+	"github.com/hihoak/torrent-cli/services/resume"
+	"github.com/hihoak/torrent-cli/services/storage"
 	"github.com/hihoak/torrent-cli/services/torrent-file-decoder"
+	"github.com/hihoak/torrent-cli/services/uploader"
 	log "github.com/rs/zerolog/log"
-	"os"
+	"net"
 	"sync"
 )
 
-type PieceDownloader interface {
-	DownloadPiece() (bool, error)
-}
-
 const (
 	maxBlockSize = 16384
 )
@@ -26,111 +24,395 @@ type workPiece struct {
 	Hash        [20]byte
 }
 
+type Config struct {
+	// ResumePath is a path to the file where completed pieces are persisted.
+	// Empty value disables resuming.
+	ResumePath string
+	// VerifyOnResume forces re-hashing of pieces that are marked as completed in resume file.
+	VerifyOnResume bool
+	// MaxPeers limits count of peers which we download from, the rest of known peers are connected
+	// when others disconnect. 0 means no limit.
+	MaxPeers int
+	// Trackers are announced periodically during download to get more peers, nil disables announces
+	Trackers *peers.TrackerList
+	// Port is a port on which incoming peers are accepted, it is announced to trackers
+	Port uint16
+}
+
 type Downloader struct {
 	torrentFile *torrent_file_decoder.TorrentFile
+	config      Config
 
-	peers []*peers.Peer
+	picker    *piecePicker
+	scheduler *scheduler
+	doneChan  chan workPiece
 
-	todoChan chan workPiece
-	doneChan chan workPiece
+	storage  storage.Storage
+	uploader *uploader.Uploader
 
-	buf []byte
+	// completedMu guards completed which is read by uploader and listener
+	completedMu sync.RWMutex
+	completed   torrent.Bitfield
+
+	mu            sync.Mutex
+	activeWorkers int
+	started       bool
+	finished      bool
+	clients       map[*torrent.Client]*connection
+	// knownPeers are addresses of all peers which were ever added, candidates are the ones
+	// which aren't connected yet
+	knownPeers map[string]bool
+	candidates []*peers.Peer
+	// stopChan is closed when download is finished, workers must exit after that
+	stopChan chan struct{}
 }
 
-func NewDownloader(torrentFile *torrent_file_decoder.TorrentFile, peers []*peers.Peer) *Downloader {
-	return &Downloader{
+// NewDownloader creates downloader of the torrent from peers, more peers can be added later by AddPeers.
+// Peer exchange is disabled for private torrents.
+func NewDownloader(torrentFile *torrent_file_decoder.TorrentFile, torrentPeers []*peers.Peer, storage storage.Storage, config Config) *Downloader {
+	d := &Downloader{
 		torrentFile: torrentFile,
-		peers:       peers,
-		todoChan:    make(chan workPiece, len(torrentFile.PieceHashes)),
+		config:      config,
+		storage:     storage,
+		completed:   torrent.NewBitfield(len(torrentFile.PieceHashes)),
+		picker:      newPiecePicker(len(torrentFile.PieceHashes)),
 		doneChan:    make(chan workPiece),
-		buf:         make([]byte, torrentFile.Length),
+		stopChan:    make(chan struct{}),
+		clients:     make(map[*torrent.Client]*connection),
+		knownPeers:  make(map[string]bool),
+	}
+	d.scheduler = newScheduler(d.picker, d.newWorkPiece)
+	d.uploader = uploader.NewUploader(torrentFile, storage, d)
+	if torrentFile.Private {
+		torrent.DefaultExtensions.Disable(torrentFile.VerifyHash, torrent.ExtensionPEX)
 	}
+	torrent.DefaultExtensions.SetMetadata(torrentFile.VerifyHash, torrentFile.RawInfo)
+	d.addPeers(torrentPeers)
+	return d
 }
 
-func (d *Downloader) calculateLengthForPiece(id int, sizeOfPiece int, totalLength int) int {
-	start := id * sizeOfPiece
-	end := start + sizeOfPiece
-	if end > totalLength {
-		end = totalLength
+// AddPeers adds peers found by trackers or other peers, they are connected if limit of peers isn't reached.
+// Peers which were added before are skipped.
+func (d *Downloader) AddPeers(torrentPeers []*peers.Peer) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.finished {
+		return
+	}
+	d.addPeers(torrentPeers)
+	if d.started {
+		d.connectPeers()
 	}
-	return end - start
 }
 
-func (d *Downloader) Download() error {
-	for idx, hash := range d.torrentFile.PieceHashes {
-		d.todoChan <- workPiece{
-			ID:          idx,
-			SizeOfPiece: d.calculateLengthForPiece(idx, d.torrentFile.PieceLength, d.torrentFile.Length),
-			Hash:        hash,
+// addPeers must be called with mu held.
+func (d *Downloader) addPeers(torrentPeers []*peers.Peer) {
+	for _, peer := range torrentPeers {
+		addr := peer.String()
+		if d.knownPeers[addr] || peer.Port == 0 {
+			continue
 		}
+		d.knownPeers[addr] = true
+		d.candidates = append(d.candidates, peer)
 	}
+}
 
-	wg := &sync.WaitGroup{}
-	wg.Add(len(d.peers))
-	for _, peer := range d.peers {
-		go func(peer *peers.Peer) {
-			defer wg.Done()
-			if err := d.downloadWorkerFunc(peer); err != nil {
+// connectPeers starts workers for candidates until limit of peers is reached, it must be called with mu held.
+func (d *Downloader) connectPeers() {
+	for len(d.candidates) > 0 && (d.config.MaxPeers <= 0 || d.activeWorkers < d.config.MaxPeers) {
+		peer := d.candidates[0]
+		d.candidates = d.candidates[1:]
+		d.activeWorkers++
+		go func() {
+			defer d.stopWorker()
+			if err := d.downloadWorkerFunc(peer); err != nil && !d.isStopped() {
 				log.Error().Err(err).Msgf("stop downloading pieces from peer %v", peer)
 			}
-		}(peer)
+		}()
+	}
+}
+
+// HasPiece reports that piece is downloaded and verified.
+func (d *Downloader) HasPiece(id int) bool {
+	d.completedMu.RLock()
+	defer d.completedMu.RUnlock()
+	return d.completed.HasPiece(id)
+}
+
+// IsComplete reports that all pieces are downloaded.
+func (d *Downloader) IsComplete() bool {
+	for idx := range d.torrentFile.PieceHashes {
+		if !d.HasPiece(idx) {
+			return false
+		}
 	}
+	return true
+}
+
+// SetPiecePriority changes order in which pieces are downloaded, pieces with higher priority go first.
+func (d *Downloader) SetPiecePriority(id int, priority Priority) {
+	d.picker.setPriority(id, priority)
+}
 
+// Bitfield returns copy of downloaded pieces.
+func (d *Downloader) Bitfield() torrent.Bitfield {
+	d.completedMu.RLock()
+	defer d.completedMu.RUnlock()
+	res := make(torrent.Bitfield, len(d.completed))
+	copy(res, d.completed)
+	return res
+}
+
+// AddPeer starts downloading from peer which connected to us. It can be called before Download.
+func (d *Downloader) AddPeer(client *torrent.Client) {
+	if !d.startWorker() {
+		if closeErr := client.Close(); closeErr != nil {
+			log.Error().Err(closeErr).Msg("failed to close connection to peer")
+		}
+		return
+	}
 	go func() {
-		wg.Wait()
-		close(d.doneChan)
-		close(d.todoChan)
+		defer d.stopWorker()
+		if err := d.incomingWorkerFunc(client); err != nil && !d.isStopped() {
+			log.Error().Err(err).Msgf("stop downloading pieces from incoming peer %s", client.RemoteAddr())
+		}
 	}()
+}
 
-	var countOfDonePieces int
-	for ; countOfDonePieces < len(d.torrentFile.PieceHashes); countOfDonePieces++ {
-		piece, ok := <-d.doneChan
-		if !ok {
-			break
+func (d *Downloader) startWorker() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.finished {
+		return false
+	}
+	d.activeWorkers++
+	return true
+}
+
+// stopWorker connects another known peer instead of the exited worker and finishes download
+// when there are no workers anymore.
+func (d *Downloader) stopWorker() {
+	d.mu.Lock()
+	d.activeWorkers--
+	if d.started && !d.finished {
+		d.connectPeers()
+	}
+	noWorkers := d.started && d.activeWorkers == 0
+	d.mu.Unlock()
+	if noWorkers {
+		d.finish()
+	}
+}
+
+// finish stops all workers, connections are closed to interrupt workers which wait for messages.
+func (d *Downloader) finish() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.finished {
+		return
+	}
+	d.finished = true
+	close(d.stopChan)
+	for client := range d.clients {
+		if closeErr := client.Close(); closeErr != nil {
+			log.Debug().Err(closeErr).Msg("failed to close connection to peer")
+		}
+	}
+}
+
+// isStopped reports that download is finished, errors of workers after that are expected
+// because connections are closed.
+func (d *Downloader) isStopped() bool {
+	select {
+	case <-d.stopChan:
+		return true
+	default:
+		return false
+	}
+}
+
+// addClient registers connection, addr is nil for incoming peers.
+func (d *Downloader) addClient(client *torrent.Client, addr *peers.Peer) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.finished {
+		return false
+	}
+	d.clients[client] = &connection{addr: addr, outgoing: addr != nil}
+	return true
+}
+
+func (d *Downloader) removeClient(client *torrent.Client) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.clients, client)
+}
+
+// broadcastHave tells all connected peers that we have a new piece.
+func (d *Downloader) broadcastHave(id int) {
+	d.mu.Lock()
+	clients := make([]*torrent.Client, 0, len(d.clients))
+	for client := range d.clients {
+		clients = append(clients, client)
+	}
+	d.mu.Unlock()
+
+	for _, client := range clients {
+		if err := client.SendHave(id); err != nil {
+			log.Debug().Err(err).Msgf("failed to send have to peer %s", client.RemoteAddr())
 		}
-		log.Info().Msgf("piece %d/%d downloaded...", piece.ID, len(d.torrentFile.PieceHashes))
 	}
+}
 
+func (d *Downloader) newWorkPiece(id int) workPiece {
+	return workPiece{
+		ID:          id,
+		SizeOfPiece: d.torrentFile.PieceSize(id),
+		Hash:        d.torrentFile.PieceHashes[id],
+	}
+}
+
+func (d *Downloader) loadCompletedPieces() error {
+	if d.config.ResumePath == "" {
+		return nil
+	}
+
+	completed, err := resume.Load(d.config.ResumePath, d.torrentFile)
+	if errors.Is(err, resume.ErrStateMismatch) || errors.Is(err, resume.ErrCorrupted) {
+		log.Warn().Err(err).Msg("ignore resume file and start download from scratch")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load resume file: %w", err)
+	}
+	d.completedMu.Lock()
+	d.completed = completed
+	d.completedMu.Unlock()
+
+	if !d.config.VerifyOnResume {
+		return nil
+	}
+	for idx := range d.torrentFile.PieceHashes {
+		if !d.HasPiece(idx) {
+			continue
+		}
+		piece := d.newWorkPiece(idx)
+		buf := make([]byte, piece.SizeOfPiece)
+		if _, readErr := d.storage.ReadAt(buf, d.torrentFile.PieceOffset(idx)); readErr != nil || !isValidPieceHash(buf, piece) {
+			log.Warn().Msgf("piece %d is marked as completed in resume file but data is corrupted", idx)
+			d.completedMu.Lock()
+			d.completed.ClearPiece(idx)
+			d.completedMu.Unlock()
+		}
+	}
+	return nil
+}
+
+func (d *Downloader) saveCompletedPieces() {
+	if d.config.ResumePath == "" {
+		return
+	}
+	if err := resume.Save(d.config.ResumePath, d.torrentFile, d.Bitfield()); err != nil {
+		log.Error().Err(err).Msg("failed to save resume file")
+	}
+}
+
+func (d *Downloader) Download() error {
+	if err := d.loadCompletedPieces(); err != nil {
+		return err
+	}
+
+	var countOfDonePieces int
+	for idx := range d.torrentFile.PieceHashes {
+		if d.HasPiece(idx) {
+			countOfDonePieces++
+			d.picker.done(idx)
+		}
+	}
+	if countOfDonePieces > 0 {
+		log.Info().Msgf("resume download: %d/%d pieces are already downloaded", countOfDonePieces, len(d.torrentFile.PieceHashes))
+	}
 	if countOfDonePieces == len(d.torrentFile.PieceHashes) {
-		if err := d.saveFile(); err != nil {
-			return fmt.Errorf("failed to save file to filesystem: %w", err)
+		log.Info().Msg("file is fully downloaded!")
+		return nil
+	}
+
+	go d.uploader.Run(d.stopChan)
+	go d.announceLoop()
+	d.mu.Lock()
+	d.started = true
+	d.connectPeers()
+	noWorkers := d.activeWorkers == 0
+	d.mu.Unlock()
+	if noWorkers {
+		d.finish()
+	}
+
+loop:
+	for countOfDonePieces < len(d.torrentFile.PieceHashes) {
+		select {
+		case piece := <-d.doneChan:
+			if d.HasPiece(piece.ID) {
+				// piece was downloaded by a peer which connected before resume state was loaded
+				continue
+			}
+			countOfDonePieces++
+			d.completedMu.Lock()
+			d.completed.SetPiece(piece.ID)
+			d.completedMu.Unlock()
+			d.saveCompletedPieces()
+			go d.broadcastHave(piece.ID)
+			log.Info().Msgf("piece %d/%d downloaded...", piece.ID, len(d.torrentFile.PieceHashes))
+		case <-d.stopChan:
+			break loop
 		}
+	}
+	d.finish()
+
+	if countOfDonePieces == len(d.torrentFile.PieceHashes) {
 		log.Info().Msg("file is fully downloaded!")
+		d.announce(peers.EventCompleted)
 		return nil
 	}
+	d.announce(peers.EventStopped)
 
 	return fmt.Errorf("failed to download file: downloaded %d/%d of all pieces", countOfDonePieces, len(d.torrentFile.PieceHashes))
 }
 
-func (d *Downloader) savePiece(piece workPiece, downloader *pieceDownloader) {
-	start := piece.ID * piece.SizeOfPiece
-	end := start + piece.SizeOfPiece
-	copy(d.buf[start:end], downloader.buf)
+func (d *Downloader) savePiece(piece workPiece, buf []byte) error {
+	if _, err := d.storage.WriteAt(buf, d.torrentFile.PieceOffset(piece.ID)); err != nil {
+		return fmt.Errorf("failed to write piece %d to storage: %w", piece.ID, err)
+	}
+	return nil
 }
 
-func (d *Downloader) saveFile() error {
-	file, err := os.OpenFile("saved_file", os.O_CREATE|os.O_RDWR, 0755)
-	if err != nil {
-		return fmt.Errorf("failed to create file: %w", err)
+// completePiece verifies piece which blocks are all received and saves it.
+func (d *Downloader) completePiece(pending *pendingPiece) error {
+	piece := pending.piece
+	if !isValidPieceHash(pending.buf, piece) {
+		log.Error().Msgf("failed to download piece %v because hash is not equal to expected", piece)
+		d.scheduler.pieceFailed(piece.ID)
+		return nil
 	}
-	defer func() {
-		if closeErr := file.Close(); closeErr != nil {
-			log.Error().Err(closeErr).Msg("failed to close file")
-		}
-	}()
-	if _, writeErr := file.Write(d.buf); writeErr != nil {
-		return fmt.Errorf("failed to write data to file: %w", writeErr)
+	if err := d.savePiece(piece, pending.buf); err != nil {
+		d.scheduler.pieceFailed(piece.ID)
+		return fmt.Errorf("failed to save piece %v: %w", piece, err)
+	}
+	log.Debug().Msgf("successfully download piece: %v", piece)
+	d.scheduler.pieceDone(piece.ID)
+	select {
+	case d.doneChan <- piece:
+	case <-d.stopChan:
 	}
 	return nil
 }
 
 func isValidPieceHash(buf []byte, piece workPiece) bool {
-	pieceHash := sha1.Sum(buf)
-	return bytes.Equal(pieceHash[:], piece.Hash[:])
+	return torrent_file_decoder.IsValidPiece(buf, piece.Hash)
 }
 
 func (d *Downloader) downloadWorkerFunc(peer *peers.Peer) error {
-	client, err := torrent.NewClient(d.torrentFile, peer)
+	client, err := torrent.NewClient(d.torrentFile, peer, d.Bitfield())
 	if err != nil {
 		return fmt.Errorf("failed to init client from peer %v: %w", peer, err)
 	}
@@ -140,33 +422,42 @@ func (d *Downloader) downloadWorkerFunc(peer *peers.Peer) error {
 		}
 	}()
 
-	if unchokeErr := client.SendUnchoke(); unchokeErr != nil {
-		return fmt.Errorf("failed to unchoke client: %w", unchokeErr)
+	return d.downloadFromClient(client, peer)
+}
+
+func (d *Downloader) incomingWorkerFunc(client *torrent.Client) error {
+	defer func() {
+		// connection is already closed if download is finished
+		if closeErr := client.Close(); closeErr != nil && !errors.Is(closeErr, net.ErrClosed) {
+			log.Error().Err(closeErr).Msg("failed to close connection to peer")
+		}
+	}()
+
+	if err := client.ReceiveBitfield(len(d.torrentFile.PieceHashes)); err != nil {
+		return fmt.Errorf("failed to retrieve bitfield: %w", err)
+	}
+	return d.downloadFromClient(client, nil)
+}
+
+// downloadFromClient downloads pieces from the client and uploads to it in the same time,
+// peer is unchoked by uploader. addr is nil for incoming peers.
+func (d *Downloader) downloadFromClient(client *torrent.Client, addr *peers.Peer) error {
+	if client.PeerID == string(peers.MyPeerID[:]) {
+		return fmt.Errorf("connected to ourselves")
 	}
+	if !d.addClient(client, addr) {
+		return nil
+	}
+	defer d.removeClient(client)
+	upload := d.uploader.AddPeer(client)
+	defer upload.Close()
+
 	if interestedErr := client.SendInterested(); interestedErr != nil {
 		return fmt.Errorf("failed to send interest to client: %w", interestedErr)
 	}
 
-	for piece := range d.todoChan {
-		if !client.HasPieceToDownload(piece.ID) {
-			d.todoChan <- piece
-			continue
-		}
-		downloader := NewPieceDownloader(client, piece)
-		downloadErr := downloader.DownloadPiece()
-		if downloadErr != nil {
-			d.todoChan <- piece
-			return fmt.Errorf("failed to download piece %v: %w", piece, downloadErr)
-		}
-		if !isValidPieceHash(downloader.buf, piece) {
-			log.Error().Msgf("failed to download piece %v because hash is not equal to expected", piece)
-			d.todoChan <- piece
-			continue
-		}
-		log.Debug().Msgf("successfully download piece: %v", piece)
-		d.doneChan <- piece
-		d.savePiece(piece, downloader)
-	}
+	d.picker.addPeer(client.HasPieceToDownload)
+	defer d.picker.removePeer(client.HasPieceToDownload)
 
-	return nil
+	return newPeerWorker(d, client, addr, upload).run()
 }
@@ -0,0 +1,69 @@
+package downloader
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"github.com/hihoak/torrent-cli/client/torrent"
+	"github.com/hihoak/torrent-cli/services/resume"
+	"github.com/hihoak/torrent-cli/services/storage"
+	torrent_file_decoder "github.com/hihoak/torrent-cli/services/torrent-file-decoder"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestDownloader creates downloader of two pieces, only the first of them is written to storage.
+func newTestDownloader(t *testing.T, resumePath string) *Downloader {
+	good, bad := bytes.Repeat([]byte{1}, 16384), bytes.Repeat([]byte{2}, 16384)
+	torrentFile := &torrent_file_decoder.TorrentFile{
+		Name:        "data",
+		VerifyHash:  [20]byte{1},
+		PieceLength: 16384,
+		PieceHashes: [][20]byte{sha1.Sum(good), sha1.Sum(bad)},
+		Length:      2 * 16384,
+		Files:       []torrent_file_decoder.File{{Path: []string{"data"}, Length: 2 * 16384}},
+	}
+	dataStorage, err := storage.NewFileStorage(torrentFile, t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create storage: %v", err)
+	}
+	t.Cleanup(func() { _ = dataStorage.Close() })
+	if _, err = dataStorage.WriteAt(good, 0); err != nil {
+		t.Fatalf("failed to write piece: %v", err)
+	}
+	return NewDownloader(torrentFile, nil, dataStorage, Config{ResumePath: resumePath, VerifyOnResume: true})
+}
+
+func TestLoadCompletedPiecesVerifiesResumeFile(t *testing.T) {
+	resumePath := filepath.Join(t.TempDir(), "data.resume")
+	d := newTestDownloader(t, resumePath)
+	completed := torrent.NewBitfield(2)
+	completed.SetPiece(0)
+	completed.SetPiece(1)
+	if err := resume.Save(resumePath, d.torrentFile, completed); err != nil {
+		t.Fatalf("failed to save resume file: %v", err)
+	}
+
+	if err := d.loadCompletedPieces(); err != nil {
+		t.Fatalf("failed to load completed pieces: %v", err)
+	}
+	// data of the second piece isn't written, so it must be downloaded again
+	if !d.HasPiece(0) || d.HasPiece(1) {
+		t.Errorf("expected only the first piece to be completed got %v", d.Bitfield())
+	}
+}
+
+func TestLoadCompletedPiecesIgnoresCorruptedResumeFile(t *testing.T) {
+	resumePath := filepath.Join(t.TempDir(), "data.resume")
+	d := newTestDownloader(t, resumePath)
+	if err := os.WriteFile(resumePath, []byte("d9:info hash20:"), 0644); err != nil {
+		t.Fatalf("failed to write resume file: %v", err)
+	}
+
+	if err := d.loadCompletedPieces(); err != nil {
+		t.Fatalf("corrupted resume file must not abort download: %v", err)
+	}
+	if d.HasPiece(0) || d.HasPiece(1) {
+		t.Errorf("expected download from scratch got %v", d.Bitfield())
+	}
+}
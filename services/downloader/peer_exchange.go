@@ -0,0 +1,118 @@
+package downloader
+
+import (
+	"fmt"
+	"github.com/hihoak/torrent-cli/client/torrent"
+	"github.com/hihoak/torrent-cli/services/peers"
+	"github.com/hihoak/torrent-cli/services/pex"
+	log "github.com/rs/zerolog/log"
+	"net"
+	"time"
+)
+
+// connection is a connected peer as it is shared with other peers. It is updated by the worker of
+// the peer, because only the worker may read state of the client.
+type connection struct {
+	// addr is an address on which peer accepts connections, it is nil for incoming peer until
+	// its listen port is known from extended handshake
+	addr     *peers.Peer
+	outgoing bool
+	seed     bool
+}
+
+// updateConnection changes shared info of connected peer, its address isn't dialed after that.
+func (d *Downloader) updateConnection(client *torrent.Client, addr *peers.Peer, seed bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if addr != nil {
+		d.knownPeers[addr.String()] = true
+	}
+	if conn, ok := d.clients[client]; ok {
+		conn.addr = addr
+		conn.seed = seed
+	}
+}
+
+// exchangedPeers returns connected peers which can be shared with other peer, the peer itself is excluded.
+func (d *Downloader) exchangedPeers(exclude *torrent.Client) []pex.Peer {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	res := make([]pex.Peer, 0, len(d.clients))
+	for client, conn := range d.clients {
+		if client == exclude || conn.addr == nil {
+			continue
+		}
+		var flags byte
+		if conn.outgoing {
+			flags |= pex.FlagReachable
+		}
+		if conn.seed {
+			flags |= pex.FlagSeed
+		}
+		res = append(res, pex.Peer{Addr: conn.addr, Flags: flags})
+	}
+	return res
+}
+
+// updateExchangedInfo updates shared address and seed flag of the peer when they change.
+func (w *peerWorker) updateExchangedInfo() {
+	addr := w.addr
+	if w.incoming {
+		// address of incoming peer is built from its listen port, which may be announced later
+		addr = nil
+		if remote, ok := w.client.RemoteAddr().(*net.TCPAddr); ok && w.client.ListenPort != 0 {
+			addr = &peers.Peer{IP: remote.IP, Port: w.client.ListenPort}
+		}
+	}
+	seed := w.countOfPeerPieces == len(w.d.torrentFile.PieceHashes)
+	if sameAddr(addr, w.addr) && seed == w.seed {
+		return
+	}
+	w.addr = addr
+	w.seed = seed
+	w.d.updateConnection(w.client, addr, seed)
+}
+
+// sameAddr reports whether both addresses are nil or point to the same ip and port.
+func sameAddr(a, b *peers.Peer) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.String() == b.String()
+}
+
+// sendPeers sends changes of connected peers to peer if it supports peer exchange.
+func (w *peerWorker) sendPeers(now time.Time) {
+	if w.d.torrentFile.Private || !w.client.SupportsExtension(torrent.ExtensionPEX) || !w.pex.Due(now) {
+		return
+	}
+	msg, changed := w.pex.Update(w.d.exchangedPeers(w.client), now)
+	if !changed {
+		return
+	}
+	payload, err := pex.Marshall(msg)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to prepare PEX message")
+		return
+	}
+	if err = w.client.SendExtended(torrent.ExtensionPEX, payload); err != nil {
+		log.Debug().Err(err).Msgf("failed to send PEX message to peer %s", w.client.RemoteAddr())
+	}
+}
+
+// receivePeers adds peers which peer shared with us to the download.
+func (w *peerWorker) receivePeers(payload []byte) error {
+	msg, err := pex.Unmarshall(payload)
+	if err != nil {
+		return fmt.Errorf("failed to parse PEX message: %w", err)
+	}
+	added := make([]*peers.Peer, 0, len(msg.Added))
+	for _, peer := range msg.Added {
+		added = append(added, peer.Addr)
+	}
+	if len(added) > 0 {
+		log.Debug().Msgf("peer %s shared %d peers", w.client.RemoteAddr(), len(added))
+		w.d.AddPeers(added)
+	}
+	return nil
+}
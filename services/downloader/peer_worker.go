@@ -0,0 +1,369 @@
+package downloader
+
+import (
+	"fmt"
+	"github.com/hihoak/torrent-cli/client/torrent"
+	"github.com/hihoak/torrent-cli/services/peers"
+	"github.com/hihoak/torrent-cli/services/pex"
+	"github.com/hihoak/torrent-cli/services/uploader"
+	log "github.com/rs/zerolog/log"
+	"sync"
+	"time"
+)
+
+const (
+	// requestTimeout is how long a block may be awaited after the blocks requested before it,
+	// then block is given to other peers
+	requestTimeout = 20 * time.Second
+	// snubTimeout is how long peer which unchoked us may send no blocks before it is considered snubbing,
+	// snubbing peer gets only one request at a time
+	snubTimeout = 60 * time.Second
+	// housekeepingInterval is how often timeouts are checked
+	housekeepingInterval = time.Second
+)
+
+// request is a block requested from peer.
+type request struct {
+	sentAt time.Time
+	// deadline is a time after which request is timed out, it includes time of receiving blocks
+	// which were requested before
+	deadline time.Time
+}
+
+// readResult is a message read from peer by reading goroutine.
+type readResult struct {
+	msg *torrent.Message
+	err error
+}
+
+// peerWorker downloads blocks from one peer and serves its requests. Blocks are taken from
+// the shared scheduler, so several peers can work on one piece.
+type peerWorker struct {
+	d      *Downloader
+	client *torrent.Client
+	upload *uploader.Peer
+
+	// requests are blocks which are requested from peer and not received yet, they are
+	// cancelled by workers of other peers in endgame
+	mu       sync.Mutex
+	requests map[block]request
+
+	pipeline *pipeline
+	// lastBlockAt is a time of the last received block or when waiting for blocks was started
+	lastBlockAt time.Time
+	// idle is set while there is nothing to request from peer, it isn't snubbing then
+	idle    bool
+	snubbed bool
+	// allowedFast are pieces which may be requested while peer chokes us (BEP 6)
+	allowedFast map[int]bool
+
+	// addr, seed and countOfPeerPieces describe peer for peer exchange, pex keeps peers which were sent to it
+	addr              *peers.Peer
+	incoming          bool
+	seed              bool
+	countOfPeerPieces int
+	pex               *pex.Session
+}
+
+// newPeerWorker creates worker of the client, addr is nil for incoming peers.
+func newPeerWorker(d *Downloader, client *torrent.Client, addr *peers.Peer, upload *uploader.Peer) *peerWorker {
+	w := &peerWorker{
+		d:           d,
+		client:      client,
+		upload:      upload,
+		requests:    make(map[block]request),
+		pipeline:    newPipeline(time.Now()),
+		idle:        true,
+		allowedFast: make(map[int]bool),
+		addr:        addr,
+		incoming:    addr == nil,
+		pex:         pex.NewSession(),
+	}
+	for idx := range d.torrentFile.PieceHashes {
+		if client.HasPieceToDownload(idx) {
+			w.countOfPeerPieces++
+		}
+	}
+	return w
+}
+
+// run downloads from peer until download is finished or connection fails. Messages are read by
+// a separate goroutine, so timeouts are checked even when peer is silent.
+func (w *peerWorker) run() error {
+	defer w.returnRequests()
+
+	done := make(chan struct{})
+	defer close(done)
+	messages := make(chan readResult)
+	w.client.SetIdleTimeout(torrent.IdleTimeout)
+	go w.readMessages(messages, done)
+	go w.client.KeepAlive(done)
+	w.updateExchangedInfo()
+
+	ticker := time.NewTicker(housekeepingInterval)
+	defer ticker.Stop()
+	for {
+		if err := w.fillRequests(); err != nil {
+			return err
+		}
+
+		select {
+		case res := <-messages:
+			if res.err != nil {
+				return fmt.Errorf("failed to read message from peer %s: %w", w.client.PeerID, res.err)
+			}
+			if err := w.handleMessage(res.msg); err != nil {
+				return err
+			}
+		case now := <-ticker.C:
+			w.checkTimeouts(now)
+			w.sendPeers(now)
+		case <-w.d.stopChan:
+			return nil
+		}
+	}
+}
+
+func (w *peerWorker) readMessages(messages chan<- readResult, done <-chan struct{}) {
+	for {
+		msg, err := w.client.ReadMessage()
+		select {
+		case messages <- readResult{msg: msg, err: err}:
+		case <-done:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// fillRequests requests blocks from peer until depth of the pipeline is reached. While peer chokes us
+// only allowed fast pieces are requested.
+func (w *peerWorker) fillRequests() error {
+	has := w.client.HasPieceToDownload
+	if w.client.Chocked {
+		if len(w.allowedFast) == 0 {
+			return nil
+		}
+		has = func(id int) bool {
+			return w.allowedFast[id] && w.client.HasPieceToDownload(id)
+		}
+	}
+	w.pipeline.setMaxDepth(w.client.RequestQueueSize)
+	depth := w.pipeline.depth
+	if w.snubbed {
+		depth = 1
+	}
+	for queued := w.countOfRequests(); queued < depth; queued++ {
+		b, ok := w.d.scheduler.nextBlock(w, has)
+		if !ok {
+			if queued == 0 {
+				w.idle = true
+			}
+			return nil
+		}
+		now := time.Now()
+		if w.idle {
+			w.lastBlockAt = now
+			w.idle = false
+		}
+		w.mu.Lock()
+		w.requests[b] = request{
+			sentAt:   now,
+			deadline: now.Add(requestTimeout + time.Duration(queued)*w.pipeline.blockTime()),
+		}
+		w.mu.Unlock()
+		if err := w.client.SendRequest(b.piece, b.begin, b.length); err != nil {
+			return fmt.Errorf("failed to send request for a block of a piece to peer %s: %w", w.client.PeerID, err)
+		}
+	}
+	return nil
+}
+
+func (w *peerWorker) countOfRequests() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.requests)
+}
+
+// removeRequest returns request of the block, false is returned if block wasn't requested
+// or is already received or cancelled.
+func (w *peerWorker) removeRequest(b block) (request, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	req, ok := w.requests[b]
+	if !ok {
+		return request{}, false
+	}
+	delete(w.requests, b)
+	return req, true
+}
+
+func (w *peerWorker) cancelRequest(b block) {
+	if _, ok := w.removeRequest(b); !ok {
+		return
+	}
+	if err := w.client.SendCancel(b.piece, b.begin, b.length); err != nil {
+		log.Debug().Err(err).Msgf("failed to cancel request of peer %s", w.client.PeerID)
+	}
+}
+
+// returnRequests gives blocks which peer won't send back to scheduler.
+func (w *peerWorker) returnRequests() {
+	w.mu.Lock()
+	requests := w.requests
+	w.requests = make(map[block]request)
+	w.mu.Unlock()
+	for b := range requests {
+		w.d.scheduler.returnBlock(w, b)
+	}
+}
+
+// checkTimeouts gives timed out requests to other peers and detects snubbing.
+func (w *peerWorker) checkTimeouts(now time.Time) {
+	w.mu.Lock()
+	var expired []block
+	for b, req := range w.requests {
+		if now.After(req.deadline) {
+			expired = append(expired, b)
+		}
+	}
+	countOfRequests := len(w.requests)
+	w.mu.Unlock()
+
+	if !w.client.Chocked && countOfRequests > 0 && !w.snubbed && now.Sub(w.lastBlockAt) >= snubTimeout {
+		log.Warn().Msgf("peer %s is snubbing: no blocks for %s", w.client.RemoteAddr(), snubTimeout)
+		w.snubbed = true
+		w.cancelRequests(now)
+		return
+	}
+	if len(expired) > 0 {
+		log.Debug().Msgf("%d requests to peer %s are timed out", len(expired), w.client.RemoteAddr())
+	}
+	for _, b := range expired {
+		w.cancelRequest(b)
+		w.d.scheduler.excludeBlock(w, b, now)
+	}
+}
+
+// cancelRequests cancels all requests to peer and gives their blocks to other peers.
+func (w *peerWorker) cancelRequests(now time.Time) {
+	w.mu.Lock()
+	requests := w.requests
+	w.requests = make(map[block]request)
+	w.mu.Unlock()
+	for b := range requests {
+		if err := w.client.SendCancel(b.piece, b.begin, b.length); err != nil {
+			log.Debug().Err(err).Msgf("failed to cancel request of peer %s", w.client.PeerID)
+		}
+		w.d.scheduler.excludeBlock(w, b, now)
+	}
+}
+
+func (w *peerWorker) handleMessage(msg *torrent.Message) error {
+	if msg == nil {
+		return nil
+	}
+
+	switch msg.ID {
+	case torrent.MsgChoke:
+		w.client.Chocked = true
+		// peer discards our requests when it chokes us, with fast extension it rejects them explicitly
+		if !w.client.SupportsFastExtension() {
+			w.returnRequests()
+		}
+	case torrent.MsgUnchoke:
+		w.client.Chocked = false
+		w.lastBlockAt = time.Now()
+	case torrent.MsgHave:
+		index, parseErr := msg.ParseHave()
+		if parseErr != nil {
+			return fmt.Errorf("failed to parse %d message received from peer %s: %w", torrent.MsgHave, w.client.PeerID, parseErr)
+		}
+		if index < len(w.d.torrentFile.PieceHashes) && !w.client.HasPieceToDownload(index) {
+			w.client.SetPieceToDownload(index)
+			w.d.picker.addHave(index)
+			w.countOfPeerPieces++
+			w.updateExchangedInfo()
+		}
+	case torrent.MsgPiece:
+		return w.handleBlock(msg)
+	case torrent.MsgReject:
+		index, begin, length, parseErr := msg.ParseRequest()
+		if parseErr != nil {
+			return fmt.Errorf("failed to parse %d message received from peer %s: %w", torrent.MsgReject, w.client.PeerID, parseErr)
+		}
+		b := block{piece: index, begin: begin, length: length}
+		if _, ok := w.removeRequest(b); !ok {
+			break
+		}
+		if w.client.Chocked {
+			// peer doesn't serve the piece as allowed fast anymore, so it isn't requested until unchoke
+			delete(w.allowedFast, index)
+			w.d.scheduler.returnBlock(w, b)
+		} else {
+			// unchoking peer which rejected the block would reject it again, so it's given to other peers
+			w.d.scheduler.excludeBlock(w, b, time.Now())
+		}
+	case torrent.MsgAllowedFast:
+		index, parseErr := msg.ParsePieceIndex()
+		if parseErr != nil {
+			return fmt.Errorf("failed to parse %d message received from peer %s: %w", torrent.MsgAllowedFast, w.client.PeerID, parseErr)
+		}
+		if index < len(w.d.torrentFile.PieceHashes) {
+			w.allowedFast[index] = true
+		}
+	case torrent.MsgSuggest:
+		// suggestions are only advice, pieces are still picked rarest first
+	case torrent.MsgExtended:
+		name, payload, extendedErr := w.client.HandleExtended(msg)
+		if extendedErr != nil {
+			return fmt.Errorf("failed to handle extended message received from peer %s: %w", w.client.PeerID, extendedErr)
+		}
+		switch name {
+		case "":
+			w.updateExchangedInfo()
+		case torrent.ExtensionPEX:
+			return w.receivePeers(payload)
+		}
+	default:
+		handled, uploadErr := w.upload.HandleMessage(msg)
+		if uploadErr != nil {
+			return fmt.Errorf("failed to handle message %d received from peer %s: %w", msg.ID, w.client.PeerID, uploadErr)
+		}
+		if !handled {
+			log.Debug().Msgf("ignore message %d received from peer %s", msg.ID, w.client.PeerID)
+		}
+	}
+	return nil
+}
+
+func (w *peerWorker) handleBlock(msg *torrent.Message) error {
+	index, begin, data, err := msg.ParseBlock()
+	if err != nil {
+		return fmt.Errorf("failed to parse %d message received from peer %s: %w", torrent.MsgPiece, w.client.PeerID, err)
+	}
+	b := block{piece: index, begin: begin, length: len(data)}
+	req, ok := w.removeRequest(b)
+	if !ok {
+		// block which we don't wait anymore, for example it was requested before choke or cancelled
+		return nil
+	}
+	now := time.Now()
+	w.pipeline.blockReceived(b.length, now.Sub(req.sentAt), now)
+	w.lastBlockAt = now
+	if w.snubbed {
+		log.Info().Msgf("peer %s is not snubbing anymore", w.client.RemoteAddr())
+		w.snubbed = false
+	}
+
+	pending, completed, others := w.d.scheduler.blockReceived(w, b, data)
+	for _, other := range others {
+		other.cancelRequest(b)
+	}
+	if !completed {
+		return nil
+	}
+	return w.d.completePiece(pending)
+}
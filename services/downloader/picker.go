@@ -0,0 +1,140 @@
+package downloader
+
+import (
+	"math/rand"
+	"sync"
+)
+
+// Priority of a piece, pieces with higher priority are downloaded first regardless of their rarity.
+type Priority int
+
+const (
+	PriorityNormal Priority = 0
+	PriorityHigh   Priority = 1
+)
+
+type pieceState int
+
+const (
+	pieceMissing pieceState = iota
+	pieceInProgress
+	pieceDone
+)
+
+// piecePicker chooses which piece to download next. It tracks how many connected peers have
+// every piece and hands out the rarest missing piece among pieces with the highest priority.
+type piecePicker struct {
+	mu           sync.Mutex
+	availability []int
+	priorities   []Priority
+	states       []pieceState
+}
+
+func newPiecePicker(piecesCount int) *piecePicker {
+	return &piecePicker{
+		availability: make([]int, piecesCount),
+		priorities:   make([]Priority, piecesCount),
+		states:       make([]pieceState, piecesCount),
+	}
+}
+
+// addPeer counts pieces of a new peer, has reports whether peer has a piece.
+func (p *piecePicker) addPeer(has func(id int) bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for id := range p.availability {
+		if has(id) {
+			p.availability[id]++
+		}
+	}
+}
+
+// removePeer uncounts pieces of disconnected peer.
+func (p *piecePicker) removePeer(has func(id int) bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for id := range p.availability {
+		if has(id) && p.availability[id] > 0 {
+			p.availability[id]--
+		}
+	}
+}
+
+// addHave counts a piece which peer announced by HAVE message.
+func (p *piecePicker) addHave(id int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if id >= 0 && id < len(p.availability) {
+		p.availability[id]++
+	}
+}
+
+func (p *piecePicker) setPriority(id int, priority Priority) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if id >= 0 && id < len(p.priorities) {
+		p.priorities[id] = priority
+	}
+}
+
+// pick returns the rarest missing piece which peer has and marks it as in progress. Among pieces
+// with the same priority and availability the piece is chosen randomly, so peers don't compete for one piece.
+func (p *piecePicker) pick(has func(id int) bool) (int, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	count := len(p.states)
+	if count == 0 {
+		return 0, false
+	}
+	best := -1
+	start := rand.Intn(count)
+	for offset := 0; offset < count; offset++ {
+		id := (start + offset) % count
+		if p.states[id] != pieceMissing || !has(id) {
+			continue
+		}
+		if best == -1 || p.isBetter(id, best) {
+			best = id
+		}
+	}
+	if best == -1 {
+		return 0, false
+	}
+	p.states[best] = pieceInProgress
+	return best, true
+}
+
+func (p *piecePicker) isBetter(id, than int) bool {
+	if p.priorities[id] != p.priorities[than] {
+		return p.priorities[id] > p.priorities[than]
+	}
+	return p.availability[id] < p.availability[than]
+}
+
+// hasMissing reports that some pieces are neither downloaded nor in progress.
+func (p *piecePicker) hasMissing() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, state := range p.states {
+		if state == pieceMissing {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *piecePicker) done(id int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.states[id] = pieceDone
+}
+
+// abort returns piece which failed to download back to missing pieces.
+func (p *piecePicker) abort(id int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.states[id] == pieceInProgress {
+		p.states[id] = pieceMissing
+	}
+}
@@ -0,0 +1,149 @@
+package downloader
+
+import (
+	"reflect"
+	"testing"
+)
+
+func hasPieces(ids ...int) func(id int) bool {
+	return func(id int) bool {
+		for _, has := range ids {
+			if has == id {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func TestPiecePickerAvailability(t *testing.T) {
+	picker := newPiecePicker(4)
+	picker.addPeer(hasPieces(0, 1, 2))
+	picker.addPeer(hasPieces(1, 2))
+	picker.addHave(2)
+	picker.addHave(3)
+	// HAVE of unknown piece is ignored
+	picker.addHave(4)
+	if expected := []int{1, 2, 3, 1}; !reflect.DeepEqual(picker.availability, expected) {
+		t.Fatalf("expected availability %v got %v", expected, picker.availability)
+	}
+
+	picker.removePeer(hasPieces(1, 2))
+	picker.removePeer(hasPieces(3))
+	// availability never goes below zero even if peer is removed twice
+	picker.removePeer(hasPieces(3))
+	if expected := []int{1, 1, 2, 0}; !reflect.DeepEqual(picker.availability, expected) {
+		t.Fatalf("expected availability %v got %v", expected, picker.availability)
+	}
+}
+
+func TestPiecePickerPick(t *testing.T) {
+	tests := []struct {
+		name       string
+		peers      [][]int
+		priorities map[int]Priority
+		done       []int
+		has        []int
+		expected   int
+		ok         bool
+	}{
+		{
+			name:     "rarest piece",
+			peers:    [][]int{{0, 1, 2, 3}, {0, 1, 3}, {0, 3}},
+			has:      []int{0, 1, 2, 3},
+			expected: 2,
+			ok:       true,
+		},
+		{
+			name:     "rarest piece which peer has",
+			peers:    [][]int{{0, 1, 2, 3}, {0, 1, 3}, {0, 3}},
+			has:      []int{0, 1, 3},
+			expected: 1,
+			ok:       true,
+		},
+		{
+			name:     "completed piece is skipped",
+			peers:    [][]int{{0, 1, 2, 3}, {0, 1, 3}, {0, 3}},
+			done:     []int{2},
+			has:      []int{0, 1, 2, 3},
+			expected: 1,
+			ok:       true,
+		},
+		{
+			name:       "priority beats rarity",
+			peers:      [][]int{{0, 1, 2, 3}, {0, 1, 3}, {0, 3}},
+			priorities: map[int]Priority{0: PriorityHigh},
+			has:        []int{0, 1, 2, 3},
+			expected:   0,
+			ok:         true,
+		},
+		{
+			name:       "priority of piece which peer lacks is ignored",
+			peers:      [][]int{{0, 1, 2, 3}, {1, 3}, {3}},
+			priorities: map[int]Priority{2: PriorityHigh},
+			has:        []int{0, 3},
+			expected:   0,
+			ok:         true,
+		},
+		{
+			name:  "peer has nothing",
+			peers: [][]int{{0, 1, 2, 3}},
+			has:   nil,
+			ok:    false,
+		},
+		{
+			name:  "peer has only completed pieces",
+			peers: [][]int{{0, 1, 2, 3}},
+			done:  []int{0, 1},
+			has:   []int{0, 1},
+			ok:    false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			picker := newPiecePicker(4)
+			for _, peer := range tt.peers {
+				picker.addPeer(hasPieces(peer...))
+			}
+			for id, priority := range tt.priorities {
+				picker.setPriority(id, priority)
+			}
+			for _, id := range tt.done {
+				picker.done(id)
+			}
+			id, ok := picker.pick(hasPieces(tt.has...))
+			if ok != tt.ok || (ok && id != tt.expected) {
+				t.Errorf("expected piece %d, %t got %d, %t", tt.expected, tt.ok, id, ok)
+			}
+		})
+	}
+}
+
+func TestPiecePickerNeverHandsMissedPiece(t *testing.T) {
+	picker := newPiecePicker(16)
+	picker.addPeer(hasPieces(0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15))
+	has := hasPieces(1, 5, 9, 13)
+	picked := make(map[int]bool)
+	for {
+		id, ok := picker.pick(has)
+		if !ok {
+			break
+		}
+		if !has(id) {
+			t.Fatalf("peer got piece %d which it doesn't have", id)
+		}
+		if picked[id] {
+			t.Fatalf("piece %d is picked twice", id)
+		}
+		picked[id] = true
+	}
+	if len(picked) != 4 {
+		t.Errorf("expected all 4 pieces of peer to be picked got %v", picked)
+	}
+
+	// aborted piece is picked again
+	picker.abort(5)
+	if id, ok := picker.pick(has); !ok || id != 5 {
+		t.Errorf("expected aborted piece 5 got %d, %t", id, ok)
+	}
+}
@@ -0,0 +1,111 @@
+package downloader
+
+import (
+	"time"
+)
+
+const (
+	minPipelineDepth = 4
+	// defaultMaxPipelineDepth limits requests to peer which didn't announce reqq in extended handshake
+	defaultMaxPipelineDepth = 250
+	// pipelineUpdateInterval is how often throughput is measured and depth is recalculated
+	pipelineUpdateInterval = time.Second
+	// rttWindow is a period of the minimum latency which is used as round trip time, latency grows
+	// with queue on peer's side so only the minimum reflects the network
+	rttWindow = 10 * time.Second
+	// pipelineBDPFactor is how many bandwidth-delay products are kept in flight, more than one
+	// lets the depth grow while throughput is limited by the pipeline and not by the link
+	pipelineBDPFactor = 2
+)
+
+// pipeline calculates how many requests are kept in flight to one peer. The depth follows
+// bandwidth-delay product of measured throughput and round trip time.
+type pipeline struct {
+	depth    int
+	maxDepth int
+
+	// received is a count of bytes since the last update
+	received   int64
+	lastUpdate time.Time
+	// rate is a smoothed throughput in bytes per second
+	rate float64
+
+	windowStart      time.Time
+	windowMinRTT     time.Duration
+	prevWindowMinRTT time.Duration
+}
+
+func newPipeline(now time.Time) *pipeline {
+	return &pipeline{
+		depth:       minPipelineDepth,
+		maxDepth:    defaultMaxPipelineDepth,
+		lastUpdate:  now,
+		windowStart: now,
+	}
+}
+
+// setMaxDepth bounds depth by reqq which peer announced.
+func (p *pipeline) setMaxDepth(reqq int) {
+	p.maxDepth = defaultMaxPipelineDepth
+	if reqq > 0 {
+		p.maxDepth = reqq
+	}
+	if p.depth > p.maxDepth {
+		p.depth = p.maxDepth
+	}
+}
+
+// blockReceived records size of the block and time since its request was sent.
+func (p *pipeline) blockReceived(size int, latency time.Duration, now time.Time) {
+	p.received += int64(size)
+	if now.Sub(p.windowStart) >= rttWindow {
+		p.prevWindowMinRTT = p.windowMinRTT
+		p.windowMinRTT = 0
+		p.windowStart = now
+	}
+	if p.windowMinRTT == 0 || latency < p.windowMinRTT {
+		p.windowMinRTT = latency
+	}
+	p.update(now)
+}
+
+func (p *pipeline) rtt() time.Duration {
+	if p.prevWindowMinRTT > 0 && p.prevWindowMinRTT < p.windowMinRTT {
+		return p.prevWindowMinRTT
+	}
+	return p.windowMinRTT
+}
+
+// blockTime returns expected time of receiving one block at measured throughput.
+func (p *pipeline) blockTime() time.Duration {
+	if p.rate <= 0 {
+		return 0
+	}
+	return time.Duration(float64(maxBlockSize) / p.rate * float64(time.Second))
+}
+
+// update recalculates depth once per pipelineUpdateInterval.
+func (p *pipeline) update(now time.Time) {
+	elapsed := now.Sub(p.lastUpdate)
+	if elapsed < pipelineUpdateInterval {
+		return
+	}
+	sample := float64(p.received) / elapsed.Seconds()
+	if p.rate == 0 {
+		p.rate = sample
+	} else {
+		p.rate = (p.rate + sample) / 2
+	}
+	p.received = 0
+	p.lastUpdate = now
+
+	bdp := p.rate * p.rtt().Seconds() * pipelineBDPFactor
+	depth := int(bdp/maxBlockSize) + 1
+	if depth < minPipelineDepth {
+		depth = minPipelineDepth
+	}
+	if depth > p.maxDepth {
+		depth = p.maxDepth
+	}
+	p.depth = depth
+}
@@ -0,0 +1,226 @@
+package downloader
+
+import (
+	log "github.com/rs/zerolog/log"
+	"sync"
+	"time"
+)
+
+// exclusionTimeout is how long peer which failed to send a block doesn't get the block again,
+// unless another peer requests it earlier
+const exclusionTimeout = requestTimeout
+
+// block is a part of a piece which is requested from peer by one message.
+type block struct {
+	piece  int
+	begin  int
+	length int
+}
+
+// requester is a peer which blocks are requested from.
+type requester interface {
+	// cancelRequest cancels request of the block which was received from another peer
+	cancelRequest(b block)
+}
+
+// pendingPiece is a piece which blocks are being downloaded, possibly from different peers.
+type pendingPiece struct {
+	piece workPiece
+	buf   []byte
+	// requesters are peers which every block is requested from, in endgame there may be several of them
+	requesters []map[requester]struct{}
+	// excluded are peers which failed to send every block and deadlines of their exclusion
+	excluded []map[requester]time.Time
+	received []bool
+	// countOfReceived is a count of blocks which are already copied to buf
+	countOfReceived int
+}
+
+func newPendingPiece(piece workPiece) *pendingPiece {
+	countOfBlocks := (piece.SizeOfPiece + maxBlockSize - 1) / maxBlockSize
+	requesters := make([]map[requester]struct{}, countOfBlocks)
+	for idx := range requesters {
+		requesters[idx] = make(map[requester]struct{})
+	}
+	return &pendingPiece{
+		piece:      piece,
+		buf:        make([]byte, piece.SizeOfPiece),
+		requesters: requesters,
+		excluded:   make([]map[requester]time.Time, countOfBlocks),
+		received:   make([]bool, countOfBlocks),
+	}
+}
+
+func (p *pendingPiece) isExcluded(idx int, r requester, now time.Time) bool {
+	until, ok := p.excluded[idx][r]
+	return ok && now.Before(until)
+}
+
+// request marks block as requested by r, exclusions of the block end because another peer got a chance.
+func (p *pendingPiece) request(idx int, r requester) {
+	p.requesters[idx][r] = struct{}{}
+	p.excluded[idx] = nil
+}
+
+func (p *pendingPiece) block(idx int) block {
+	begin := idx * maxBlockSize
+	length := maxBlockSize
+	if begin+length > p.piece.SizeOfPiece {
+		length = p.piece.SizeOfPiece - begin
+	}
+	return block{piece: p.piece.ID, begin: begin, length: length}
+}
+
+// scheduler hands out blocks to peers, so one piece can be downloaded from several peers. Blocks of
+// already started pieces go first to complete them as soon as possible, new pieces are chosen by picker.
+// When every remaining block is already requested scheduler enters endgame: blocks are requested
+// from several peers and requests to others are cancelled when the block arrives.
+type scheduler struct {
+	mu       sync.Mutex
+	picker   *piecePicker
+	newPiece func(id int) workPiece
+	pending  map[int]*pendingPiece
+	endgame  bool
+}
+
+func newScheduler(picker *piecePicker, newPiece func(id int) workPiece) *scheduler {
+	return &scheduler{
+		picker:   picker,
+		newPiece: newPiece,
+		pending:  make(map[int]*pendingPiece),
+	}
+}
+
+// nextBlock returns a block for peer r and marks it as requested by r. has reports whether peer has a piece.
+func (s *scheduler) nextBlock(r requester, has func(id int) bool) (block, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for id, pending := range s.pending {
+		if !has(id) {
+			continue
+		}
+		for idx, requesters := range pending.requesters {
+			if len(requesters) == 0 && !pending.received[idx] && !pending.isExcluded(idx, r, now) {
+				pending.request(idx, r)
+				return pending.block(idx), true
+			}
+		}
+	}
+
+	if id, ok := s.picker.pick(has); ok {
+		pending := newPendingPiece(s.newPiece(id))
+		s.pending[id] = pending
+		pending.request(0, r)
+		return pending.block(0), true
+	}
+
+	if s.picker.hasMissing() {
+		return block{}, false
+	}
+	return s.nextEndgameBlock(r, has, now)
+}
+
+// nextEndgameBlock returns a block which is already requested from other peers, blocks with
+// the fewest requesters go first.
+func (s *scheduler) nextEndgameBlock(r requester, has func(id int) bool, now time.Time) (block, bool) {
+	var best *pendingPiece
+	bestIdx := -1
+	for id, pending := range s.pending {
+		if !has(id) {
+			continue
+		}
+		for idx, requesters := range pending.requesters {
+			if pending.received[idx] {
+				continue
+			}
+			if _, ok := requesters[r]; ok || pending.isExcluded(idx, r, now) {
+				continue
+			}
+			if best == nil || len(requesters) < len(best.requesters[bestIdx]) {
+				best, bestIdx = pending, idx
+			}
+		}
+	}
+	if best == nil {
+		return block{}, false
+	}
+	if !s.endgame {
+		s.endgame = true
+		log.Info().Msgf("enter endgame mode: %d pieces are left", len(s.pending))
+	}
+	best.request(bestIdx, r)
+	return best.block(bestIdx), true
+}
+
+// returnBlock removes request of the block from peer r, so block is available for other peers.
+func (s *scheduler) returnBlock(r requester, b block) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pending, ok := s.pending[b.piece]
+	if !ok {
+		return
+	}
+	delete(pending.requesters[b.begin/maxBlockSize], r)
+}
+
+// excludeBlock is like returnBlock, but the block isn't given to r again until another peer requests it
+// or exclusionTimeout passes. It's used when r failed to send the block, so the block goes to other peers.
+func (s *scheduler) excludeBlock(r requester, b block, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pending, ok := s.pending[b.piece]
+	if !ok {
+		return
+	}
+	idx := b.begin / maxBlockSize
+	delete(pending.requesters[idx], r)
+	if pending.excluded[idx] == nil {
+		pending.excluded[idx] = make(map[requester]time.Time)
+	}
+	pending.excluded[idx][r] = now.Add(exclusionTimeout)
+}
+
+// blockReceived copies data of the block received from peer r into its piece, other peers which block
+// was requested from are returned to cancel their requests. When the last block of the piece is received
+// the piece is returned, it isn't handed out anymore and must be finished by pieceDone or pieceFailed.
+func (s *scheduler) blockReceived(r requester, b block, data []byte) (*pendingPiece, bool, []requester) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pending, ok := s.pending[b.piece]
+	if !ok || b.begin%maxBlockSize != 0 {
+		return nil, false, nil
+	}
+	idx := b.begin / maxBlockSize
+	if idx >= len(pending.received) || pending.received[idx] || pending.block(idx) != b || len(data) != b.length {
+		return nil, false, nil
+	}
+	copy(pending.buf[b.begin:], data)
+	pending.received[idx] = true
+	pending.countOfReceived++
+
+	others := make([]requester, 0, len(pending.requesters[idx]))
+	for other := range pending.requesters[idx] {
+		if other != r {
+			others = append(others, other)
+		}
+	}
+	pending.requesters[idx] = make(map[requester]struct{})
+
+	if pending.countOfReceived < len(pending.received) {
+		return nil, false, others
+	}
+	delete(s.pending, b.piece)
+	return pending, true, others
+}
+
+// pieceDone marks verified and saved piece as downloaded.
+func (s *scheduler) pieceDone(id int) {
+	s.picker.done(id)
+}
+
+// pieceFailed returns piece which hash doesn't match back to picker, it is downloaded from scratch.
+func (s *scheduler) pieceFailed(id int) {
+	s.picker.abort(id)
+}
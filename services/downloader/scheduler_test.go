@@ -0,0 +1,64 @@
+package downloader
+
+import (
+	"testing"
+	"time"
+)
+
+type testRequester struct {
+	name string
+}
+
+func (r *testRequester) String() string {
+	return r.name
+}
+
+func (r *testRequester) cancelRequest(block) {}
+
+func newTestScheduler() *scheduler {
+	picker := newPiecePicker(1)
+	picker.addPeer(hasAll)
+	return newScheduler(picker, func(id int) workPiece {
+		return workPiece{ID: id, SizeOfPiece: 2 * maxBlockSize}
+	})
+}
+
+func hasAll(int) bool { return true }
+
+func TestSchedulerDoesNotReturnExcludedBlockToSamePeer(t *testing.T) {
+	s := newTestScheduler()
+	slow, fast := &testRequester{name: "slow"}, &testRequester{name: "fast"}
+
+	first, ok := s.nextBlock(slow, hasAll)
+	if !ok || first.begin != 0 {
+		t.Fatalf("expected the first block got %+v, %t", first, ok)
+	}
+	s.excludeBlock(slow, first, time.Now())
+
+	if b, ok := s.nextBlock(slow, hasAll); !ok || b.begin != maxBlockSize {
+		t.Fatalf("expected slow peer to get the second block got %+v, %t", b, ok)
+	}
+	if b, ok := s.nextBlock(slow, hasAll); ok {
+		t.Fatalf("expected no block for slow peer got %+v", b)
+	}
+	if b, ok := s.nextBlock(fast, hasAll); !ok || b != first {
+		t.Fatalf("expected fast peer to get timed out block got %+v, %t", b, ok)
+	}
+
+	// another peer had its chance, so the block may go back to slow peer
+	s.returnBlock(fast, first)
+	if b, ok := s.nextBlock(slow, hasAll); !ok || b != first {
+		t.Fatalf("expected slow peer to get block after another peer got %+v, %t", b, ok)
+	}
+}
+
+func TestSchedulerExclusionExpires(t *testing.T) {
+	s := newTestScheduler()
+	peer := &testRequester{name: "only"}
+
+	first, _ := s.nextBlock(peer, hasAll)
+	s.excludeBlock(peer, first, time.Now().Add(-exclusionTimeout))
+	if b, ok := s.nextBlock(peer, hasAll); !ok || b != first {
+		t.Fatalf("expected expired exclusion to be ignored got %+v, %t", b, ok)
+	}
+}
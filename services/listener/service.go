@@ -0,0 +1,134 @@
+package listener
+
+import (
+	"errors"
+	"fmt"
+	"github.com/hihoak/torrent-cli/client/torrent"
+	log "github.com/rs/zerolog/log"
+	"net"
+	"sync"
+)
+
+// DefaultMaxHandshakes limits count of incoming connections which are handshaking at the same time
+// if limit isn't given.
+const DefaultMaxHandshakes = 50
+
+// Handler receives peers which connected to us for a specific torrent.
+type Handler interface {
+	// Bitfield returns pieces of the torrent which we have, they are sent to the peer after handshake
+	Bitfield() torrent.Bitfield
+	AddPeer(client *torrent.Client)
+}
+
+// Listener accepts incoming peer connections and routes them by info hash from the handshake.
+type Listener struct {
+	ln net.Listener
+	// handshakes are slots of incoming connections which are handshaking, connection over the limit is closed
+	handshakes chan struct{}
+
+	mu       sync.RWMutex
+	handlers map[[20]byte]Handler
+}
+
+// Listen starts accepting connections on port, the port is announced to peers in extended handshake.
+// At most maxHandshakes connections are handshaking at the same time, DefaultMaxHandshakes is used
+// if it isn't positive.
+func Listen(port uint16, maxHandshakes int) (*Listener, error) {
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on port %d: %w", port, err)
+	}
+	if maxHandshakes <= 0 {
+		maxHandshakes = DefaultMaxHandshakes
+	}
+	res := &Listener{
+		ln:         ln,
+		handshakes: make(chan struct{}, maxHandshakes),
+		handlers:   make(map[[20]byte]Handler),
+	}
+	torrent.DefaultExtensions.SetListenPort(res.Port())
+	return res, nil
+}
+
+// Port returns the port which listener is bound to.
+func (l *Listener) Port() uint16 {
+	return uint16(l.ln.Addr().(*net.TCPAddr).Port)
+}
+
+func (l *Listener) Register(infoHash [20]byte, handler Handler) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.handlers[infoHash] = handler
+}
+
+func (l *Listener) Unregister(infoHash [20]byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.handlers, infoHash)
+}
+
+func (l *Listener) handler(infoHash [20]byte) (Handler, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	handler, ok := l.handlers[infoHash]
+	return handler, ok
+}
+
+func (l *Listener) lookup(infoHash [20]byte) (torrent.Bitfield, bool) {
+	handler, ok := l.handler(infoHash)
+	if !ok {
+		return nil, false
+	}
+	return handler.Bitfield(), true
+}
+
+// Serve accepts connections until listener is closed.
+func (l *Listener) Serve() error {
+	for {
+		conn, err := l.ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to accept connection: %w", err)
+		}
+		select {
+		case l.handshakes <- struct{}{}:
+		default:
+			log.Debug().Msgf("reject incoming connection from %s: too many handshakes", conn.RemoteAddr())
+			if closeErr := conn.Close(); closeErr != nil {
+				log.Error().Err(closeErr).Msg("failed to close incoming connection")
+			}
+			continue
+		}
+		go func() {
+			defer func() { <-l.handshakes }()
+			l.handle(conn)
+		}()
+	}
+}
+
+func (l *Listener) handle(conn net.Conn) {
+	client, infoHash, err := torrent.Accept(conn, l.lookup)
+	if err != nil {
+		log.Debug().Err(err).Msgf("reject incoming connection from %s", conn.RemoteAddr())
+		if closeErr := conn.Close(); closeErr != nil {
+			log.Error().Err(closeErr).Msg("failed to close incoming connection")
+		}
+		return
+	}
+
+	handler, ok := l.handler(infoHash)
+	if !ok {
+		if closeErr := client.Close(); closeErr != nil {
+			log.Error().Err(closeErr).Msg("failed to close incoming connection")
+		}
+		return
+	}
+	log.Debug().Msgf("accepted incoming connection from %s", conn.RemoteAddr())
+	handler.AddPeer(client)
+}
+
+func (l *Listener) Close() error {
+	return l.ln.Close()
+}
@@ -0,0 +1,52 @@
+package listener
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestListenerClosesConnectionsOverHandshakeLimit(t *testing.T) {
+	l, err := Listen(0, 1)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		if serveErr := l.Serve(); serveErr != nil {
+			t.Errorf("failed to serve: %v", serveErr)
+		}
+	}()
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(l.Port())}
+
+	// the first peer sends nothing, so its handshake takes the only slot
+	silent, err := net.DialTCP("tcp", nil, addr)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer silent.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	extra, err := net.DialTCP("tcp", nil, addr)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer extra.Close()
+	if err = extra.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+		t.Fatalf("failed to set deadline: %v", err)
+	}
+	if _, err = extra.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Fatalf("expected connection over the limit to be closed got %v", err)
+	}
+
+	// the silent peer keeps its slot until its handshake times out
+	if err = silent.SetReadDeadline(time.Now().Add(100 * time.Millisecond)); err != nil {
+		t.Fatalf("failed to set deadline: %v", err)
+	}
+	var netErr net.Error
+	if _, err = silent.Read(make([]byte, 1)); !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("expected silent connection to stay open got %v", err)
+	}
+}
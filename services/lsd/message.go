@@ -0,0 +1,89 @@
+package lsd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	requestLine     = "BT-SEARCH * HTTP/1.1"
+	headerPort      = "port"
+	headerInfoHash  = "infohash"
+	headerCookie    = "cookie"
+	maxMessageSize  = 1400
+	infoHashHexSize = 40
+)
+
+// Announce is BT-SEARCH message which tells peers in local network that we accept connections for torrents.
+type Announce struct {
+	Port       uint16
+	InfoHashes [][20]byte
+	// Cookie identifies sender, so own announces which are looped back are ignored
+	Cookie string
+}
+
+// Marshall encodes announce which is sent to multicast group host.
+func (a Announce) Marshall(host string) []byte {
+	var res bytes.Buffer
+	res.WriteString(requestLine + "\r\n")
+	fmt.Fprintf(&res, "Host: %s\r\n", host)
+	fmt.Fprintf(&res, "Port: %d\r\n", a.Port)
+	for _, infoHash := range a.InfoHashes {
+		fmt.Fprintf(&res, "Infohash: %x\r\n", infoHash)
+	}
+	if a.Cookie != "" {
+		fmt.Fprintf(&res, "cookie: %s\r\n", a.Cookie)
+	}
+	res.WriteString("\r\n\r\n")
+	return res.Bytes()
+}
+
+// Unmarshall parses BT-SEARCH message, names of headers are case-insensitive and unknown headers are skipped.
+func Unmarshall(data []byte) (Announce, error) {
+	var res Announce
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	if !scanner.Scan() || strings.TrimSpace(scanner.Text()) != requestLine {
+		return res, fmt.Errorf("not a BT-SEARCH message")
+	}
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			break
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return res, fmt.Errorf("invalid header %q", line)
+		}
+		value = strings.TrimSpace(value)
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case headerPort:
+			port, err := strconv.ParseUint(value, 10, 16)
+			if err != nil || port == 0 {
+				return res, fmt.Errorf("invalid port %q", value)
+			}
+			res.Port = uint16(port)
+		case headerInfoHash:
+			if len(value) != infoHashHexSize {
+				return res, fmt.Errorf("invalid info hash %q", value)
+			}
+			var infoHash [20]byte
+			if _, err := hex.Decode(infoHash[:], []byte(value)); err != nil {
+				return res, fmt.Errorf("failed to decode info hash %q: %w", value, err)
+			}
+			res.InfoHashes = append(res.InfoHashes, infoHash)
+		case headerCookie:
+			res.Cookie = value
+		}
+	}
+	if res.Port == 0 {
+		return res, fmt.Errorf("port is missed")
+	}
+	if len(res.InfoHashes) == 0 {
+		return res, fmt.Errorf("info hash is missed")
+	}
+	return res, nil
+}
@@ -0,0 +1,101 @@
+package lsd
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var (
+	testInfoHash      = [20]byte{0xde, 0xad, 0xbe, 0xef, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	testOtherInfoHash = [20]byte{1, 2, 3}
+)
+
+func TestMarshallUnmarshall(t *testing.T) {
+	announce := Announce{Port: 6881, InfoHashes: [][20]byte{testInfoHash, testOtherInfoHash}, Cookie: "abc"}
+	data := announce.Marshall("239.192.152.143:6771")
+	expected := "BT-SEARCH * HTTP/1.1\r\n" +
+		"Host: 239.192.152.143:6771\r\n" +
+		"Port: 6881\r\n" +
+		"Infohash: deadbeef0102030405060708090a0b0c0d0e0f10\r\n" +
+		"Infohash: 0102030000000000000000000000000000000000\r\n" +
+		"cookie: abc\r\n" +
+		"\r\n\r\n"
+	if string(data) != expected {
+		t.Errorf("expected message %q got %q", expected, data)
+	}
+
+	parsed, err := Unmarshall(data)
+	if err != nil {
+		t.Fatalf("failed to unmarshall: %v", err)
+	}
+	if !reflect.DeepEqual(parsed, announce) {
+		t.Errorf("expected %+v got %+v", announce, parsed)
+	}
+	if data = (Announce{Port: 6881, InfoHashes: [][20]byte{testInfoHash}}).Marshall("host"); strings.Contains(string(data), "cookie") {
+		t.Errorf("empty cookie must not be sent: %q", data)
+	}
+}
+
+func TestUnmarshall(t *testing.T) {
+	tests := []struct {
+		name     string
+		message  string
+		expected Announce
+	}{
+		{
+			name: "headers in any case",
+			message: "BT-SEARCH * HTTP/1.1\r\nHOST: 239.192.152.143:6771\r\nport: 51413\r\n" +
+				"INFOHASH: DEADBEEF0102030405060708090A0B0C0D0E0F10\r\nCookie: other\r\n\r\n\r\n",
+			expected: Announce{Port: 51413, InfoHashes: [][20]byte{testInfoHash}, Cookie: "other"},
+		},
+		{
+			name:     "unix line endings and unknown headers",
+			message:  "BT-SEARCH * HTTP/1.1\nX-Unknown: 1\nPort: 1\nInfohash: deadbeef0102030405060708090a0b0c0d0e0f10\n\n",
+			expected: Announce{Port: 1, InfoHashes: [][20]byte{testInfoHash}},
+		},
+		{
+			name: "headers after empty line are skipped",
+			message: "BT-SEARCH * HTTP/1.1\r\nPort: 1\r\nInfohash: deadbeef0102030405060708090a0b0c0d0e0f10\r\n\r\n" +
+				"Infohash: 0102030000000000000000000000000000000000\r\n",
+			expected: Announce{Port: 1, InfoHashes: [][20]byte{testInfoHash}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parsed, err := Unmarshall([]byte(tt.message))
+			if err != nil {
+				t.Fatalf("failed to unmarshall: %v", err)
+			}
+			if !reflect.DeepEqual(parsed, tt.expected) {
+				t.Errorf("expected %+v got %+v", tt.expected, parsed)
+			}
+		})
+	}
+}
+
+func TestUnmarshallErrors(t *testing.T) {
+	const infoHash = "Infohash: deadbeef0102030405060708090a0b0c0d0e0f10\r\n"
+	tests := []struct {
+		name    string
+		message string
+	}{
+		{name: "empty message", message: ""},
+		{name: "another method", message: "M-SEARCH * HTTP/1.1\r\nPort: 1\r\n" + infoHash + "\r\n\r\n"},
+		{name: "malformed request line", message: "BT-SEARCH *\r\nPort: 1\r\n" + infoHash + "\r\n\r\n"},
+		{name: "missed port", message: "BT-SEARCH * HTTP/1.1\r\n" + infoHash + "\r\n\r\n"},
+		{name: "zero port", message: "BT-SEARCH * HTTP/1.1\r\nPort: 0\r\n" + infoHash + "\r\n\r\n"},
+		{name: "too big port", message: "BT-SEARCH * HTTP/1.1\r\nPort: 65536\r\n" + infoHash + "\r\n\r\n"},
+		{name: "missed info hash", message: "BT-SEARCH * HTTP/1.1\r\nPort: 1\r\n\r\n\r\n"},
+		{name: "short info hash", message: "BT-SEARCH * HTTP/1.1\r\nPort: 1\r\nInfohash: deadbeef\r\n\r\n\r\n"},
+		{name: "invalid info hash", message: "BT-SEARCH * HTTP/1.1\r\nPort: 1\r\nInfohash: " + strings.Repeat("z", 40) + "\r\n\r\n\r\n"},
+		{name: "header without colon", message: "BT-SEARCH * HTTP/1.1\r\nPort 1\r\n" + infoHash + "\r\n\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if parsed, err := Unmarshall([]byte(tt.message)); err == nil {
+				t.Errorf("expected error got %+v", parsed)
+			}
+		})
+	}
+}
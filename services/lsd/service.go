@@ -0,0 +1,306 @@
+package lsd
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/hihoak/torrent-cli/services/peers"
+	log "github.com/rs/zerolog/log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// Port is UDP port of multicast groups of local service discovery (BEP 14)
+	Port = 6771
+	// AnnounceInterval is how often registered torrents are announced to local network
+	AnnounceInterval = 5 * time.Minute
+	// minAnnounceInterval limits announces of one torrent, BEP 14 allows at most one per minute
+	minAnnounceInterval = time.Minute
+	// maxInfoHashesPerMessage keeps announce smaller than maxMessageSize
+	maxInfoHashesPerMessage = 20
+	// replyTimeout is how long GetPeers waits announces which peers send in reply to ours
+	replyTimeout = 2 * time.Second
+)
+
+var (
+	groupIPv4 = &net.UDPAddr{IP: net.IPv4(239, 192, 152, 143), Port: Port}
+	groupIPv6 = &net.UDPAddr{IP: net.ParseIP("ff15::efc0:988f"), Port: Port}
+)
+
+// Handler receives peers which announced a torrent in local network.
+type Handler interface {
+	AddPeers(torrentPeers []*peers.Peer)
+}
+
+type group struct {
+	addr *net.UDPAddr
+	conn *net.UDPConn
+	// sender sends announces, multicast loopback is disabled on conn, so peers on this host wouldn't get them
+	sender *net.UDPConn
+}
+
+type registration struct {
+	// handler is nil if we only announce the torrent
+	handler   Handler
+	announced time.Time
+}
+
+// Service announces torrents to IPv4 and IPv6 multicast groups of local network and listens announces of
+// other peers there. It must not be used for private torrents.
+type Service struct {
+	port   uint16
+	cookie string
+	groups []group
+
+	mu       sync.Mutex
+	torrents map[[20]byte]*registration
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// Listen joins multicast groups, port is a port on which we accept peers. Group which can't be joined
+// is skipped, error is returned only if no group is joined.
+func Listen(port uint16) (*Service, error) {
+	cookie := make([]byte, 8)
+	if _, err := rand.Read(cookie); err != nil {
+		return nil, fmt.Errorf("failed to generate cookie: %w", err)
+	}
+	s := &Service{
+		port:     port,
+		cookie:   hex.EncodeToString(cookie),
+		torrents: make(map[[20]byte]*registration),
+		closed:   make(chan struct{}),
+	}
+
+	var errs []error
+	for _, addr := range []*net.UDPAddr{groupIPv4, groupIPv6} {
+		network := "udp4"
+		if addr.IP.To4() == nil {
+			network = "udp6"
+		}
+		conn, err := net.ListenMulticastUDP(network, nil, addr)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to join multicast group %s: %w", addr, err))
+			continue
+		}
+		sender, err := net.ListenUDP(network, nil)
+		if err != nil {
+			_ = conn.Close()
+			errs = append(errs, fmt.Errorf("failed to open socket for multicast group %s: %w", addr, err))
+			continue
+		}
+		s.groups = append(s.groups, group{addr: addr, conn: conn, sender: sender})
+	}
+	if len(s.groups) == 0 {
+		return nil, errors.Join(errs...)
+	}
+	for _, err := range errs {
+		log.Debug().Err(err).Msg("local service discovery works without multicast group")
+	}
+	return s, nil
+}
+
+// Register announces the torrent to local network and passes peers which announce it to handler until
+// Unregister is called, nil handler only announces.
+func (s *Service) Register(infoHash [20]byte, handler Handler) {
+	s.mu.Lock()
+	reg, ok := s.torrents[infoHash]
+	if !ok {
+		reg = &registration{}
+		s.torrents[infoHash] = reg
+	}
+	// time of the last announce is kept, so registering again doesn't break the limit of announces
+	reg.handler = handler
+	s.mu.Unlock()
+	go s.announce(time.Now())
+}
+
+func (s *Service) Unregister(infoHash [20]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.torrents, infoHash)
+}
+
+// lookup returns handler of the torrent, false is returned if the torrent isn't registered.
+func (s *Service) lookup(infoHash [20]byte) (Handler, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reg, ok := s.torrents[infoHash]
+	if !ok {
+		return nil, false
+	}
+	return reg.handler, true
+}
+
+type collector struct {
+	mu    sync.Mutex
+	peers []*peers.Peer
+}
+
+func (c *collector) AddPeers(torrentPeers []*peers.Peer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.peers = append(c.peers, torrentPeers...)
+}
+
+func (c *collector) found() []*peers.Peer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return peers.MergePeers(c.peers)
+}
+
+// GetPeers announces the torrent and returns peers which announce it in reply during replyTimeout, so
+// download can start in local network without trackers. The torrent stays announced until Unregister,
+// port of the service is announced instead of port.
+func (s *Service) GetPeers(infoHash [20]byte, _ uint16) ([]*peers.Peer, error) {
+	found := &collector{}
+	s.Register(infoHash, found)
+	timer := time.NewTimer(replyTimeout)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-s.closed:
+	}
+
+	s.mu.Lock()
+	if reg, ok := s.torrents[infoHash]; ok && reg.handler == found {
+		reg.handler = nil
+	}
+	s.mu.Unlock()
+	res := found.found()
+	log.Info().Msgf("found %d peers in local network", len(res))
+	return res, nil
+}
+
+// Serve processes announces of other peers and periodically announces registered torrents until service
+// is closed.
+func (s *Service) Serve() error {
+	go s.announceLoop()
+	errs := make(chan error, len(s.groups))
+	for _, g := range s.groups {
+		go func(g group) {
+			errs <- s.receive(g)
+		}(g)
+	}
+	var res error
+	for range s.groups {
+		if err := <-errs; err != nil && res == nil {
+			res = err
+		}
+	}
+	return res
+}
+
+func (s *Service) Close() error {
+	var res error
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		for _, g := range s.groups {
+			if err := g.conn.Close(); err != nil && res == nil {
+				res = fmt.Errorf("failed to leave multicast group %s: %w", g.addr, err)
+			}
+			if err := g.sender.Close(); err != nil && res == nil {
+				res = fmt.Errorf("failed to close socket for multicast group %s: %w", g.addr, err)
+			}
+		}
+	})
+	return res
+}
+
+func (s *Service) isClosed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Service) receive(g group) error {
+	buf := make([]byte, maxMessageSize)
+	for {
+		size, from, err := g.conn.ReadFromUDP(buf)
+		if err != nil {
+			if s.isClosed() {
+				return nil
+			}
+			return fmt.Errorf("failed to read announce from multicast group %s: %w", g.addr, err)
+		}
+		// peer which just joined doesn't know about us until the next periodic announce, so we answer
+		// as soon as minAnnounceInterval allows
+		if s.handle(buf[:size], from) {
+			s.announce(time.Now())
+		}
+	}
+}
+
+// handle passes peer of the announce to handlers of registered torrents, own and malformed announces are
+// ignored. True is returned if the peer shares a registered torrent.
+func (s *Service) handle(data []byte, from *net.UDPAddr) bool {
+	msg, err := Unmarshall(data)
+	if err != nil {
+		log.Debug().Err(err).Msgf("ignore malformed announce from %s", from)
+		return false
+	}
+	if msg.Cookie == s.cookie {
+		return false
+	}
+	peer := &peers.Peer{IP: from.IP, Port: msg.Port}
+	shared := false
+	for _, infoHash := range msg.InfoHashes {
+		handler, ok := s.lookup(infoHash)
+		if !ok {
+			continue
+		}
+		shared = true
+		if handler != nil {
+			log.Debug().Msgf("found peer %s of %x in local network", peer, infoHash)
+			handler.AddPeers([]*peers.Peer{peer})
+		}
+	}
+	return shared
+}
+
+func (s *Service) announceLoop() {
+	ticker := time.NewTicker(AnnounceInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closed:
+			return
+		case now := <-ticker.C:
+			s.announce(now)
+		}
+	}
+}
+
+// announce sends registered torrents which weren't announced for minAnnounceInterval to all joined groups.
+func (s *Service) announce(now time.Time) {
+	msg := Announce{Port: s.port, Cookie: s.cookie}
+	s.mu.Lock()
+	for infoHash, reg := range s.torrents {
+		if !reg.announced.IsZero() && now.Sub(reg.announced) < minAnnounceInterval {
+			continue
+		}
+		reg.announced = now
+		msg.InfoHashes = append(msg.InfoHashes, infoHash)
+	}
+	s.mu.Unlock()
+
+	for len(msg.InfoHashes) > 0 {
+		part := msg
+		if len(part.InfoHashes) > maxInfoHashesPerMessage {
+			part.InfoHashes = part.InfoHashes[:maxInfoHashesPerMessage]
+		}
+		msg.InfoHashes = msg.InfoHashes[len(part.InfoHashes):]
+		for _, g := range s.groups {
+			if _, err := g.sender.WriteToUDP(part.Marshall(g.addr.String()), g.addr); err != nil && !s.isClosed() {
+				log.Debug().Err(err).Msgf("failed to announce to multicast group %s", g.addr)
+			}
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package lsd
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestHandleSkipsOwnAnnounces(t *testing.T) {
+	s := &Service{cookie: "own", torrents: make(map[[20]byte]*registration)}
+	found := &collector{}
+	s.torrents[testInfoHash] = &registration{handler: found}
+	s.torrents[testOtherInfoHash] = &registration{}
+	from := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 2), Port: Port}
+
+	tests := []struct {
+		name     string
+		announce Announce
+		shared   bool
+		found    []string
+	}{
+		{name: "own cookie", announce: Announce{Port: 1, InfoHashes: [][20]byte{testInfoHash}, Cookie: "own"}},
+		{name: "unknown torrent", announce: Announce{Port: 2, InfoHashes: [][20]byte{{9}}, Cookie: "foreign"}},
+		{name: "announced only", announce: Announce{Port: 3, InfoHashes: [][20]byte{testOtherInfoHash}}, shared: true},
+		{
+			name:     "foreign cookie",
+			announce: Announce{Port: 4, InfoHashes: [][20]byte{{9}, testInfoHash}, Cookie: "foreign"},
+			shared:   true,
+			found:    []string{"192.168.1.2:4"},
+		},
+		{
+			name:     "no cookie",
+			announce: Announce{Port: 5, InfoHashes: [][20]byte{testInfoHash}},
+			shared:   true,
+			found:    []string{"192.168.1.2:4", "192.168.1.2:5"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if shared := s.handle(tt.announce.Marshall("host"), from); shared != tt.shared {
+				t.Errorf("expected shared %t got %t", tt.shared, shared)
+			}
+			var addrs []string
+			for _, peer := range found.found() {
+				addrs = append(addrs, peer.String())
+			}
+			if !reflect.DeepEqual(addrs, tt.found) {
+				t.Errorf("expected peers %v got %v", tt.found, addrs)
+			}
+		})
+	}
+	if s.handle([]byte("garbage"), from) {
+		t.Error("malformed announce must be ignored")
+	}
+}
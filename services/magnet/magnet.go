@@ -0,0 +1,189 @@
+package magnet
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"github.com/hihoak/torrent-cli/services/peers"
+	torrent_file_decoder "github.com/hihoak/torrent-cli/services/torrent-file-decoder"
+	log "github.com/rs/zerolog/log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	magnetScheme      = "magnet"
+	infoHashURNPrefix = "urn:btih:"
+	// unknownLeft is announced as left bytes before metadata is fetched
+	unknownLeft = 16 * 1024
+)
+
+// Magnet is a parsed magnet link.
+type Magnet struct {
+	InfoHash [20]byte
+	Name     string
+	Trackers []string
+	Peers    []*peers.Peer
+}
+
+func IsMagnetLink(link string) bool {
+	return strings.HasPrefix(link, magnetScheme+":")
+}
+
+func Parse(link string) (*Magnet, error) {
+	uri, err := url.Parse(link)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse magnet link: %w", err)
+	}
+	if uri.Scheme != magnetScheme {
+		return nil, fmt.Errorf("wrong scheme %q of magnet link", uri.Scheme)
+	}
+
+	params, err := url.ParseQuery(uri.RawQuery)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse parameters of magnet link: %w", err)
+	}
+
+	res := &Magnet{
+		Name: params.Get("dn"),
+	}
+	foundInfoHash := false
+	for _, topic := range params["xt"] {
+		if !strings.HasPrefix(topic, infoHashURNPrefix) {
+			continue
+		}
+		infoHash, decodeErr := decodeInfoHash(strings.TrimPrefix(topic, infoHashURNPrefix))
+		if decodeErr != nil {
+			return nil, decodeErr
+		}
+		res.InfoHash = infoHash
+		foundInfoHash = true
+		break
+	}
+	if !foundInfoHash {
+		return nil, fmt.Errorf("magnet link has no %q exact topic", infoHashURNPrefix)
+	}
+
+	for _, tracker := range params["tr"] {
+		if tracker != "" {
+			res.Trackers = append(res.Trackers, tracker)
+		}
+	}
+
+	for _, address := range params["x.pe"] {
+		peer, parseErr := parsePeerAddress(address)
+		if parseErr != nil {
+			return nil, fmt.Errorf("failed to parse peer address %q: %w", address, parseErr)
+		}
+		res.Peers = append(res.Peers, peer)
+	}
+
+	return res, nil
+}
+
+// decodeInfoHash accepts info hash in hex (40 characters) or base32 (32 characters) encoding.
+func decodeInfoHash(encoded string) ([20]byte, error) {
+	var res [20]byte
+	var decoded []byte
+	var err error
+	switch len(encoded) {
+	case 40:
+		decoded, err = hex.DecodeString(encoded)
+	case 32:
+		decoded, err = base32.StdEncoding.DecodeString(strings.ToUpper(encoded))
+	default:
+		return res, fmt.Errorf("info hash %q has wrong length %d", encoded, len(encoded))
+	}
+	if err != nil {
+		return res, fmt.Errorf("failed to decode info hash %q: %w", encoded, err)
+	}
+	copy(res[:], decoded)
+	return res, nil
+}
+
+func parsePeerAddress(address string) (*peers.Peer, error) {
+	host, portRaw, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portRaw, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q: %w", portRaw, err)
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		ips, lookupErr := net.LookupIP(host)
+		if lookupErr != nil || len(ips) == 0 {
+			return nil, fmt.Errorf("failed to resolve host %q: %w", host, lookupErr)
+		}
+		ip = ips[0]
+	}
+	return &peers.Peer{IP: ip, Port: uint16(port)}, nil
+}
+
+// AnnounceList returns trackers of the magnet link, every tracker is a separate tier.
+func (m *Magnet) AnnounceList() [][]string {
+	res := make([][]string, 0, len(m.Trackers))
+	for _, tracker := range m.Trackers {
+		res = append(res, []string{tracker})
+	}
+	return res
+}
+
+// GetPeers returns peers from the magnet link together with peers from sources and trackers, which must
+// be built from AnnounceList.
+func (m *Magnet) GetPeers(trackers *peers.TrackerList, port uint16, sources ...peers.PeerSource) ([]*peers.Peer, error) {
+	res := peers.MergePeers(m.Peers, peers.FromSources(m.InfoHash, port, sources))
+	if len(m.Trackers) == 0 {
+		if len(res) == 0 {
+			return nil, fmt.Errorf("magnet link has no trackers and no peers are found")
+		}
+		return res, nil
+	}
+
+	resp, err := trackers.Announce(peers.AnnounceRequest{
+		InfoHash: m.InfoHash,
+		PeerID:   peers.MyPeerID,
+		Port:     port,
+		// size of the torrent is unknown until metadata is fetched, but zero would announce us as a seed
+		// and trackers may not return other seeds to us
+		Left:  unknownLeft,
+		Event: peers.EventStarted,
+	})
+	if err != nil {
+		if len(res) > 0 {
+			log.Warn().Err(err).Msg("failed to get peers from trackers, use only peers from magnet link and other sources")
+			return res, nil
+		}
+		return nil, fmt.Errorf("failed to get peers from trackers: %w", err)
+	}
+	return peers.MergePeers(res, resp.Peers), nil
+}
+
+// FromTorrentFile returns magnet link of the torrent with its name and trackers.
+func FromTorrentFile(torrentFile *torrent_file_decoder.TorrentFile) *Magnet {
+	res := &Magnet{
+		InfoHash: torrentFile.VerifyHash,
+		Name:     torrentFile.Name,
+	}
+	for _, tier := range torrentFile.AnnounceList {
+		res.Trackers = append(res.Trackers, tier...)
+	}
+	return res
+}
+
+func (m *Magnet) String() string {
+	params := []string{"xt=" + infoHashURNPrefix + hex.EncodeToString(m.InfoHash[:])}
+	if m.Name != "" {
+		params = append(params, "dn="+url.QueryEscape(m.Name))
+	}
+	for _, tracker := range m.Trackers {
+		params = append(params, "tr="+url.QueryEscape(tracker))
+	}
+	for _, peer := range m.Peers {
+		params = append(params, "x.pe="+url.QueryEscape(net.JoinHostPort(peer.IP.String(), strconv.Itoa(int(peer.Port)))))
+	}
+	return magnetScheme + ":?" + strings.Join(params, "&")
+}
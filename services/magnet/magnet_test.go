@@ -0,0 +1,100 @@
+package magnet
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var testInfoHash = [20]byte{0xde, 0xad, 0xbe, 0xef, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+
+func TestParse(t *testing.T) {
+	hexHash := hex.EncodeToString(testInfoHash[:])
+	base32Hash := base32.StdEncoding.EncodeToString(testInfoHash[:])
+	tests := []struct {
+		name     string
+		link     string
+		trackers []string
+		peers    []string
+	}{
+		{name: "hex info hash", link: "magnet:?xt=urn:btih:" + hexHash},
+		{name: "upper case hex info hash", link: "magnet:?xt=urn:btih:" + strings.ToUpper(hexHash)},
+		{name: "base32 info hash", link: "magnet:?xt=urn:btih:" + base32Hash},
+		{name: "lower case base32 info hash", link: "magnet:?xt=urn:btih:" + strings.ToLower(base32Hash)},
+		{name: "info hash after another topic", link: "magnet:?xt=urn:sha1:abc&xt=urn:btih:" + hexHash},
+		{
+			name:     "multiple trackers",
+			link:     "magnet:?xt=urn:btih:" + hexHash + "&tr=udp%3A%2F%2Fone%3A80&tr=&tr=http%3A%2F%2Ftwo%2Fannounce",
+			trackers: []string{"udp://one:80", "http://two/announce"},
+		},
+		{
+			name:  "peers",
+			link:  "magnet:?xt=urn:btih:" + hexHash + "&x.pe=10.0.0.1%3A6881&x.pe=%5B::1%5D%3A51413",
+			peers: []string{"10.0.0.1:6881", "[::1]:51413"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			link, err := Parse(tt.link)
+			if err != nil {
+				t.Fatalf("failed to parse: %v", err)
+			}
+			if link.InfoHash != testInfoHash {
+				t.Errorf("expected info hash %x got %x", testInfoHash, link.InfoHash)
+			}
+			if !reflect.DeepEqual(link.Trackers, tt.trackers) {
+				t.Errorf("expected trackers %v got %v", tt.trackers, link.Trackers)
+			}
+			var peers []string
+			for _, peer := range link.Peers {
+				peers = append(peers, peer.String())
+			}
+			if !reflect.DeepEqual(peers, tt.peers) {
+				t.Errorf("expected peers %v got %v", tt.peers, peers)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	hexHash := hex.EncodeToString(testInfoHash[:])
+	tests := []struct {
+		name string
+		link string
+	}{
+		{name: "missed exact topic", link: "magnet:?dn=name&tr=udp%3A%2F%2Fone%3A80"},
+		{name: "exact topic of another type", link: "magnet:?xt=urn:sha1:" + hexHash},
+		{name: "wrong length of info hash", link: "magnet:?xt=urn:btih:" + hexHash[:39]},
+		{name: "invalid hex info hash", link: "magnet:?xt=urn:btih:" + strings.Repeat("z", 40)},
+		{name: "invalid base32 info hash", link: "magnet:?xt=urn:btih:" + strings.Repeat("1", 32)},
+		{name: "wrong scheme", link: "http://example.com/?xt=urn:btih:" + hexHash},
+		{name: "invalid peer", link: "magnet:?xt=urn:btih:" + hexHash + "&x.pe=10.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if link, err := Parse(tt.link); err == nil {
+				t.Errorf("expected error got %+v", link)
+			}
+		})
+	}
+}
+
+func TestStringRoundTrip(t *testing.T) {
+	link, err := Parse("magnet:?xt=urn:btih:" + hex.EncodeToString(testInfoHash[:]) +
+		"&dn=some+name&tr=udp%3A%2F%2Fone%3A80&tr=http%3A%2F%2Ftwo%2Fannounce&x.pe=10.0.0.1%3A6881")
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	parsed, err := Parse(link.String())
+	if err != nil {
+		t.Fatalf("failed to parse %q: %v", link.String(), err)
+	}
+	if !reflect.DeepEqual(parsed, link) {
+		t.Errorf("expected %+v got %+v", link, parsed)
+	}
+	if expected := [][]string{{"udp://one:80"}, {"http://two/announce"}}; !reflect.DeepEqual(link.AnnounceList(), expected) {
+		t.Errorf("expected every tracker in its own tier got %v", link.AnnounceList())
+	}
+}
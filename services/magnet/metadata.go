@@ -0,0 +1,174 @@
+package magnet
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"github.com/hihoak/torrent-cli/client/torrent"
+	"github.com/hihoak/torrent-cli/services/peers"
+	torrent_file_decoder "github.com/hihoak/torrent-cli/services/torrent-file-decoder"
+	log "github.com/rs/zerolog/log"
+	"time"
+)
+
+const (
+	maxMetadataSize          = 16 * 1024 * 1024
+	metadataFetchTimeout     = 60 * time.Second
+	maxParallelMetadataPeers = 8
+)
+
+// FetchTorrentFile downloads info dictionary of the magnet link from peers and builds torrent file from it.
+func (m *Magnet) FetchTorrentFile(torrentPeers []*peers.Peer) (*torrent_file_decoder.TorrentFile, error) {
+	info, err := FetchMetadata(m.InfoHash, torrentPeers)
+	if err != nil {
+		return nil, err
+	}
+	torrentFile, err := torrent_file_decoder.UnmarshallInfo(info, m.AnnounceList())
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode fetched metadata: %w", err)
+	}
+	return torrentFile, nil
+}
+
+// FetchMetadata asks peers for info dictionary with ut_metadata extension until one of them
+// returns data with expected info hash.
+func FetchMetadata(infoHash [20]byte, torrentPeers []*peers.Peer) ([]byte, error) {
+	type result struct {
+		info []byte
+		err  error
+	}
+
+	peersChan := make(chan *peers.Peer, len(torrentPeers))
+	for _, peer := range torrentPeers {
+		peersChan <- peer
+	}
+	close(peersChan)
+
+	workers := maxParallelMetadataPeers
+	if workers > len(torrentPeers) {
+		workers = len(torrentPeers)
+	}
+	resultsChan := make(chan result, len(torrentPeers))
+	done := make(chan struct{})
+	defer close(done)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for peer := range peersChan {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				info, err := fetchMetadataFromPeer(infoHash, peer)
+				if err != nil {
+					err = fmt.Errorf("peer %v: %w", peer, err)
+				}
+				resultsChan <- result{info: info, err: err}
+			}
+		}()
+	}
+
+	var errs []error
+	for range torrentPeers {
+		res := <-resultsChan
+		if res.err == nil {
+			return res.info, nil
+		}
+		log.Debug().Err(res.err).Msg("failed to fetch metadata")
+		errs = append(errs, res.err)
+	}
+	return nil, fmt.Errorf("failed to fetch metadata from %d peers: %w", len(torrentPeers), errors.Join(errs...))
+}
+
+func fetchMetadataFromPeer(infoHash [20]byte, peer *peers.Peer) ([]byte, error) {
+	client, err := torrent.Connect(infoHash, peer, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if closeErr := client.Close(); closeErr != nil {
+			log.Error().Err(closeErr).Msg("failed to close connection to peer")
+		}
+	}()
+
+	if !client.SupportsExtensionProtocol() {
+		return nil, fmt.Errorf("peer doesn't support extension protocol")
+	}
+	if deadlineErr := client.SetDeadline(time.Now().Add(metadataFetchTimeout)); deadlineErr != nil {
+		return nil, fmt.Errorf("failed to set deadline: %w", deadlineErr)
+	}
+
+	for !client.ExtendedHandshakeReceived {
+		if _, _, readErr := readExtendedMessage(client); readErr != nil {
+			return nil, readErr
+		}
+	}
+	if !client.SupportsExtension(torrent.ExtensionMetadata) {
+		return nil, fmt.Errorf("peer doesn't support %s extension", torrent.ExtensionMetadata)
+	}
+	if client.MetadataSize <= 0 || client.MetadataSize > maxMetadataSize {
+		return nil, fmt.Errorf("peer announced invalid metadata size %d", client.MetadataSize)
+	}
+
+	info := make([]byte, client.MetadataSize)
+	countOfPieces := (client.MetadataSize + torrent.MetadataPieceSize - 1) / torrent.MetadataPieceSize
+	for idx := 0; idx < countOfPieces; idx++ {
+		if requestErr := client.SendMetadataRequest(idx); requestErr != nil {
+			return nil, requestErr
+		}
+	}
+
+	receivedPieces := make([]bool, countOfPieces)
+	for received := 0; received < countOfPieces; {
+		name, payload, readErr := readExtendedMessage(client)
+		if readErr != nil {
+			return nil, readErr
+		}
+		if name != torrent.ExtensionMetadata {
+			continue
+		}
+		piece, parseErr := torrent.ParseMetadataPiece(payload)
+		if parseErr != nil {
+			return nil, parseErr
+		}
+		switch piece.Type {
+		case torrent.MetadataReject:
+			return nil, fmt.Errorf("peer rejected request of metadata piece %d", piece.Index)
+		case torrent.MetadataData:
+		default:
+			continue
+		}
+		start := piece.Index * torrent.MetadataPieceSize
+		if piece.Index < 0 || piece.Index >= countOfPieces || start+len(piece.Data) > len(info) {
+			return nil, fmt.Errorf("got metadata piece %d out of bounds", piece.Index)
+		}
+		copy(info[start:], piece.Data)
+		if !receivedPieces[piece.Index] {
+			receivedPieces[piece.Index] = true
+			received++
+		}
+	}
+
+	if sha1.Sum(info) != infoHash {
+		return nil, fmt.Errorf("hash of received metadata doesn't match info hash")
+	}
+	return info, nil
+}
+
+// readExtendedMessage reads messages until extended one, other messages are ignored.
+func readExtendedMessage(client *torrent.Client) (string, []byte, error) {
+	for {
+		msg, err := client.ReadMessage()
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to read message: %w", err)
+		}
+		if msg == nil || msg.ID != torrent.MsgExtended {
+			continue
+		}
+		name, payload, handleErr := client.HandleExtended(msg)
+		if handleErr != nil {
+			return "", nil, fmt.Errorf("failed to handle extended message: %w", handleErr)
+		}
+		return name, payload, nil
+	}
+}
@@ -0,0 +1,196 @@
+package magnet
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"github.com/hihoak/torrent-cli/bencode"
+	"github.com/hihoak/torrent-cli/client/torrent"
+	"github.com/hihoak/torrent-cli/services/peers"
+	"io"
+	"net"
+	"testing"
+)
+
+// stubMetadataID is ID of ut_metadata which stub peer announces
+const stubMetadataID = 3
+
+// stubMetadataPeer is a peer which serves metadata with ut_metadata extension. It waits requests of all
+// pieces and answers them, so order of answers can be changed.
+type stubMetadataPeer struct {
+	infoHash [20]byte
+	// size is announced as metadata_size, data is sent in pieces
+	size int
+	data []byte
+	// reverse sends pieces in reverse order
+	reverse bool
+	// reject rejects all requests
+	reject bool
+}
+
+func (s *stubMetadataPeer) listen(t *testing.T) *peers.Peer {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, acceptErr := ln.Accept()
+			if acceptErr != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_ = s.serve(conn)
+			}()
+		}
+	}()
+	addr := ln.Addr().(*net.TCPAddr)
+	return &peers.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+}
+
+func (s *stubMetadataPeer) serve(conn net.Conn) error {
+	if _, err := io.ReadFull(conn, make([]byte, 68)); err != nil {
+		return err
+	}
+	if err := torrent.SendHandshake(conn, s.infoHash, [20]byte{'s', 't', 'u', 'b'}); err != nil {
+		return err
+	}
+	handshake, err := bencode.Marshal(map[string]interface{}{
+		"m":             map[string]interface{}{torrent.ExtensionMetadata: stubMetadataID},
+		"metadata_size": s.size,
+	})
+	if err != nil {
+		return err
+	}
+	if err = s.send(conn, 0, handshake); err != nil {
+		return err
+	}
+
+	clientMetadataID := 0
+	countOfPieces := (s.size + torrent.MetadataPieceSize - 1) / torrent.MetadataPieceSize
+	var requests []int
+	for len(requests) < countOfPieces {
+		msg, readErr := torrent.UnmarshallMessage(conn)
+		if readErr != nil {
+			return readErr
+		}
+		if msg == nil || msg.ID != torrent.MsgExtended {
+			continue
+		}
+		extendedID, payload, parseErr := msg.ParseExtended()
+		if parseErr != nil {
+			return parseErr
+		}
+		if extendedID == 0 {
+			clientHandshake := struct {
+				M map[string]int `bencode:"m"`
+			}{}
+			if decodeErr := bencode.Unmarshal(payload, &clientHandshake); decodeErr != nil {
+				return decodeErr
+			}
+			clientMetadataID = clientHandshake.M[torrent.ExtensionMetadata]
+			continue
+		}
+		request, parseErr := torrent.ParseMetadataPiece(payload)
+		if parseErr != nil {
+			return parseErr
+		}
+		requests = append(requests, request.Index)
+	}
+
+	if s.reverse {
+		for left, right := 0, len(requests)-1; left < right; left, right = left+1, right-1 {
+			requests[left], requests[right] = requests[right], requests[left]
+		}
+	}
+	for _, index := range requests {
+		if err = s.answer(conn, clientMetadataID, index); err != nil {
+			return err
+		}
+	}
+	// connection is kept until client closes it
+	_, _ = io.Copy(io.Discard, conn)
+	return nil
+}
+
+func (s *stubMetadataPeer) answer(conn net.Conn, clientMetadataID, index int) error {
+	if s.reject {
+		payload, err := bencode.Marshal(map[string]interface{}{"msg_type": torrent.MetadataReject, "piece": index})
+		if err != nil {
+			return err
+		}
+		return s.send(conn, clientMetadataID, payload)
+	}
+	start := index * torrent.MetadataPieceSize
+	end := start + torrent.MetadataPieceSize
+	if end > len(s.data) {
+		end = len(s.data)
+	}
+	payload, err := bencode.Marshal(map[string]interface{}{"msg_type": torrent.MetadataData, "piece": index, "total_size": len(s.data)})
+	if err != nil {
+		return err
+	}
+	return s.send(conn, clientMetadataID, append(payload, s.data[start:end]...))
+}
+
+func (s *stubMetadataPeer) send(conn net.Conn, extendedID int, payload []byte) error {
+	_, err := conn.Write(torrent.Marshall(torrent.CreateExtendedMessage(extendedID, payload)))
+	return err
+}
+
+func testMetadata() ([]byte, [20]byte) {
+	info := bytes.Repeat([]byte("metadata"), 5000)
+	return info, sha1.Sum(info)
+}
+
+func TestFetchMetadata(t *testing.T) {
+	info, infoHash := testMetadata()
+	corrupted := append([]byte{}, info...)
+	corrupted[len(corrupted)-1] ^= 0xff
+	tests := []struct {
+		name string
+		peer *stubMetadataPeer
+		ok   bool
+	}{
+		{name: "pieces in order", peer: &stubMetadataPeer{size: len(info), data: info}, ok: true},
+		{name: "pieces out of order", peer: &stubMetadataPeer{size: len(info), data: info, reverse: true}, ok: true},
+		{name: "hash mismatch", peer: &stubMetadataPeer{size: len(corrupted), data: corrupted}},
+		{name: "total size is less than data", peer: &stubMetadataPeer{size: len(info) - 100, data: info}},
+		{name: "no total size", peer: &stubMetadataPeer{size: 0, data: info}},
+		{name: "total size is too big", peer: &stubMetadataPeer{size: maxMetadataSize + 1, data: info}},
+		{name: "reject", peer: &stubMetadataPeer{size: len(info), data: info, reject: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.peer.infoHash = infoHash
+			fetched, err := FetchMetadata(infoHash, []*peers.Peer{tt.peer.listen(t)})
+			if !tt.ok {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				t.Logf("got expected error: %v", err)
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to fetch metadata: %v", err)
+			}
+			if !bytes.Equal(fetched, info) {
+				t.Errorf("fetched metadata of %d bytes differs from expected %d bytes", len(fetched), len(info))
+			}
+		})
+	}
+}
+
+func TestFetchMetadataSkipsBadPeers(t *testing.T) {
+	info, infoHash := testMetadata()
+	rejecting := &stubMetadataPeer{infoHash: infoHash, size: len(info), data: info, reject: true}
+	good := &stubMetadataPeer{infoHash: infoHash, size: len(info), data: info}
+	fetched, err := FetchMetadata(infoHash, []*peers.Peer{rejecting.listen(t), good.listen(t)})
+	if err != nil {
+		t.Fatalf("failed to fetch metadata: %v", err)
+	}
+	if !bytes.Equal(fetched, info) {
+		t.Error("fetched metadata differs from expected")
+	}
+}
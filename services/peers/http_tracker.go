@@ -0,0 +1,87 @@
+package peers
+
+import (
+	"fmt"
+	"github.com/hihoak/torrent-cli/bencode"
+	log "github.com/rs/zerolog/log"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+type bencodePeers struct {
+	FailureReason string `bencode:"failure reason"`
+	Interval      int    `bencode:"interval"`
+	Complete      int    `bencode:"complete"`
+	Incomplete    int    `bencode:"incomplete"`
+	Peers         string `bencode:"peers"`
+}
+
+func buildHTTPTrackerURL(base *url.URL, req AnnounceRequest) string {
+	trackerURL := *base
+	params := trackerURL.Query()
+	params.Set("info_hash", string(req.InfoHash[:]))
+	params.Set("peer_id", string(req.PeerID[:]))
+	params.Set("port", strconv.Itoa(int(req.Port)))
+	params.Set("uploaded", strconv.FormatInt(req.Uploaded, 10))
+	params.Set("downloaded", strconv.FormatInt(req.Downloaded, 10))
+	params.Set("left", strconv.FormatInt(req.Left, 10))
+	params.Set("compact", "1")
+	if req.Event != EventNone {
+		params.Set("event", req.Event.String())
+	}
+	trackerURL.RawQuery = params.Encode()
+	return trackerURL.String()
+}
+
+func announceHTTP(base *url.URL, announceReq AnnounceRequest) (*AnnounceResponse, error) {
+	req, err := http.NewRequest(http.MethodGet, buildHTTPTrackerURL(base, announceReq), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare request to get a peers: %w", err)
+	}
+
+	client := http.Client{
+		Timeout: time.Second * 30,
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get peers: %w", err)
+	}
+	defer func() {
+		if closeErr := resp.Body.Close(); closeErr != nil {
+			log.Error().Err(closeErr).Msg("failed to close connection")
+		}
+	}()
+	if resp.StatusCode != http.StatusOK {
+		responseErr := fmt.Errorf("failed to get peers: status code %d", resp.StatusCode)
+		additionalInfo, readErr := io.ReadAll(resp.Body)
+		if readErr != nil {
+			log.Error().Err(readErr).Msg("failed to read body of response")
+		}
+		return nil, fmt.Errorf("%w: %s", responseErr, string(additionalInfo))
+	}
+
+	bencodePeersData := bencodePeers{}
+	unmarshallErr := bencode.NewDecoder(resp.Body).Decode(&bencodePeersData)
+	if unmarshallErr != nil {
+		return nil, fmt.Errorf("failed to unmarshall peers response from bencode encoding to Peers structure: %w", unmarshallErr)
+	}
+	if bencodePeersData.FailureReason != "" {
+		return nil, fmt.Errorf("tracker returned failure: %s", bencodePeersData.FailureReason)
+	}
+
+	peers, convertToPeers := ParseCompactPeers([]byte(bencodePeersData.Peers))
+	if convertToPeers != nil {
+		return nil, fmt.Errorf("failed to convert encoded peers to peers structure: %w", convertToPeers)
+	}
+
+	return &AnnounceResponse{
+		Interval: time.Duration(bencodePeersData.Interval) * time.Second,
+		Leechers: bencodePeersData.Incomplete,
+		Seeders:  bencodePeersData.Complete,
+		Peers:    peers,
+	}, nil
+}
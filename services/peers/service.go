@@ -4,19 +4,19 @@ import (
 	"encoding/binary"
 	"fmt"
 	torrent_decoder "github.com/hihoak/torrent-cli/services/torrent-file-decoder"
-	"github.com/jackpal/bencode-go"
 	log "github.com/rs/zerolog/log"
-	"io"
 	"math/rand"
 	"net"
-	"net/http"
-	"time"
+	"strconv"
+	"sync"
 )
 
 const (
 	peerIPLengthBytes   = 4
 	peerPortLengthBytes = 2
 	peerAddressLength   = 6
+	// peerIPv6AddressLength is a length of peer in compact format with 16 bytes of IP
+	peerIPv6AddressLength = 18
 )
 
 var letters = []byte("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
@@ -32,18 +32,15 @@ func getID() [20]byte {
 	return [20]byte(id)
 }
 
-type bencodePeers struct {
-	Peers string `bencode:"peers"`
-}
-
-func (b *bencodePeers) convertToPeers() ([]*Peer, error) {
-	if len(b.Peers)%peerAddressLength != 0 {
-		return nil, fmt.Errorf("invalid peers length %d: length must deviding by %d", len(b.Peers), peerAddressLength)
+// ParseCompactPeers converts peers in compact format (4 bytes of IP and 2 bytes of port) to Peer structures.
+func ParseCompactPeers(data []byte) ([]*Peer, error) {
+	if len(data)%peerAddressLength != 0 {
+		return nil, fmt.Errorf("invalid peers length %d: length must deviding by %d", len(data), peerAddressLength)
 	}
-	res := make([]*Peer, 0, len(b.Peers)/peerAddressLength)
-	for left := 0; left < len(b.Peers); left += peerAddressLength {
-		ipRaw := []byte(b.Peers[left : left+peerIPLengthBytes])
-		port := binary.BigEndian.Uint16([]byte(b.Peers[left+peerIPLengthBytes : left+peerIPLengthBytes+peerPortLengthBytes]))
+	res := make([]*Peer, 0, len(data)/peerAddressLength)
+	for left := 0; left < len(data); left += peerAddressLength {
+		ipRaw := data[left : left+peerIPLengthBytes]
+		port := binary.BigEndian.Uint16(data[left+peerIPLengthBytes : left+peerIPLengthBytes+peerPortLengthBytes])
 		res = append(res, &Peer{
 			IP:   net.IPv4(ipRaw[0], ipRaw[1], ipRaw[2], ipRaw[3]),
 			Port: port,
@@ -52,57 +49,120 @@ func (b *bencodePeers) convertToPeers() ([]*Peer, error) {
 	return res, nil
 }
 
+// ParseCompactPeers6 converts peers in compact format with 16 bytes of IPv6 address to Peer structures.
+func ParseCompactPeers6(data []byte) ([]*Peer, error) {
+	if len(data)%peerIPv6AddressLength != 0 {
+		return nil, fmt.Errorf("invalid peers length %d: length must deviding by %d", len(data), peerIPv6AddressLength)
+	}
+	res := make([]*Peer, 0, len(data)/peerIPv6AddressLength)
+	for left := 0; left < len(data); left += peerIPv6AddressLength {
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, data[left:left+net.IPv6len])
+		res = append(res, &Peer{
+			IP:   ip,
+			Port: binary.BigEndian.Uint16(data[left+net.IPv6len : left+peerIPv6AddressLength]),
+		})
+	}
+	return res, nil
+}
+
 type Peer struct {
 	IP   net.IP
 	Port uint16
 }
 
-func GetPeers(torrentFile *torrent_decoder.TorrentFile) ([]*Peer, error) {
-	trackerURL, err := torrentFile.BuildTrackerURL(MyPeerID)
-	if err != nil {
-		return nil, fmt.Errorf("failed to build tracker URL for find PEERS: %w", err)
+func (p *Peer) String() string {
+	return net.JoinHostPort(p.IP.String(), strconv.Itoa(int(p.Port)))
+}
+
+// Compact returns peer in compact format: 6 bytes for IPv4 address and 18 bytes for IPv6 address.
+func (p *Peer) Compact() []byte {
+	ip := p.IP.To4()
+	if ip == nil {
+		ip = p.IP.To16()
 	}
+	res := make([]byte, len(ip)+peerPortLengthBytes)
+	copy(res, ip)
+	binary.BigEndian.PutUint16(res[len(ip):], p.Port)
+	return res
+}
 
-	req, err := http.NewRequest(http.MethodGet, trackerURL, nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed to prepare request to get a peers: %w", err)
+// PeerSource finds peers of a torrent without trackers, for example in DHT.
+type PeerSource interface {
+	// GetPeers returns peers of the torrent and announces that we accept connections on port.
+	GetPeers(infoHash [20]byte, port uint16) ([]*Peer, error)
+}
+
+// GetPeers announces to trackers of the torrent that we started and listen on port and returns received
+// peers merged with peers from sources. Sources aren't used for private torrents (BEP 27). Error is returned
+// only if trackers failed and sources found nothing.
+func GetPeers(torrentFile *torrent_decoder.TorrentFile, trackers *TrackerList, port uint16, sources ...PeerSource) ([]*Peer, error) {
+	if torrentFile.Private {
+		sources = nil
 	}
+	var sourcePeers []*Peer
+	sourcesDone := make(chan struct{})
+	go func() {
+		defer close(sourcesDone)
+		sourcePeers = FromSources(torrentFile.VerifyHash, port, sources)
+	}()
 
-	client := http.Client{
-		Timeout: time.Second * 30,
+	var trackerPeers []*Peer
+	resp, err := trackers.Announce(AnnounceRequest{
+		InfoHash: torrentFile.VerifyHash,
+		PeerID:   MyPeerID,
+		Port:     port,
+		Left:     int64(torrentFile.Length),
+		Event:    EventStarted,
+	})
+	if err == nil {
+		trackerPeers = resp.Peers
 	}
+	<-sourcesDone
 
-	resp, err := client.Do(req)
+	res := MergePeers(trackerPeers, sourcePeers)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get peers: %w", err)
-	}
-	if resp.StatusCode != http.StatusOK {
-		responseErr := fmt.Errorf("failed to get peers: status code %d", resp.StatusCode)
-		if resp.Body != nil {
-			additionalInfo, readErr := io.ReadAll(resp.Body)
-			if readErr != nil {
-				log.Error().Err(readErr).Msg("failed to read body of response")
-			}
-			responseErr = fmt.Errorf("%w: %s", responseErr, string(additionalInfo))
+		if len(res) == 0 {
+			return nil, fmt.Errorf("failed to get peers: %w", err)
 		}
-		return nil, responseErr
+		log.Warn().Err(err).Msgf("failed to get peers from trackers, use %d peers from other sources", len(res))
 	}
-	defer func() {
-		if closeErr := resp.Body.Close(); closeErr != nil {
-			log.Error().Err(closeErr).Msg("failed to close connection")
-		}
-	}()
+	return res, nil
+}
 
-	bencodePeersData := bencodePeers{}
-	unmarshallErr := bencode.Unmarshal(resp.Body, &bencodePeersData)
-	if unmarshallErr != nil {
-		return nil, fmt.Errorf("failed to unmarshall peers response from bencode encoding to Peers structure: %w", unmarshallErr)
+// FromSources queries all sources concurrently and merges their peers, failed sources are skipped.
+func FromSources(infoHash [20]byte, port uint16, sources []PeerSource) []*Peer {
+	found := make([][]*Peer, len(sources))
+	wg := &sync.WaitGroup{}
+	wg.Add(len(sources))
+	for idx, source := range sources {
+		go func(idx int, source PeerSource) {
+			defer wg.Done()
+			sourcePeers, err := source.GetPeers(infoHash, port)
+			if err != nil {
+				log.Warn().Err(err).Msg("failed to get peers from source")
+				return
+			}
+			found[idx] = sourcePeers
+		}(idx, source)
 	}
+	wg.Wait()
+	return MergePeers(found...)
+}
 
-	peers, convertToPeers := bencodePeersData.convertToPeers()
-	if convertToPeers != nil {
-		return nil, fmt.Errorf("failed to convert encoded peers to peers structure: %w", convertToPeers)
+// MergePeers concatenates lists of peers without duplicates.
+func MergePeers(lists ...[]*Peer) []*Peer {
+	var res []*Peer
+	seen := make(map[string]bool)
+	for _, list := range lists {
+		for _, peer := range list {
+			addr := peer.String()
+			if seen[addr] {
+				continue
+			}
+			seen[addr] = true
+			res = append(res, peer)
+		}
 	}
-
-	return peers, nil
+	return res
 }
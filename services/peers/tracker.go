@@ -0,0 +1,71 @@
+package peers
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+)
+
+type Event int
+
+// Values of events are the same as in UDP tracker protocol.
+const (
+	EventNone Event = iota
+	EventCompleted
+	EventStarted
+	EventStopped
+)
+
+func (e Event) String() string {
+	switch e {
+	case EventCompleted:
+		return "completed"
+	case EventStarted:
+		return "started"
+	case EventStopped:
+		return "stopped"
+	default:
+		return ""
+	}
+}
+
+type AnnounceRequest struct {
+	InfoHash   [20]byte
+	PeerID     [20]byte
+	Port       uint16
+	Uploaded   int64
+	Downloaded int64
+	Left       int64
+	Event      Event
+}
+
+type AnnounceResponse struct {
+	Interval time.Duration
+	Leechers int
+	Seeders  int
+	Peers    []*Peer
+}
+
+// Announce sends request to the tracker, protocol is selected by the scheme of trackerURL.
+func Announce(trackerURL string, req AnnounceRequest) (*AnnounceResponse, error) {
+	base, err := url.Parse(trackerURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse tracker URL %q: %w", trackerURL, err)
+	}
+
+	switch base.Scheme {
+	case "http", "https":
+		return announceHTTP(base, req)
+	case "udp":
+		tracker, trackerErr := NewUDPTracker(base.Host)
+		if trackerErr != nil {
+			return nil, fmt.Errorf("failed to init UDP tracker: %w", trackerErr)
+		}
+		defer tracker.Close()
+		tracker.BaseTimeout = udpAnnounceBaseTimeout
+		tracker.MaxRetries = udpAnnounceMaxRetries
+		return tracker.Announce(req)
+	default:
+		return nil, fmt.Errorf("unsupported scheme of tracker URL %q", trackerURL)
+	}
+}
@@ -0,0 +1,129 @@
+package peers
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/rs/zerolog/log"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// TrackerList announces to tiers of trackers as described in BEP 12. Trackers are shuffled
+// inside of a tier once and tracker which responded successfully is moved to the front of its tier,
+// so one list must be used for all announces of the torrent.
+type TrackerList struct {
+	mu    sync.Mutex
+	tiers [][]string
+	// interval is returned by trackers in the last successful announce
+	interval time.Duration
+}
+
+func NewTrackerList(announceList [][]string) *TrackerList {
+	tiers := make([][]string, 0, len(announceList))
+	for _, tier := range announceList {
+		shuffled := append([]string(nil), tier...)
+		rand.Shuffle(len(shuffled), func(i, j int) {
+			shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+		})
+		tiers = append(tiers, shuffled)
+	}
+	return &TrackerList{tiers: tiers}
+}
+
+// Announce announces to every tier concurrently, inside of a tier trackers are tried in order until
+// the first success. Peers from all tiers are merged. Error is returned only if every tier failed.
+func (l *TrackerList) Announce(req AnnounceRequest) (*AnnounceResponse, error) {
+	l.mu.Lock()
+	tiers := make([][]string, len(l.tiers))
+	for idx, tier := range l.tiers {
+		tiers[idx] = append([]string(nil), tier...)
+	}
+	l.mu.Unlock()
+
+	if len(tiers) == 0 {
+		return nil, fmt.Errorf("torrent has no trackers")
+	}
+
+	responses := make([]*AnnounceResponse, len(tiers))
+	errs := make([]error, len(tiers))
+	wg := &sync.WaitGroup{}
+	wg.Add(len(tiers))
+	for idx, tier := range tiers {
+		go func(idx int, tier []string) {
+			defer wg.Done()
+			responses[idx], errs[idx] = l.announceTier(idx, tier, req)
+		}(idx, tier)
+	}
+	wg.Wait()
+
+	var merged *AnnounceResponse
+	seen := make(map[string]struct{})
+	for _, resp := range responses {
+		if resp == nil {
+			continue
+		}
+		if merged == nil {
+			merged = &AnnounceResponse{Interval: resp.Interval}
+		}
+		if resp.Interval > 0 && (merged.Interval == 0 || resp.Interval < merged.Interval) {
+			merged.Interval = resp.Interval
+		}
+		merged.Leechers += resp.Leechers
+		merged.Seeders += resp.Seeders
+		for _, peer := range resp.Peers {
+			address := net.JoinHostPort(peer.IP.String(), strconv.Itoa(int(peer.Port)))
+			if _, ok := seen[address]; ok {
+				continue
+			}
+			seen[address] = struct{}{}
+			merged.Peers = append(merged.Peers, peer)
+		}
+	}
+	if merged == nil {
+		return nil, fmt.Errorf("all trackers failed: %w", errors.Join(errs...))
+	}
+	l.mu.Lock()
+	l.interval = merged.Interval
+	l.mu.Unlock()
+	return merged, nil
+}
+
+// Interval returns interval after which trackers expect the next announce, zero if no announce succeeded.
+func (l *TrackerList) Interval() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.interval
+}
+
+func (l *TrackerList) announceTier(tierIdx int, tier []string, req AnnounceRequest) (*AnnounceResponse, error) {
+	var errs []error
+	for _, trackerURL := range tier {
+		resp, err := Announce(trackerURL, req)
+		if err != nil {
+			log.Warn().Err(err).Msgf("failed to announce to tracker %s", trackerURL)
+			errs = append(errs, fmt.Errorf("tracker %s: %w", trackerURL, err))
+			continue
+		}
+		l.promote(tierIdx, trackerURL)
+		log.Debug().Msgf("tracker %s returned %d peers", trackerURL, len(resp.Peers))
+		return resp, nil
+	}
+	return nil, errors.Join(errs...)
+}
+
+// promote moves tracker to the front of its tier.
+func (l *TrackerList) promote(tierIdx int, trackerURL string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	tier := l.tiers[tierIdx]
+	for idx, tracker := range tier {
+		if tracker == trackerURL {
+			copy(tier[1:idx+1], tier[:idx])
+			tier[0] = trackerURL
+			return
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package peers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newStubHTTPTracker(t *testing.T, body string) (*httptest.Server, *int32) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		_, _ = w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func TestTrackerListKeepsPromotedTracker(t *testing.T) {
+	failing, failingRequests := newStubHTTPTracker(t, "d14:failure reason4:downe")
+	working, workingRequests := newStubHTTPTracker(t, "d8:intervali900e5:peers6:\x0a\x00\x00\x01\x1a\xe1e")
+	trackers := NewTrackerList([][]string{{failing.URL + "/announce", working.URL + "/announce"}})
+
+	for idx := 0; idx < 3; idx++ {
+		resp, err := trackers.Announce(AnnounceRequest{InfoHash: [20]byte{1}, PeerID: MyPeerID, Port: 6881})
+		if err != nil {
+			t.Fatalf("failed to announce: %v", err)
+		}
+		if len(resp.Peers) != 1 || resp.Peers[0].String() != "10.0.0.1:6881" {
+			t.Fatalf("unexpected peers %v", resp.Peers)
+		}
+	}
+	// failing tracker may be asked only before working tracker is promoted
+	if got := atomic.LoadInt32(failingRequests); got > 1 {
+		t.Errorf("expected promoted tracker to be used first, failing tracker got %d requests", got)
+	}
+	if got := atomic.LoadInt32(workingRequests); got != 3 {
+		t.Errorf("expected 3 requests to working tracker got %d", got)
+	}
+	if trackers.Interval() != 900*time.Second {
+		t.Errorf("expected interval of the last announce got %s", trackers.Interval())
+	}
+}
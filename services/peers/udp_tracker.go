@@ -0,0 +1,206 @@
+package peers
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	udpProtocolID = 0x41727101980
+
+	udpActionConnect  uint32 = 0
+	udpActionAnnounce uint32 = 1
+	udpActionScrape   uint32 = 2
+	udpActionError    uint32 = 3
+
+	udpHeaderLength           = 16
+	udpResponseHeaderLength   = 8
+	udpAnnounceResponseLength = 20
+	udpScrapeResultLength     = 12
+	udpMaxPacketSize          = 2048
+
+	// udpConnectionIDLifetime is the time during which connection ID can be used by client.
+	udpConnectionIDLifetime = time.Minute
+	udpDefaultBaseTimeout   = 15 * time.Second
+	udpDefaultMaxRetries    = 8
+	// udpAnnounceBaseTimeout and udpAnnounceMaxRetries are used by Announce, it doesn't wait for the whole
+	// BEP 15 backoff, so dead tracker delays failover to the next tracker of its tier for at most 15 seconds.
+	udpAnnounceBaseTimeout = 5 * time.Second
+	udpAnnounceMaxRetries  = 1
+)
+
+var errUDPTimeout = errors.New("UDP tracker request timed out")
+
+type ScrapeResult struct {
+	Seeders   int
+	Completed int
+	Leechers  int
+}
+
+// UDPTracker is a client of UDP tracker protocol (BEP 15).
+type UDPTracker struct {
+	conn net.Conn
+
+	// BaseTimeout is a timeout of the first attempt, n-th retransmission waits BaseTimeout * 2^n.
+	BaseTimeout time.Duration
+	// MaxRetries is a count of retransmissions after which request fails.
+	MaxRetries int
+
+	mu                 sync.Mutex
+	connectionID       uint64
+	connectionIDExpiry time.Time
+}
+
+func NewUDPTracker(address string) (*UDPTracker, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial UDP tracker %q: %w", address, err)
+	}
+	return &UDPTracker{
+		conn:        conn,
+		BaseTimeout: udpDefaultBaseTimeout,
+		MaxRetries:  udpDefaultMaxRetries,
+	}, nil
+}
+
+func (t *UDPTracker) Close() error {
+	return t.conn.Close()
+}
+
+func (t *UDPTracker) Announce(req AnnounceRequest) (*AnnounceResponse, error) {
+	payload := make([]byte, 82)
+	copy(payload[0:20], req.InfoHash[:])
+	copy(payload[20:40], req.PeerID[:])
+	binary.BigEndian.PutUint64(payload[40:48], uint64(req.Downloaded))
+	binary.BigEndian.PutUint64(payload[48:56], uint64(req.Left))
+	binary.BigEndian.PutUint64(payload[56:64], uint64(req.Uploaded))
+	binary.BigEndian.PutUint32(payload[64:68], uint32(req.Event))
+	// IP address 0 means that tracker uses sender address of the packet
+	binary.BigEndian.PutUint32(payload[68:72], 0)
+	binary.BigEndian.PutUint32(payload[72:76], rand.Uint32())
+	// num_want -1 is a default count of peers
+	binary.BigEndian.PutUint32(payload[76:80], 0xFFFFFFFF)
+	binary.BigEndian.PutUint16(payload[80:82], req.Port)
+
+	resp, err := t.request(udpActionAnnounce, payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to announce: %w", err)
+	}
+	if len(resp) < udpAnnounceResponseLength-udpResponseHeaderLength {
+		return nil, fmt.Errorf("too short announce response of length %d", len(resp))
+	}
+
+	peers, err := ParseCompactPeers(resp[12:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse peers of announce response: %w", err)
+	}
+	return &AnnounceResponse{
+		Interval: time.Duration(binary.BigEndian.Uint32(resp[0:4])) * time.Second,
+		Leechers: int(binary.BigEndian.Uint32(resp[4:8])),
+		Seeders:  int(binary.BigEndian.Uint32(resp[8:12])),
+		Peers:    peers,
+	}, nil
+}
+
+func (t *UDPTracker) Scrape(infoHashes ...[20]byte) ([]ScrapeResult, error) {
+	payload := make([]byte, 0, len(infoHashes)*20)
+	for _, infoHash := range infoHashes {
+		payload = append(payload, infoHash[:]...)
+	}
+
+	resp, err := t.request(udpActionScrape, payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scrape: %w", err)
+	}
+	if len(resp) < len(infoHashes)*udpScrapeResultLength {
+		return nil, fmt.Errorf("too short scrape response of length %d for %d info hashes", len(resp), len(infoHashes))
+	}
+
+	res := make([]ScrapeResult, 0, len(infoHashes))
+	for left := 0; left < len(infoHashes)*udpScrapeResultLength; left += udpScrapeResultLength {
+		res = append(res, ScrapeResult{
+			Seeders:   int(binary.BigEndian.Uint32(resp[left : left+4])),
+			Completed: int(binary.BigEndian.Uint32(resp[left+4 : left+8])),
+			Leechers:  int(binary.BigEndian.Uint32(resp[left+8 : left+12])),
+		})
+	}
+	return res, nil
+}
+
+// request sends action to the tracker with retransmissions and returns response payload without header.
+// Connection ID is obtained again if it's expired.
+func (t *UDPTracker) request(action uint32, payload []byte) ([]byte, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for n := 0; n <= t.MaxRetries; n++ {
+		timeout := t.BaseTimeout << n
+		if time.Now().After(t.connectionIDExpiry) {
+			resp, err := t.exchange(udpProtocolID, udpActionConnect, nil, timeout)
+			if errors.Is(err, errUDPTimeout) {
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to connect: %w", err)
+			}
+			if len(resp) < 8 {
+				return nil, fmt.Errorf("too short connect response of length %d", len(resp))
+			}
+			t.connectionID = binary.BigEndian.Uint64(resp[:8])
+			t.connectionIDExpiry = time.Now().Add(udpConnectionIDLifetime)
+		}
+
+		resp, err := t.exchange(t.connectionID, action, payload, timeout)
+		if errors.Is(err, errUDPTimeout) {
+			continue
+		}
+		return resp, err
+	}
+	return nil, fmt.Errorf("tracker doesn't respond after %d retransmissions: %w", t.MaxRetries, errUDPTimeout)
+}
+
+// exchange sends a single packet and waits for the response with the same transaction ID.
+func (t *UDPTracker) exchange(connectionID uint64, action uint32, payload []byte, timeout time.Duration) ([]byte, error) {
+	transactionID := rand.Uint32()
+	packet := make([]byte, udpHeaderLength+len(payload))
+	binary.BigEndian.PutUint64(packet[0:8], connectionID)
+	binary.BigEndian.PutUint32(packet[8:12], action)
+	binary.BigEndian.PutUint32(packet[12:16], transactionID)
+	copy(packet[udpHeaderLength:], payload)
+
+	if err := t.conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, fmt.Errorf("failed to set deadline: %w", err)
+	}
+	if _, err := t.conn.Write(packet); err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+
+	buf := make([]byte, udpMaxPacketSize)
+	for {
+		n, err := t.conn.Read(buf)
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return nil, errUDPTimeout
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read response: %w", err)
+		}
+		if n < udpResponseHeaderLength || binary.BigEndian.Uint32(buf[4:8]) != transactionID {
+			continue
+		}
+
+		respAction := binary.BigEndian.Uint32(buf[0:4])
+		if respAction == udpActionError {
+			return nil, fmt.Errorf("tracker returned error: %s", string(buf[udpResponseHeaderLength:n]))
+		}
+		if respAction != action {
+			return nil, fmt.Errorf("got response with action %d expect %d", respAction, action)
+		}
+		return append([]byte(nil), buf[udpResponseHeaderLength:n]...), nil
+	}
+}
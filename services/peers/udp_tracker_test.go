@@ -0,0 +1,243 @@
+package peers
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubUDPTracker is a local UDP tracker which answers connect, announce and scrape requests.
+type stubUDPTracker struct {
+	conn *net.UDPConn
+
+	mu sync.Mutex
+	// drop is a count of the next requests which are ignored to trigger retransmissions
+	drop         int
+	connects     int
+	actions      []uint32
+	connectionID uint64
+	peers        []*Peer
+}
+
+func newStubUDPTracker(t *testing.T, peers ...*Peer) *stubUDPTracker {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	stub := &stubUDPTracker{conn: conn, peers: peers}
+	t.Cleanup(func() { _ = conn.Close() })
+	go stub.serve()
+	return stub
+}
+
+func (s *stubUDPTracker) addr() string {
+	return s.conn.LocalAddr().String()
+}
+
+func (s *stubUDPTracker) serve() {
+	buf := make([]byte, udpMaxPacketSize)
+	for {
+		n, from, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if resp := s.handle(buf[:n]); resp != nil {
+			_, _ = s.conn.WriteToUDP(resp, from)
+		}
+	}
+}
+
+func (s *stubUDPTracker) handle(packet []byte) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(packet) < udpHeaderLength {
+		return nil
+	}
+	connectionID := binary.BigEndian.Uint64(packet[0:8])
+	action := binary.BigEndian.Uint32(packet[8:12])
+	transactionID := binary.BigEndian.Uint32(packet[12:16])
+	if s.drop > 0 {
+		s.drop--
+		return nil
+	}
+	s.actions = append(s.actions, action)
+
+	header := func(action uint32) []byte {
+		res := make([]byte, udpResponseHeaderLength)
+		binary.BigEndian.PutUint32(res[0:4], action)
+		binary.BigEndian.PutUint32(res[4:8], transactionID)
+		return res
+	}
+	if action == udpActionConnect {
+		if connectionID != udpProtocolID {
+			return append(header(udpActionError), "invalid protocol ID"...)
+		}
+		s.connects++
+		s.connectionID = uint64(0xC0FFEE00 + s.connects)
+		return binary.BigEndian.AppendUint64(header(udpActionConnect), s.connectionID)
+	}
+	if connectionID != s.connectionID {
+		return append(header(udpActionError), "unknown connection ID"...)
+	}
+
+	switch action {
+	case udpActionAnnounce:
+		resp := header(udpActionAnnounce)
+		resp = binary.BigEndian.AppendUint32(resp, 1800)
+		resp = binary.BigEndian.AppendUint32(resp, 3)
+		resp = binary.BigEndian.AppendUint32(resp, 5)
+		for _, peer := range s.peers {
+			resp = append(resp, peer.Compact()...)
+		}
+		return resp
+	case udpActionScrape:
+		resp := header(udpActionScrape)
+		for idx := 0; idx < (len(packet)-udpHeaderLength)/20; idx++ {
+			resp = binary.BigEndian.AppendUint32(resp, uint32(10+idx))
+			resp = binary.BigEndian.AppendUint32(resp, uint32(20+idx))
+			resp = binary.BigEndian.AppendUint32(resp, uint32(30+idx))
+		}
+		return resp
+	}
+	return append(header(udpActionError), "unknown action"...)
+}
+
+func (s *stubUDPTracker) dropNext(count int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.drop = count
+}
+
+func (s *stubUDPTracker) stats() (int, []uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.connects, append([]uint32(nil), s.actions...)
+}
+
+func newTestUDPTracker(t *testing.T, addr string) *UDPTracker {
+	tracker, err := NewUDPTracker(addr)
+	if err != nil {
+		t.Fatalf("failed to create tracker: %v", err)
+	}
+	t.Cleanup(func() { _ = tracker.Close() })
+	tracker.BaseTimeout = 50 * time.Millisecond
+	tracker.MaxRetries = 2
+	return tracker
+}
+
+func TestUDPTrackerAnnounce(t *testing.T) {
+	stub := newStubUDPTracker(t, &Peer{IP: net.IPv4(10, 0, 0, 1), Port: 6881}, &Peer{IP: net.IPv4(10, 0, 0, 2), Port: 51413})
+	tracker := newTestUDPTracker(t, stub.addr())
+
+	resp, err := tracker.Announce(AnnounceRequest{InfoHash: [20]byte{1}, PeerID: MyPeerID, Port: 6881, Left: 100, Event: EventStarted})
+	if err != nil {
+		t.Fatalf("failed to announce: %v", err)
+	}
+	if resp.Interval != 1800*time.Second || resp.Leechers != 3 || resp.Seeders != 5 {
+		t.Errorf("unexpected announce response %+v", resp)
+	}
+	if len(resp.Peers) != 2 || resp.Peers[0].String() != "10.0.0.1:6881" || resp.Peers[1].String() != "10.0.0.2:51413" {
+		t.Errorf("unexpected peers %v", resp.Peers)
+	}
+	connects, actions := stub.stats()
+	if connects != 1 || len(actions) != 2 || actions[0] != udpActionConnect || actions[1] != udpActionAnnounce {
+		t.Errorf("expected connect and announce, got %d connects and actions %v", connects, actions)
+	}
+}
+
+func TestUDPTrackerScrape(t *testing.T) {
+	stub := newStubUDPTracker(t)
+	tracker := newTestUDPTracker(t, stub.addr())
+
+	results, err := tracker.Scrape([20]byte{1}, [20]byte{2})
+	if err != nil {
+		t.Fatalf("failed to scrape: %v", err)
+	}
+	expected := []ScrapeResult{{Seeders: 10, Completed: 20, Leechers: 30}, {Seeders: 11, Completed: 21, Leechers: 31}}
+	if len(results) != len(expected) {
+		t.Fatalf("expected %d results got %d", len(expected), len(results))
+	}
+	for idx := range expected {
+		if results[idx] != expected[idx] {
+			t.Errorf("result %d: expected %+v got %+v", idx, expected[idx], results[idx])
+		}
+	}
+}
+
+func TestUDPTrackerConnectionIDIsReusedUntilExpiry(t *testing.T) {
+	stub := newStubUDPTracker(t)
+	tracker := newTestUDPTracker(t, stub.addr())
+
+	for idx := 0; idx < 2; idx++ {
+		if _, err := tracker.Scrape([20]byte{1}); err != nil {
+			t.Fatalf("failed to scrape: %v", err)
+		}
+	}
+	if connects, _ := stub.stats(); connects != 1 {
+		t.Fatalf("expected connection ID to be reused, got %d connects", connects)
+	}
+
+	tracker.mu.Lock()
+	tracker.connectionIDExpiry = time.Now().Add(-time.Second)
+	tracker.mu.Unlock()
+	if _, err := tracker.Scrape([20]byte{1}); err != nil {
+		t.Fatalf("failed to scrape after expiry: %v", err)
+	}
+	if connects, _ := stub.stats(); connects != 2 {
+		t.Fatalf("expected new connect after expiry, got %d connects", connects)
+	}
+}
+
+func TestUDPTrackerRetransmitsWithBackoff(t *testing.T) {
+	stub := newStubUDPTracker(t)
+	tracker := newTestUDPTracker(t, stub.addr())
+
+	// the first two attempts are lost, they wait 50ms and 100ms
+	stub.dropNext(2)
+	start := time.Now()
+	if _, err := tracker.Scrape([20]byte{1}); err != nil {
+		t.Fatalf("failed to scrape: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("expected backoff of at least 150ms, got %s", elapsed)
+	}
+	connects, actions := stub.stats()
+	if connects != 1 || len(actions) != 2 {
+		t.Errorf("expected one connect and one scrape to reach tracker, got %d connects and actions %v", connects, actions)
+	}
+}
+
+func TestUDPTrackerFailsAfterMaxRetries(t *testing.T) {
+	stub := newStubUDPTracker(t)
+	tracker := newTestUDPTracker(t, stub.addr())
+
+	stub.dropNext(tracker.MaxRetries + 1)
+	start := time.Now()
+	_, err := tracker.Scrape([20]byte{1})
+	if !errors.Is(err, errUDPTimeout) {
+		t.Fatalf("expected timeout error got %v", err)
+	}
+	// 50ms + 100ms + 200ms
+	if elapsed := time.Since(start); elapsed < 350*time.Millisecond {
+		t.Errorf("expected all retransmissions to be awaited, got %s", elapsed)
+	}
+}
+
+func TestUDPTrackerError(t *testing.T) {
+	stub := newStubUDPTracker(t)
+	tracker := newTestUDPTracker(t, stub.addr())
+
+	if _, err := tracker.Scrape([20]byte{1}); err != nil {
+		t.Fatalf("failed to scrape: %v", err)
+	}
+	// tracker forgot the connection ID, its error must be returned without retransmissions
+	stub.mu.Lock()
+	stub.connectionID = 0
+	stub.mu.Unlock()
+	if _, err := tracker.Scrape([20]byte{1}); err == nil {
+		t.Fatal("expected tracker error")
+	}
+}
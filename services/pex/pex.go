@@ -0,0 +1,161 @@
+package pex
+
+import (
+	"fmt"
+	"github.com/hihoak/torrent-cli/bencode"
+	"github.com/hihoak/torrent-cli/services/peers"
+	"time"
+)
+
+const (
+	// Interval is the minimal time between two PEX messages sent to one peer
+	Interval = time.Minute
+	// maxPeersPerMessage limits count of added and count of dropped peers in one message,
+	// the rest is sent next time
+	maxPeersPerMessage = 50
+)
+
+// Flags of added peers.
+const (
+	FlagEncryption = 0x01
+	FlagSeed       = 0x02
+	FlagUTP        = 0x04
+	FlagHolepunch  = 0x08
+	FlagReachable  = 0x10
+)
+
+type bencodeMessage struct {
+	Added       string `bencode:"added,omitempty"`
+	AddedFlags  string `bencode:"added.f,omitempty"`
+	Dropped     string `bencode:"dropped,omitempty"`
+	Added6      string `bencode:"added6,omitempty"`
+	Added6Flags string `bencode:"added6.f,omitempty"`
+	Dropped6    string `bencode:"dropped6,omitempty"`
+}
+
+// Peer is a connected peer which is shared with other peers.
+type Peer struct {
+	Addr  *peers.Peer
+	Flags byte
+}
+
+// Message is a list of peers which were connected and disconnected since the previous message.
+type Message struct {
+	Added   []Peer
+	Dropped []*peers.Peer
+}
+
+// Marshall encodes message to payload of ut_pex extended message.
+func Marshall(msg Message) ([]byte, error) {
+	var res bencodeMessage
+	for _, peer := range msg.Added {
+		if peer.Addr.IP.To4() != nil {
+			res.Added += string(peer.Addr.Compact())
+			res.AddedFlags += string([]byte{peer.Flags})
+		} else {
+			res.Added6 += string(peer.Addr.Compact())
+			res.Added6Flags += string([]byte{peer.Flags})
+		}
+	}
+	for _, peer := range msg.Dropped {
+		if peer.IP.To4() != nil {
+			res.Dropped += string(peer.Compact())
+		} else {
+			res.Dropped6 += string(peer.Compact())
+		}
+	}
+	data, err := bencode.Marshal(res)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshall PEX message: %w", err)
+	}
+	return data, nil
+}
+
+// Unmarshall decodes payload of ut_pex extended message. Flags are optional, peers without them get zero flags.
+func Unmarshall(data []byte) (Message, error) {
+	var raw bencodeMessage
+	if err := bencode.Unmarshal(data, &raw); err != nil {
+		return Message{}, fmt.Errorf("failed to unmarshall PEX message: %w", err)
+	}
+
+	var res Message
+	added, err := peers.ParseCompactPeers([]byte(raw.Added))
+	if err != nil {
+		return Message{}, fmt.Errorf("failed to parse added peers: %w", err)
+	}
+	res.Added = appendWithFlags(res.Added, added, raw.AddedFlags)
+	added6, err := peers.ParseCompactPeers6([]byte(raw.Added6))
+	if err != nil {
+		return Message{}, fmt.Errorf("failed to parse added IPv6 peers: %w", err)
+	}
+	res.Added = appendWithFlags(res.Added, added6, raw.Added6Flags)
+
+	dropped, err := peers.ParseCompactPeers([]byte(raw.Dropped))
+	if err != nil {
+		return Message{}, fmt.Errorf("failed to parse dropped peers: %w", err)
+	}
+	dropped6, err := peers.ParseCompactPeers6([]byte(raw.Dropped6))
+	if err != nil {
+		return Message{}, fmt.Errorf("failed to parse dropped IPv6 peers: %w", err)
+	}
+	res.Dropped = append(dropped, dropped6...)
+	return res, nil
+}
+
+func appendWithFlags(res []Peer, addrs []*peers.Peer, flags string) []Peer {
+	for idx, addr := range addrs {
+		peer := Peer{Addr: addr}
+		if idx < len(flags) {
+			peer.Flags = flags[idx]
+		}
+		res = append(res, peer)
+	}
+	return res
+}
+
+// Session keeps peers which were sent to one connected peer, so only changes are sent next time.
+type Session struct {
+	sent     map[string]Peer
+	lastSent time.Time
+}
+
+func NewSession() *Session {
+	return &Session{
+		sent: make(map[string]Peer),
+	}
+}
+
+// Due reports that Interval passed since the previous message, the first message may be sent at once.
+func (s *Session) Due(now time.Time) bool {
+	return s.lastSent.IsZero() || now.Sub(s.lastSent) >= Interval
+}
+
+// Update compares current peers with peers which were sent before and returns the difference which
+// must be sent at now. False is returned if nothing is changed.
+func (s *Session) Update(current []Peer, now time.Time) (Message, bool) {
+	var res Message
+	currentAddrs := make(map[string]bool, len(current))
+	for _, peer := range current {
+		addr := peer.Addr.String()
+		currentAddrs[addr] = true
+		if _, ok := s.sent[addr]; ok || len(res.Added) >= maxPeersPerMessage {
+			continue
+		}
+		s.sent[addr] = peer
+		res.Added = append(res.Added, peer)
+	}
+	for addr, peer := range s.sent {
+		if len(res.Dropped) >= maxPeersPerMessage {
+			break
+		}
+		if !currentAddrs[addr] {
+			delete(s.sent, addr)
+			res.Dropped = append(res.Dropped, peer.Addr)
+		}
+	}
+	if len(res.Added) == 0 && len(res.Dropped) == 0 {
+		return res, false
+	}
+	s.lastSent = now
+	return res, true
+}
@@ -0,0 +1,154 @@
+package pex
+
+import (
+	"github.com/hihoak/torrent-cli/bencode"
+	"github.com/hihoak/torrent-cli/services/peers"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testPeer(ip string, port uint16) *peers.Peer {
+	return &peers.Peer{IP: net.ParseIP(ip), Port: port}
+}
+
+func peerStrings(list []*peers.Peer) []string {
+	var res []string
+	for _, peer := range list {
+		res = append(res, peer.String())
+	}
+	return res
+}
+
+func addedStrings(list []Peer) ([]string, []byte) {
+	var (
+		addrs []string
+		flags []byte
+	)
+	for _, peer := range list {
+		addrs = append(addrs, peer.Addr.String())
+		flags = append(flags, peer.Flags)
+	}
+	return addrs, flags
+}
+
+func TestMarshallUnmarshall(t *testing.T) {
+	msg := Message{
+		Added: []Peer{
+			{Addr: testPeer("10.0.0.1", 6881), Flags: FlagSeed},
+			{Addr: testPeer("2001:db8::1", 51413), Flags: FlagEncryption | FlagReachable},
+			{Addr: testPeer("10.0.0.2", 6882)},
+		},
+		Dropped: []*peers.Peer{testPeer("10.0.0.3", 6883), testPeer("2001:db8::2", 6884)},
+	}
+	data, err := Marshall(msg)
+	if err != nil {
+		t.Fatalf("failed to marshall: %v", err)
+	}
+	var raw bencodeMessage
+	if err = bencode.Unmarshal(data, &raw); err != nil {
+		t.Fatalf("failed to decode payload: %v", err)
+	}
+	if len(raw.Added) != 12 || raw.AddedFlags != string([]byte{FlagSeed, 0}) ||
+		len(raw.Added6) != 18 || raw.Added6Flags != string([]byte{FlagEncryption | FlagReachable}) ||
+		len(raw.Dropped) != 6 || len(raw.Dropped6) != 18 {
+		t.Errorf("unexpected payload %q", data)
+	}
+
+	parsed, err := Unmarshall(data)
+	if err != nil {
+		t.Fatalf("failed to unmarshall: %v", err)
+	}
+	// IPv4 peers go before IPv6 peers
+	addrs, flags := addedStrings(parsed.Added)
+	if expected := []string{"10.0.0.1:6881", "10.0.0.2:6882", "[2001:db8::1]:51413"}; !reflect.DeepEqual(addrs, expected) {
+		t.Errorf("expected added %v got %v", expected, addrs)
+	}
+	if expected := []byte{FlagSeed, 0, FlagEncryption | FlagReachable}; !reflect.DeepEqual(flags, expected) {
+		t.Errorf("expected flags %v got %v", expected, flags)
+	}
+	if expected := []string{"10.0.0.3:6883", "[2001:db8::2]:6884"}; !reflect.DeepEqual(peerStrings(parsed.Dropped), expected) {
+		t.Errorf("expected dropped %v got %v", expected, peerStrings(parsed.Dropped))
+	}
+}
+
+func TestUnmarshallFlags(t *testing.T) {
+	added := string(testPeer("10.0.0.1", 1).Compact()) + string(testPeer("10.0.0.2", 2).Compact())
+	tests := []struct {
+		name     string
+		flags    string
+		expected []byte
+	}{
+		{name: "flags of every peer", flags: string([]byte{FlagSeed, FlagUTP}), expected: []byte{FlagSeed, FlagUTP}},
+		{name: "missed flags", flags: "", expected: []byte{0, 0}},
+		{name: "short flags", flags: string([]byte{FlagHolepunch}), expected: []byte{FlagHolepunch, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := bencode.Marshal(bencodeMessage{Added: added, AddedFlags: tt.flags})
+			if err != nil {
+				t.Fatalf("failed to marshall: %v", err)
+			}
+			msg, err := Unmarshall(data)
+			if err != nil {
+				t.Fatalf("failed to unmarshall: %v", err)
+			}
+			if _, flags := addedStrings(msg.Added); !reflect.DeepEqual(flags, tt.expected) {
+				t.Errorf("expected flags %v got %v", tt.expected, flags)
+			}
+		})
+	}
+}
+
+func TestUnmarshallMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  bencodeMessage
+	}{
+		{name: "added", msg: bencodeMessage{Added: "12345"}},
+		{name: "added6", msg: bencodeMessage{Added6: "1234567"}},
+		{name: "dropped", msg: bencodeMessage{Dropped: "1234567"}},
+		{name: "dropped6", msg: bencodeMessage{Dropped6: "12345678901234567"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := bencode.Marshal(tt.msg)
+			if err != nil {
+				t.Fatalf("failed to marshall: %v", err)
+			}
+			if msg, err := Unmarshall(data); err == nil {
+				t.Errorf("expected error got %+v", msg)
+			}
+		})
+	}
+	if msg, err := Unmarshall([]byte("not bencode")); err == nil {
+		t.Errorf("expected error got %+v", msg)
+	}
+}
+
+func TestSessionUpdate(t *testing.T) {
+	session := NewSession()
+	now := time.Now()
+	if !session.Due(now) {
+		t.Fatal("the first message must be due at once")
+	}
+	first, second := Peer{Addr: testPeer("10.0.0.1", 1)}, Peer{Addr: testPeer("10.0.0.2", 2)}
+	msg, changed := session.Update([]Peer{first, second}, now)
+	if addrs, _ := addedStrings(msg.Added); !changed || len(addrs) != 2 || len(msg.Dropped) != 0 {
+		t.Fatalf("expected both peers to be added got %+v, %t", msg, changed)
+	}
+	if session.Due(now.Add(Interval / 2)) {
+		t.Error("message must not be due before interval")
+	}
+
+	// the same peers with new pointers aren't sent again
+	if msg, changed = session.Update([]Peer{{Addr: testPeer("10.0.0.1", 1)}, {Addr: testPeer("10.0.0.2", 2)}}, now.Add(Interval)); changed {
+		t.Errorf("expected no changes got %+v", msg)
+	}
+
+	msg, changed = session.Update([]Peer{second}, now.Add(2*Interval))
+	if !changed || len(msg.Added) != 0 || !reflect.DeepEqual(peerStrings(msg.Dropped), []string{"10.0.0.1:1"}) {
+		t.Errorf("expected the first peer to be dropped got %+v, %t", msg, changed)
+	}
+}
@@ -0,0 +1,97 @@
+package resume
+
+import (
+	"errors"
+	"fmt"
+	"github.com/hihoak/torrent-cli/bencode"
+	"github.com/hihoak/torrent-cli/client/torrent"
+	torrent_file_decoder "github.com/hihoak/torrent-cli/services/torrent-file-decoder"
+	"os"
+	"path/filepath"
+)
+
+const resumeFileExtension = ".resume"
+
+var (
+	ErrStateMismatch = errors.New("resume state doesn't match torrent")
+	// ErrCorrupted is returned for resume file which can't be decoded, for example truncated by crash
+	ErrCorrupted = errors.New("resume file is corrupted")
+)
+
+type bencodeState struct {
+	InfoHash    string `bencode:"info hash"`
+	PieceLength int    `bencode:"piece length"`
+	FileSizes   []int  `bencode:"file sizes"`
+	Bitfield    string `bencode:"bitfield"`
+}
+
+// Path returns location of resume file for torrent which data is stored in baseDir.
+func Path(torrentFile *torrent_file_decoder.TorrentFile, baseDir string) string {
+	return filepath.Join(baseDir, torrentFile.Name+resumeFileExtension)
+}
+
+// Load reads bitfield of completed pieces from resume file. If file doesn't exist
+// empty bitfield is returned.
+func Load(path string, torrentFile *torrent_file_decoder.TorrentFile) (torrent.Bitfield, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return torrent.NewBitfield(len(torrentFile.PieceHashes)), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read resume file %q: %w", path, err)
+	}
+
+	state := bencodeState{}
+	if unmarshallErr := bencode.Unmarshal(data, &state); unmarshallErr != nil {
+		return nil, fmt.Errorf("%w: failed to unmarshall resume file %q: %w", ErrCorrupted, path, unmarshallErr)
+	}
+
+	if state.InfoHash != string(torrentFile.VerifyHash[:]) {
+		return nil, fmt.Errorf("%w: info hash is different", ErrStateMismatch)
+	}
+	if state.PieceLength != torrentFile.PieceLength {
+		return nil, fmt.Errorf("%w: piece length %d expect %d", ErrStateMismatch, state.PieceLength, torrentFile.PieceLength)
+	}
+	if len(state.FileSizes) != len(torrentFile.Files) {
+		return nil, fmt.Errorf("%w: count of files %d expect %d", ErrStateMismatch, len(state.FileSizes), len(torrentFile.Files))
+	}
+	for idx, file := range torrentFile.Files {
+		if state.FileSizes[idx] != file.Length {
+			return nil, fmt.Errorf("%w: size of file %v is %d expect %d", ErrStateMismatch, file.Path, state.FileSizes[idx], file.Length)
+		}
+	}
+	bitfield := torrent.NewBitfield(len(torrentFile.PieceHashes))
+	if len(state.Bitfield) != len(bitfield) {
+		return nil, fmt.Errorf("%w: bitfield length %d expect %d", ErrStateMismatch, len(state.Bitfield), len(bitfield))
+	}
+	copy(bitfield, state.Bitfield)
+
+	return bitfield, nil
+}
+
+// Save atomically writes bitfield of completed pieces to resume file.
+func Save(path string, torrentFile *torrent_file_decoder.TorrentFile, bitfield torrent.Bitfield) error {
+	state := bencodeState{
+		InfoHash:    string(torrentFile.VerifyHash[:]),
+		PieceLength: torrentFile.PieceLength,
+		FileSizes:   make([]int, 0, len(torrentFile.Files)),
+		Bitfield:    string(bitfield),
+	}
+	for _, file := range torrentFile.Files {
+		state.FileSizes = append(state.FileSizes, file.Length)
+	}
+
+	data, err := bencode.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to marshall resume state: %w", err)
+	}
+
+	tmpPath := path + ".tmp"
+	if err = os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write resume file %q: %w", tmpPath, err)
+	}
+	if err = os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to replace resume file %q: %w", path, err)
+	}
+	return nil
+}
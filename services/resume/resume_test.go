@@ -0,0 +1,126 @@
+package resume
+
+import (
+	"bytes"
+	"errors"
+	"github.com/hihoak/torrent-cli/client/torrent"
+	torrent_file_decoder "github.com/hihoak/torrent-cli/services/torrent-file-decoder"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestTorrentFile() *torrent_file_decoder.TorrentFile {
+	return &torrent_file_decoder.TorrentFile{
+		Name:        "data",
+		VerifyHash:  [20]byte{1, 2, 3},
+		PieceLength: 16384,
+		PieceHashes: make([][20]byte, 10),
+		Length:      10*16384 - 100,
+		Files: []torrent_file_decoder.File{
+			{Path: []string{"a"}, Length: 100000},
+			{Path: []string{"b"}, Length: 10*16384 - 100 - 100000, Offset: 100000},
+		},
+		MultiFile: true,
+	}
+}
+
+func TestSaveAndLoad(t *testing.T) {
+	torrentFile := newTestTorrentFile()
+	path := Path(torrentFile, t.TempDir())
+	if filepath.Base(path) != "data.resume" {
+		t.Errorf("unexpected path of resume file %q", path)
+	}
+
+	bitfield, err := Load(path, torrentFile)
+	if err != nil {
+		t.Fatalf("failed to load missed resume file: %v", err)
+	}
+	if !bitfield.IsEmpty() || len(bitfield) != len(torrent.NewBitfield(10)) {
+		t.Fatalf("expected empty bitfield got %v", bitfield)
+	}
+
+	for _, idx := range []int{0, 3, 9} {
+		bitfield.SetPiece(idx)
+	}
+	if err = Save(path, torrentFile, bitfield); err != nil {
+		t.Fatalf("failed to save: %v", err)
+	}
+	if _, err = os.Stat(path + ".tmp"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected temporary file to be renamed, got %v", err)
+	}
+	loaded, err := Load(path, torrentFile)
+	if err != nil {
+		t.Fatalf("failed to load: %v", err)
+	}
+	if !bytes.Equal(loaded, bitfield) {
+		t.Errorf("expected bitfield %v got %v", bitfield, loaded)
+	}
+}
+
+func TestLoadRejectsStateOfAnotherTorrent(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(torrentFile *torrent_file_decoder.TorrentFile)
+	}{
+		{name: "info hash", change: func(torrentFile *torrent_file_decoder.TorrentFile) {
+			torrentFile.VerifyHash = [20]byte{4, 5, 6}
+		}},
+		{name: "piece length", change: func(torrentFile *torrent_file_decoder.TorrentFile) {
+			torrentFile.PieceLength *= 2
+		}},
+		{name: "size of file", change: func(torrentFile *torrent_file_decoder.TorrentFile) {
+			torrentFile.Files[1].Length++
+		}},
+		{name: "count of files", change: func(torrentFile *torrent_file_decoder.TorrentFile) {
+			torrentFile.Files = torrentFile.Files[:1]
+		}},
+		{name: "count of pieces", change: func(torrentFile *torrent_file_decoder.TorrentFile) {
+			torrentFile.PieceHashes = make([][20]byte, 20)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			torrentFile := newTestTorrentFile()
+			path := Path(torrentFile, t.TempDir())
+			bitfield := torrent.NewBitfield(len(torrentFile.PieceHashes))
+			bitfield.SetPiece(1)
+			if err := Save(path, torrentFile, bitfield); err != nil {
+				t.Fatalf("failed to save: %v", err)
+			}
+
+			// completed pieces of another torrent must be checked again, so state isn't returned
+			tt.change(torrentFile)
+			loaded, err := Load(path, torrentFile)
+			if !errors.Is(err, ErrStateMismatch) {
+				t.Fatalf("expected state mismatch got %v", err)
+			}
+			if loaded != nil {
+				t.Errorf("expected no bitfield got %v", loaded)
+			}
+		})
+	}
+}
+
+func TestLoadDetectsCorruptedFile(t *testing.T) {
+	torrentFile := newTestTorrentFile()
+	path := Path(torrentFile, t.TempDir())
+	bitfield := torrent.NewBitfield(len(torrentFile.PieceHashes))
+	bitfield.SetPiece(5)
+	if err := Save(path, torrentFile, bitfield); err != nil {
+		t.Fatalf("failed to save: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+
+	for _, corrupted := range [][]byte{data[:len(data)/2], []byte("garbage"), {}} {
+		if err = os.WriteFile(path, corrupted, 0644); err != nil {
+			t.Fatalf("failed to write: %v", err)
+		}
+		if _, err = Load(path, torrentFile); !errors.Is(err, ErrCorrupted) {
+			t.Errorf("%q: expected corrupted file error got %v", corrupted, err)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package seeder
+
+import (
+	"fmt"
+	"github.com/hihoak/torrent-cli/client/torrent"
+	"github.com/hihoak/torrent-cli/services/peers"
+	"github.com/hihoak/torrent-cli/services/storage"
+	torrent_file_decoder "github.com/hihoak/torrent-cli/services/torrent-file-decoder"
+	"github.com/hihoak/torrent-cli/services/uploader"
+	log "github.com/rs/zerolog/log"
+	"sync"
+	"time"
+)
+
+const (
+	// announceRetryInterval is used when trackers failed or didn't return an interval
+	announceRetryInterval = time.Minute
+	ratioCheckInterval    = 5 * time.Second
+)
+
+type Config struct {
+	// Port is a port on which incoming peers are accepted, it is announced to trackers
+	Port uint16
+	// MaxRatio stops seeding when uploaded bytes reach MaxRatio * size of the torrent, 0 means no limit
+	MaxRatio float64
+	// MaxDuration stops seeding after this time, 0 means no limit
+	MaxDuration time.Duration
+}
+
+// Seeder uploads verified data of the torrent to peers which connect to us.
+type Seeder struct {
+	torrentFile *torrent_file_decoder.TorrentFile
+	config      Config
+	uploader    *uploader.Uploader
+	trackers    *peers.TrackerList
+	bitfield    torrent.Bitfield
+
+	mu      sync.Mutex
+	clients map[*torrent.Client]struct{}
+	stopped bool
+	// uploaded is a count of bytes uploaded to peers which are already disconnected
+	uploaded int64
+}
+
+// NewSeeder creates seeder for storage which must contain all pieces of the torrent.
+func NewSeeder(torrentFile *torrent_file_decoder.TorrentFile, storage storage.Storage, config Config) *Seeder {
+	bitfield := torrent.NewBitfield(len(torrentFile.PieceHashes))
+	for idx := range torrentFile.PieceHashes {
+		bitfield.SetPiece(idx)
+	}
+	s := &Seeder{
+		torrentFile: torrentFile,
+		config:      config,
+		trackers:    peers.NewTrackerList(torrentFile.AnnounceList),
+		bitfield:    bitfield,
+		clients:     make(map[*torrent.Client]struct{}),
+	}
+	s.uploader = uploader.NewUploader(torrentFile, storage, s)
+	if torrentFile.Private {
+		torrent.DefaultExtensions.Disable(torrentFile.VerifyHash, torrent.ExtensionPEX)
+	}
+	torrent.DefaultExtensions.SetMetadata(torrentFile.VerifyHash, torrentFile.RawInfo)
+	return s
+}
+
+func (s *Seeder) HasPiece(id int) bool {
+	return id >= 0 && id < len(s.torrentFile.PieceHashes)
+}
+
+func (s *Seeder) IsComplete() bool {
+	return true
+}
+
+func (s *Seeder) Bitfield() torrent.Bitfield {
+	res := make(torrent.Bitfield, len(s.bitfield))
+	copy(res, s.bitfield)
+	return res
+}
+
+// Uploaded returns count of bytes uploaded to all peers.
+func (s *Seeder) Uploaded() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := s.uploaded
+	for client := range s.clients {
+		res += client.Uploaded()
+	}
+	return res
+}
+
+// AddPeer serves peer which connected to us.
+func (s *Seeder) AddPeer(client *torrent.Client) {
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		if closeErr := client.Close(); closeErr != nil {
+			log.Error().Err(closeErr).Msg("failed to close connection to peer")
+		}
+		return
+	}
+	s.clients[client] = struct{}{}
+	s.mu.Unlock()
+
+	go func() {
+		defer s.removePeer(client)
+		if err := s.servePeer(client); err != nil {
+			log.Debug().Err(err).Msgf("stop uploading to peer %s", client.RemoteAddr())
+		}
+	}()
+}
+
+func (s *Seeder) removePeer(client *torrent.Client) {
+	if closeErr := client.Close(); closeErr != nil {
+		log.Debug().Err(closeErr).Msg("failed to close connection to peer")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.clients[client]; ok {
+		delete(s.clients, client)
+		s.uploaded += client.Uploaded()
+	}
+}
+
+func (s *Seeder) servePeer(client *torrent.Client) error {
+	if err := client.ReceiveBitfield(len(s.torrentFile.PieceHashes)); err != nil {
+		return fmt.Errorf("failed to retrieve bitfield: %w", err)
+	}
+	upload := s.uploader.AddPeer(client)
+	defer upload.Close()
+
+	client.SetIdleTimeout(torrent.IdleTimeout)
+	keepAliveStop := make(chan struct{})
+	defer close(keepAliveStop)
+	go client.KeepAlive(keepAliveStop)
+
+	for {
+		if s.isSeed(client) {
+			log.Debug().Msgf("disconnect from peer %s because it is a seed", client.RemoteAddr())
+			return nil
+		}
+
+		msg, err := client.ReadMessage()
+		if err != nil {
+			return fmt.Errorf("failed to read message: %w", err)
+		}
+		if msg == nil {
+			continue
+		}
+
+		switch msg.ID {
+		case torrent.MsgHave:
+			index, parseErr := msg.ParseHave()
+			if parseErr != nil {
+				return fmt.Errorf("failed to parse %d message: %w", torrent.MsgHave, parseErr)
+			}
+			client.SetPieceToDownload(index)
+		case torrent.MsgExtended:
+			if _, _, extendedErr := client.HandleExtended(msg); extendedErr != nil {
+				return fmt.Errorf("failed to handle extended message: %w", extendedErr)
+			}
+		default:
+			if _, uploadErr := upload.HandleMessage(msg); uploadErr != nil {
+				return fmt.Errorf("failed to handle message %d: %w", msg.ID, uploadErr)
+			}
+		}
+	}
+}
+
+// isSeed reports that peer has all pieces, so it won't download anything from us.
+func (s *Seeder) isSeed(client *torrent.Client) bool {
+	for idx := range s.torrentFile.PieceHashes {
+		if !client.HasPieceToDownload(idx) {
+			return false
+		}
+	}
+	return true
+}
+
+// Seed uploads data until stop is closed or one of the limits is reached. Trackers are notified
+// that we have all data at start and that we stopped at the end.
+func (s *Seeder) Seed(stop <-chan struct{}) {
+	uploaderStop := make(chan struct{})
+	go s.uploader.Run(uploaderStop)
+
+	nextAnnounce := time.NewTimer(s.announce(peers.EventCompleted))
+	defer nextAnnounce.Stop()
+	ratioTicker := time.NewTicker(ratioCheckInterval)
+	defer ratioTicker.Stop()
+	var timeLimit <-chan time.Time
+	if s.config.MaxDuration > 0 {
+		timeLimitTimer := time.NewTimer(s.config.MaxDuration)
+		defer timeLimitTimer.Stop()
+		timeLimit = timeLimitTimer.C
+	}
+
+loop:
+	for {
+		select {
+		case <-stop:
+			log.Info().Msg("stop seeding")
+			break loop
+		case <-nextAnnounce.C:
+			nextAnnounce.Reset(s.announce(peers.EventNone))
+		case <-timeLimit:
+			log.Info().Msgf("stop seeding: time limit %s is reached", s.config.MaxDuration)
+			break loop
+		case <-ratioTicker.C:
+			if s.config.MaxRatio > 0 && s.Ratio() >= s.config.MaxRatio {
+				log.Info().Msgf("stop seeding: ratio %.2f is reached", s.config.MaxRatio)
+				break loop
+			}
+		}
+	}
+
+	close(uploaderStop)
+	s.mu.Lock()
+	s.stopped = true
+	for client := range s.clients {
+		if closeErr := client.Close(); closeErr != nil {
+			log.Debug().Err(closeErr).Msg("failed to close connection to peer")
+		}
+	}
+	s.mu.Unlock()
+	s.announce(peers.EventStopped)
+}
+
+// Ratio returns uploaded bytes divided by size of the torrent.
+func (s *Seeder) Ratio() float64 {
+	if s.torrentFile.Length == 0 {
+		return 0
+	}
+	return float64(s.Uploaded()) / float64(s.torrentFile.Length)
+}
+
+// announce notifies trackers about us and returns interval after which next announce must be sent.
+func (s *Seeder) announce(event peers.Event) time.Duration {
+	if len(s.torrentFile.AnnounceList) == 0 {
+		return announceRetryInterval
+	}
+	resp, err := s.trackers.Announce(peers.AnnounceRequest{
+		InfoHash: s.torrentFile.VerifyHash,
+		PeerID:   peers.MyPeerID,
+		Port:     s.config.Port,
+		Uploaded: s.Uploaded(),
+		Left:     0,
+		Event:    event,
+	})
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to announce to trackers")
+		return announceRetryInterval
+	}
+	log.Info().Msgf("announced to trackers: %d seeders, %d leechers", resp.Seeders, resp.Leechers)
+	if resp.Interval <= 0 {
+		return announceRetryInterval
+	}
+	return resp.Interval
+}
@@ -0,0 +1,156 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	torrent_file_decoder "github.com/hihoak/torrent-cli/services/torrent-file-decoder"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Storage keeps data of the torrent. Offsets are positions in the concatenated stream
+// of all pieces, so piece with index i starts at i * PieceLength.
+type Storage interface {
+	io.WriterAt
+	io.ReaderAt
+	io.Closer
+}
+
+// ErrMissingData is returned when requested data belongs to file which doesn't exist.
+var ErrMissingData = errors.New("file of torrent is missing")
+
+type storageFile struct {
+	info torrent_file_decoder.File
+	file *os.File
+}
+
+// FileStorage is a Storage that places files of the torrent on the filesystem
+// the same way as they described in torrent file.
+type FileStorage struct {
+	files []storageFile
+}
+
+func NewFileStorage(torrentFile *torrent_file_decoder.TorrentFile, baseDir string) (*FileStorage, error) {
+	s := &FileStorage{
+		files: make([]storageFile, 0, len(torrentFile.Files)),
+	}
+	for _, info := range torrentFile.Files {
+		path := torrentFile.LocalPath(baseDir, info)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			_ = s.Close()
+			return nil, fmt.Errorf("failed to create directory for file %q: %w", path, err)
+		}
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+		if err != nil {
+			_ = s.Close()
+			return nil, fmt.Errorf("failed to open file %q: %w", path, err)
+		}
+		s.files = append(s.files, storageFile{info: info, file: file})
+	}
+	return s, nil
+}
+
+// OpenFileStorage opens already existing files of the torrent only for reading.
+// Missing files are not created, reading of their data returns ErrMissingData.
+func OpenFileStorage(torrentFile *torrent_file_decoder.TorrentFile, baseDir string) (*FileStorage, error) {
+	s := &FileStorage{
+		files: make([]storageFile, 0, len(torrentFile.Files)),
+	}
+	for _, info := range torrentFile.Files {
+		path := torrentFile.LocalPath(baseDir, info)
+		file, err := os.Open(path)
+		if errors.Is(err, os.ErrNotExist) {
+			s.files = append(s.files, storageFile{info: info})
+			continue
+		}
+		if err != nil {
+			_ = s.Close()
+			return nil, fmt.Errorf("failed to open file %q: %w", path, err)
+		}
+		s.files = append(s.files, storageFile{info: info, file: file})
+	}
+	return s, nil
+}
+
+// forEachChunk calls fn for every part of [off, off+length) that belongs to a single file.
+// pos is a position inside of the file and bufOffset is a position inside of the caller buffer.
+func (s *FileStorage) forEachChunk(off int64, length int, fn func(file storageFile, pos int64, bufOffset, chunkLength int) error) error {
+	end := off + int64(length)
+	for _, file := range s.files {
+		fileStart := int64(file.info.Offset)
+		fileEnd := fileStart + int64(file.info.Length)
+		if fileEnd <= off || fileStart >= end {
+			continue
+		}
+		if file.file == nil {
+			return fmt.Errorf("%w: %v", ErrMissingData, file.info.Path)
+		}
+		chunkStart := off
+		if fileStart > chunkStart {
+			chunkStart = fileStart
+		}
+		chunkEnd := end
+		if fileEnd < chunkEnd {
+			chunkEnd = fileEnd
+		}
+		if err := fn(file, chunkStart-fileStart, int(chunkStart-off), int(chunkEnd-chunkStart)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *FileStorage) WriteAt(p []byte, off int64) (int, error) {
+	written := 0
+	err := s.forEachChunk(off, len(p), func(file storageFile, pos int64, bufOffset, chunkLength int) error {
+		n, err := file.file.WriteAt(p[bufOffset:bufOffset+chunkLength], pos)
+		written += n
+		if err != nil {
+			return fmt.Errorf("failed to write to file %q: %w", file.file.Name(), err)
+		}
+		return nil
+	})
+	if err != nil {
+		return written, err
+	}
+	if written < len(p) {
+		return written, fmt.Errorf("failed to write %d bytes at offset %d: out of torrent bounds", len(p), off)
+	}
+	return written, nil
+}
+
+func (s *FileStorage) ReadAt(p []byte, off int64) (int, error) {
+	read := 0
+	err := s.forEachChunk(off, len(p), func(file storageFile, pos int64, bufOffset, chunkLength int) error {
+		n, err := file.file.ReadAt(p[bufOffset:bufOffset+chunkLength], pos)
+		read += n
+		if err != nil {
+			if err == io.EOF {
+				return io.ErrUnexpectedEOF
+			}
+			return fmt.Errorf("failed to read from file %q: %w", file.file.Name(), err)
+		}
+		return nil
+	})
+	if err != nil {
+		return read, err
+	}
+	if read < len(p) {
+		return read, io.EOF
+	}
+	return read, nil
+}
+
+func (s *FileStorage) Close() error {
+	var closeErr error
+	for _, file := range s.files {
+		if file.file == nil {
+			continue
+		}
+		if err := file.file.Close(); err != nil && closeErr == nil {
+			closeErr = fmt.Errorf("failed to close file %q: %w", file.file.Name(), err)
+		}
+	}
+	return closeErr
+}
@@ -0,0 +1,67 @@
+package torrent_file_decoder
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"github.com/hihoak/torrent-cli/bencode"
+)
+
+// EncodeInfo builds info dictionary from files, pieces and Private flag of the torrent
+// and updates RawInfo and VerifyHash.
+func (t *TorrentFile) EncodeInfo() error {
+	info := bencodeTorrentInfo{
+		PieceLength: t.PieceLength,
+		Name:        t.Name,
+	}
+	pieces := make([]byte, 0, len(t.PieceHashes)*20)
+	for _, hash := range t.PieceHashes {
+		pieces = append(pieces, hash[:]...)
+	}
+	info.Pieces = string(pieces)
+	if t.Private {
+		info.Private = 1
+	}
+	if t.MultiFile {
+		info.Files = make([]bencodeFileInfo, 0, len(t.Files))
+		for _, file := range t.Files {
+			info.Files = append(info.Files, bencodeFileInfo{Length: file.Length, Path: file.Path})
+		}
+	} else {
+		info.Length = t.Length
+	}
+
+	rawInfo, err := bencode.Marshal(info)
+	if err != nil {
+		return fmt.Errorf("failed to marshall info dictionary: %w", err)
+	}
+	t.RawInfo = rawInfo
+	t.VerifyHash = sha1.Sum(rawInfo)
+	return nil
+}
+
+// Marshall encodes torrent file. Info dictionary is taken from RawInfo as is, so info hash
+// of encoded torrent is equal to VerifyHash.
+func Marshall(t *TorrentFile) ([]byte, error) {
+	if len(t.RawInfo) == 0 {
+		return nil, fmt.Errorf("torrent file has no encoded info dictionary")
+	}
+	res := bencodeTorrentFile{
+		Announce:  t.Announce,
+		Comment:   t.Comment,
+		CreatedBy: t.CreatedBy,
+		RawInfo:   t.RawInfo,
+	}
+	if res.Announce == "" && len(t.AnnounceList) > 0 && len(t.AnnounceList[0]) > 0 {
+		res.Announce = t.AnnounceList[0][0]
+	}
+	if len(t.AnnounceList) > 1 || (len(t.AnnounceList) == 1 && len(t.AnnounceList[0]) > 1) {
+		res.AnnounceList = t.AnnounceList
+	}
+	if !t.CreationDate.IsZero() {
+		res.CreationDate = t.CreationDate.Unix()
+	}
+	if len(t.WebSeeds) > 0 {
+		res.URLList = t.WebSeeds
+	}
+	return bencode.Marshal(res)
+}
@@ -4,31 +4,42 @@ import (
 	"bytes"
 	"crypto/sha1"
 	"fmt"
-	"github.com/jackpal/bencode-go"
+	"github.com/hihoak/torrent-cli/bencode"
 	"io"
-	"net/url"
+	"net"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type bencodeTorrentFile struct {
-	Announce string             `bencode:"announce"`
-	Info     bencodeTorrentInfo `bencode:"info"`
+	Announce     string     `bencode:"announce,omitempty"`
+	AnnounceList [][]string `bencode:"announce-list,omitempty"`
+	Comment      string     `bencode:"comment,omitempty"`
+	CreatedBy    string     `bencode:"created by,omitempty"`
+	CreationDate int64      `bencode:"creation date,omitempty"`
+	// URLList is a list of web seeds (BEP 19), it may be a single string or a list of strings
+	URLList interface{} `bencode:"url-list,omitempty"`
+	// Nodes are DHT nodes of trackerless torrent (BEP 5), every node is a list of host and port
+	Nodes []interface{} `bencode:"nodes,omitempty"`
+	// RawInfo keeps exact bytes of info dictionary, info hash is calculated from them
+	RawInfo bencode.RawMessage `bencode:"info"`
+	Info    bencodeTorrentInfo `bencode:"-"`
 }
 
 type bencodeTorrentInfo struct {
-	Pieces      string `bencode:"pieces"`
-	PieceLength int    `bencode:"piece length"`
-	Length      int    `bencode:"length"`
-	Name        string `bencode:"name"`
+	Pieces      string            `bencode:"pieces"`
+	PieceLength int               `bencode:"piece length"`
+	Length      int               `bencode:"length,omitempty"`
+	Files       []bencodeFileInfo `bencode:"files,omitempty"`
+	Name        string            `bencode:"name"`
+	Private     int               `bencode:"private,omitempty"`
 }
 
-func (b *bencodeTorrentFile) CalculateVerifyHash() ([20]byte, error) {
-	var buf bytes.Buffer
-	err := bencode.Marshal(&buf, b.Info)
-	if err != nil {
-		return [20]byte{}, fmt.Errorf("failed to marshall torrent info into bencode: %w", err)
-	}
-	return sha1.Sum(buf.Bytes()), nil
+type bencodeFileInfo struct {
+	Length int      `bencode:"length"`
+	Path   []string `bencode:"path"`
 }
 
 func (b *bencodeTorrentFile) convertPiecesToSlice() ([][20]byte, error) {
@@ -43,70 +54,255 @@ func (b *bencodeTorrentFile) convertPiecesToSlice() ([][20]byte, error) {
 	return res, nil
 }
 
+// IsValidPathSegment reports that segment can be used as a name of the torrent or a part of path of its file.
+func IsValidPathSegment(segment string) bool {
+	if segment == "" || segment == "." || segment == ".." {
+		return false
+	}
+	return !strings.ContainsAny(segment, "/\\\x00")
+}
+
+func (b *bencodeTorrentFile) convertFilesToSlice() ([]File, int, error) {
+	if !IsValidPathSegment(b.Info.Name) {
+		return nil, 0, fmt.Errorf("invalid torrent name %q", b.Info.Name)
+	}
+	if len(b.Info.Files) == 0 {
+		if b.Info.Length < 0 {
+			return nil, 0, fmt.Errorf("negative length %d of file %q", b.Info.Length, b.Info.Name)
+		}
+		return []File{{Path: []string{b.Info.Name}, Length: b.Info.Length, Offset: 0}}, b.Info.Length, nil
+	}
+	res := make([]File, 0, len(b.Info.Files))
+	offset := 0
+	for _, file := range b.Info.Files {
+		if len(file.Path) == 0 {
+			return nil, 0, fmt.Errorf("file with empty path in files list")
+		}
+		for _, segment := range file.Path {
+			if !IsValidPathSegment(segment) {
+				return nil, 0, fmt.Errorf("invalid path segment %q in file %v", segment, file.Path)
+			}
+		}
+		if file.Length < 0 {
+			return nil, 0, fmt.Errorf("negative length %d of file %v", file.Length, file.Path)
+		}
+		res = append(res, File{Path: file.Path, Length: file.Length, Offset: offset})
+		offset += file.Length
+	}
+	return res, offset, nil
+}
+
+// convertAnnounceList returns tiers of trackers without empty ones. If torrent has no announce-list
+// announce is the only tier.
+func (b *bencodeTorrentFile) convertAnnounceList() [][]string {
+	res := make([][]string, 0, len(b.AnnounceList))
+	for _, tier := range b.AnnounceList {
+		trackers := make([]string, 0, len(tier))
+		for _, tracker := range tier {
+			if tracker != "" {
+				trackers = append(trackers, tracker)
+			}
+		}
+		if len(trackers) > 0 {
+			res = append(res, trackers)
+		}
+	}
+	if len(res) == 0 && b.Announce != "" {
+		res = append(res, []string{b.Announce})
+	}
+	return res
+}
+
+func (b *bencodeTorrentFile) convertURLList() []string {
+	switch urls := b.URLList.(type) {
+	case string:
+		if urls != "" {
+			return []string{urls}
+		}
+	case []interface{}:
+		res := make([]string, 0, len(urls))
+		for _, rawURL := range urls {
+			if webSeed, ok := rawURL.(string); ok && webSeed != "" {
+				res = append(res, webSeed)
+			}
+		}
+		return res
+	}
+	return nil
+}
+
+// convertNodes returns DHT nodes in "host:port" form, malformed nodes are skipped.
+func (b *bencodeTorrentFile) convertNodes() []string {
+	res := make([]string, 0, len(b.Nodes))
+	for _, rawNode := range b.Nodes {
+		pair, ok := rawNode.([]interface{})
+		if !ok || len(pair) != 2 {
+			continue
+		}
+		host, hostOk := pair[0].(string)
+		port, portOk := pair[1].(int64)
+		if !hostOk || !portOk || host == "" || port <= 0 || port > 65535 {
+			continue
+		}
+		res = append(res, net.JoinHostPort(host, strconv.FormatInt(port, 10)))
+	}
+	return res
+}
+
+// validatePieces checks that count of piece hashes matches length of data, so every piece has
+// positive size.
+func validatePieces(pieceLength, countOfPieces, length int) error {
+	if pieceLength <= 0 {
+		return fmt.Errorf("piece length must be positive, got %d", pieceLength)
+	}
+	if expected := (length + pieceLength - 1) / pieceLength; countOfPieces != expected {
+		return fmt.Errorf("got %d piece hashes, expected %d for %d bytes in pieces of %d bytes",
+			countOfPieces, expected, length, pieceLength)
+	}
+	return nil
+}
+
 func (b *bencodeTorrentFile) toTorrentFile() (*TorrentFile, error) {
+	if len(b.RawInfo) == 0 {
+		return nil, fmt.Errorf("torrent has no info dictionary")
+	}
+	if err := bencode.Unmarshal(b.RawInfo, &b.Info); err != nil {
+		return nil, fmt.Errorf("failed to unmarshall info dictionary: %w", err)
+	}
 	pieceHashes, err := b.convertPiecesToSlice()
 	if err != nil {
 		return nil, fmt.Errorf("failed convert bencode torrent file to torrent file struct: %w", err)
 	}
-	verifyHash, err := b.CalculateVerifyHash()
+	files, length, err := b.convertFilesToSlice()
 	if err != nil {
-		return nil, fmt.Errorf("failed to calculate verify hash: %w", err)
+		return nil, fmt.Errorf("failed to convert files of torrent: %w", err)
+	}
+	if err = validatePieces(b.Info.PieceLength, len(pieceHashes), length); err != nil {
+		return nil, fmt.Errorf("invalid pieces of torrent: %w", err)
 	}
 	res := TorrentFile{
-		Announce:    b.Announce,
-		VerifyHash:  verifyHash,
-		PieceHashes: pieceHashes,
-		PieceLength: b.Info.PieceLength,
-		Length:      b.Info.Length,
-		Name:        b.Info.Name,
+		Announce:     b.Announce,
+		AnnounceList: b.convertAnnounceList(),
+		VerifyHash:   sha1.Sum(b.RawInfo),
+		PieceHashes:  pieceHashes,
+		PieceLength:  b.Info.PieceLength,
+		Length:       length,
+		Name:         b.Info.Name,
+		Files:        files,
+		MultiFile:    len(b.Info.Files) > 0,
+		Private:      b.Info.Private == 1,
+		RawInfo:      b.RawInfo,
+		Comment:      b.Comment,
+		CreatedBy:    b.CreatedBy,
+		WebSeeds:     b.convertURLList(),
+		Nodes:        b.convertNodes(),
+	}
+	if b.CreationDate > 0 {
+		res.CreationDate = time.Unix(b.CreationDate, 0)
 	}
 
 	return &res, nil
 }
 
+// File is a single file of the torrent. Offset is the position of the first byte
+// of the file in the concatenated stream of all pieces.
+type File struct {
+	Path   []string
+	Length int
+	Offset int
+}
+
 type TorrentFile struct {
-	Announce    string
-	VerifyHash  [20]byte
-	PieceHashes [][20]byte
-	PieceLength int    `bencode:"piece length"`
-	Length      int    `bencode:"length"`
-	Name        string `bencode:"name"`
+	Announce string
+	// AnnounceList is a list of tiers of trackers (BEP 12), it always contains Announce
+	// if torrent has no announce-list.
+	AnnounceList [][]string
+	VerifyHash   [20]byte
+	PieceHashes  [][20]byte
+	PieceLength  int    `bencode:"piece length"`
+	Length       int    `bencode:"length"`
+	Name         string `bencode:"name"`
+	Files        []File
+	// MultiFile is true when torrent has "files" list, in that case all files are placed
+	// into directory named after Name.
+	MultiFile bool
+	// Private forbids to get peers from other sources than trackers (BEP 27)
+	Private bool
+	// RawInfo is bencoded info dictionary from which VerifyHash is calculated
+	RawInfo []byte
+
+	Comment      string
+	CreatedBy    string
+	CreationDate time.Time
+	WebSeeds     []string
+	// Nodes are addresses of DHT nodes in "host:port" form which are used to join DHT
+	Nodes []string
 }
 
+// Unmarshall decodes torrent file. Info hash is calculated from the exact bytes of info
+// dictionary, so keys which are not decoded are taken into account too.
 func Unmarshall(data io.Reader) (*TorrentFile, error) {
 	var res bencodeTorrentFile
-	if err := bencode.Unmarshal(data, &res); err != nil {
+	if err := bencode.NewDecoder(data).Decode(&res); err != nil {
 		return nil, fmt.Errorf("failed to unmarshall data from bencode encoding: %w", err)
 	}
 	return res.toTorrentFile()
 }
 
-func (t *TorrentFile) BuildTrackerURL(peerID [20]byte) (string, error) {
-	base, err := url.Parse(t.Announce)
-	if err != nil {
-		return "", fmt.Errorf("failed to parse URL %q: %w", t.Announce, err)
-	}
-
-	port := base.Port()
-	if port == "" {
-		switch base.Scheme {
-		case "http":
-			port = "80"
-		case "https":
-			port = "443"
-		default:
-			port = "80"
+// UnmarshallInfo builds torrent file from bencoded info dictionary, for example received
+// from peers by metadata exchange. Info hash is calculated from the data as is.
+func UnmarshallInfo(info []byte, announceList [][]string) (*TorrentFile, error) {
+	res := bencodeTorrentFile{
+		AnnounceList: announceList,
+		RawInfo:      info,
+	}
+	if len(announceList) > 0 && len(announceList[0]) > 0 {
+		res.Announce = announceList[0][0]
+	}
+	return res.toTorrentFile()
+}
+
+// PieceOffset returns position of the first byte of the piece in the concatenated stream of all files.
+func (t *TorrentFile) PieceOffset(id int) int64 {
+	return int64(id) * int64(t.PieceLength)
+}
+
+// PieceSize returns size of the piece, only the last piece can be shorter than PieceLength.
+func (t *TorrentFile) PieceSize(id int) int {
+	start := id * t.PieceLength
+	end := start + t.PieceLength
+	if end > t.Length {
+		end = t.Length
+	}
+	return end - start
+}
+
+// FilesOfPiece returns all files which have at least one byte in the piece.
+func (t *TorrentFile) FilesOfPiece(id int) []File {
+	start := int(t.PieceOffset(id))
+	end := start + t.PieceSize(id)
+	var res []File
+	for _, file := range t.Files {
+		if file.Offset < end && file.Offset+file.Length > start {
+			res = append(res, file)
 		}
 	}
-	params := url.Values{
-		"info_hash":  []string{string(t.VerifyHash[:])},
-		"peer_id":    []string{string(peerID[:])},
-		"port":       []string{port},
-		"uploaded":   []string{"0"},
-		"downloaded": []string{"0"},
-		"compact":    []string{"1"},
-		"left":       []string{strconv.Itoa(t.Length)},
-	}
-	base.RawQuery = params.Encode()
-	return base.String(), nil
+	return res
+}
+
+// IsValidPiece checks that SHA-1 of the data is equal to expected hash of the piece.
+func IsValidPiece(buf []byte, hash [20]byte) bool {
+	pieceHash := sha1.Sum(buf)
+	return bytes.Equal(pieceHash[:], hash[:])
+}
+
+// LocalPath returns path of the file on the filesystem relative to baseDir.
+func (t *TorrentFile) LocalPath(baseDir string, file File) string {
+	segments := make([]string, 0, len(file.Path)+2)
+	segments = append(segments, baseDir)
+	if t.MultiFile {
+		segments = append(segments, t.Name)
+	}
+	segments = append(segments, file.Path...)
+	return filepath.Join(segments...)
 }
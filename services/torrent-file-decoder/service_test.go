@@ -0,0 +1,173 @@
+package torrent_file_decoder
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"github.com/hihoak/torrent-cli/bencode"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testPieces(count int) string {
+	return strings.Repeat("h", 20*count)
+}
+
+func marshallTorrent(t *testing.T, info map[string]interface{}) []byte {
+	data, err := bencode.Marshal(map[string]interface{}{"announce": "http://tracker/announce", "info": info})
+	if err != nil {
+		t.Fatalf("failed to marshall torrent: %v", err)
+	}
+	return data
+}
+
+func TestUnmarshallSingleFile(t *testing.T) {
+	data := marshallTorrent(t, map[string]interface{}{
+		"name":         "file.bin",
+		"length":       40000,
+		"piece length": 16384,
+		"pieces":       testPieces(3),
+	})
+	torrentFile, err := Unmarshall(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("failed to unmarshall: %v", err)
+	}
+	if torrentFile.MultiFile || torrentFile.Length != 40000 || len(torrentFile.PieceHashes) != 3 {
+		t.Errorf("unexpected torrent %+v", torrentFile)
+	}
+	expectedFiles := []File{{Path: []string{"file.bin"}, Length: 40000}}
+	if !reflect.DeepEqual(torrentFile.Files, expectedFiles) {
+		t.Errorf("expected files %+v got %+v", expectedFiles, torrentFile.Files)
+	}
+	if size := torrentFile.PieceSize(2); size != 40000-2*16384 {
+		t.Errorf("expected size of the last piece %d got %d", 40000-2*16384, size)
+	}
+	if !reflect.DeepEqual(torrentFile.AnnounceList, [][]string{{"http://tracker/announce"}}) {
+		t.Errorf("expected announce as the only tier got %v", torrentFile.AnnounceList)
+	}
+}
+
+func TestUnmarshallMultiFile(t *testing.T) {
+	data := marshallTorrent(t, map[string]interface{}{
+		"name":         "dir",
+		"piece length": 16384,
+		"pieces":       testPieces(2),
+		"files": []interface{}{
+			map[string]interface{}{"length": 10000, "path": []interface{}{"a.txt"}},
+			map[string]interface{}{"length": 0, "path": []interface{}{"empty"}},
+			map[string]interface{}{"length": 7000, "path": []interface{}{"sub", "b.txt"}},
+		},
+	})
+	torrentFile, err := Unmarshall(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("failed to unmarshall: %v", err)
+	}
+	expectedFiles := []File{
+		{Path: []string{"a.txt"}, Length: 10000, Offset: 0},
+		{Path: []string{"empty"}, Length: 0, Offset: 10000},
+		{Path: []string{"sub", "b.txt"}, Length: 7000, Offset: 10000},
+	}
+	if !torrentFile.MultiFile || torrentFile.Length != 17000 || !reflect.DeepEqual(torrentFile.Files, expectedFiles) {
+		t.Errorf("unexpected torrent %+v", torrentFile)
+	}
+}
+
+func TestUnmarshallRejectsMalformedGeometry(t *testing.T) {
+	tests := []struct {
+		name string
+		info map[string]interface{}
+	}{
+		{
+			name: "zero piece length",
+			info: map[string]interface{}{"name": "a", "length": 10, "piece length": 0, "pieces": testPieces(1)},
+		},
+		{
+			name: "negative piece length",
+			info: map[string]interface{}{"name": "a", "length": 10, "piece length": -16384, "pieces": testPieces(1)},
+		},
+		{
+			name: "extra piece hashes",
+			info: map[string]interface{}{"name": "a", "length": 16384, "piece length": 16384, "pieces": testPieces(2)},
+		},
+		{
+			name: "missed piece hashes",
+			info: map[string]interface{}{"name": "a", "length": 16385, "piece length": 16384, "pieces": testPieces(1)},
+		},
+		{
+			name: "negative length",
+			info: map[string]interface{}{"name": "a", "length": -1, "piece length": 16384, "pieces": testPieces(1)},
+		},
+		{
+			name: "negative length of file",
+			info: map[string]interface{}{"name": "a", "piece length": 16384, "pieces": testPieces(1), "files": []interface{}{
+				map[string]interface{}{"length": 20000, "path": []interface{}{"a"}},
+				map[string]interface{}{"length": -10000, "path": []interface{}{"b"}},
+			}},
+		},
+		{
+			name: "truncated piece hash",
+			info: map[string]interface{}{"name": "a", "length": 10, "piece length": 16384, "pieces": "short"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Unmarshall(bytes.NewReader(marshallTorrent(t, tt.info))); err == nil {
+				t.Error("expected error for torrent file")
+			}
+			// metadata of magnet link which is received from peers is checked in the same way
+			rawInfo, err := bencode.Marshal(tt.info)
+			if err != nil {
+				t.Fatalf("failed to marshall info: %v", err)
+			}
+			if _, err = UnmarshallInfo(rawInfo, nil); err == nil {
+				t.Error("expected error for metadata")
+			}
+		})
+	}
+}
+
+func TestInfoHashIsCalculatedFromRawInfo(t *testing.T) {
+	// keys which aren't decoded into struct must be kept in info hash
+	info := map[string]interface{}{
+		"name":         "dir",
+		"piece length": 16384,
+		"pieces":       testPieces(1),
+		"private":      1,
+		"source":       "TRACKER",
+		"files": []interface{}{
+			map[string]interface{}{"length": 100, "path": []interface{}{"a"}, "md5sum": "0123456789abcdef"},
+			map[string]interface{}{"length": 200, "path": []interface{}{"b"}, "attr": "x"},
+		},
+	}
+	rawInfo, err := bencode.Marshal(info)
+	if err != nil {
+		t.Fatalf("failed to marshall info: %v", err)
+	}
+	data := marshallTorrent(t, info)
+	if !bytes.Contains(data, rawInfo) {
+		t.Fatal("torrent must contain info dictionary as is")
+	}
+
+	torrentFile, err := Unmarshall(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("failed to unmarshall: %v", err)
+	}
+	if torrentFile.VerifyHash != sha1.Sum(rawInfo) {
+		t.Errorf("expected info hash %x got %x", sha1.Sum(rawInfo), torrentFile.VerifyHash)
+	}
+	if !bytes.Equal(torrentFile.RawInfo, rawInfo) {
+		t.Errorf("expected raw info %q got %q", rawInfo, torrentFile.RawInfo)
+	}
+	if !torrentFile.Private {
+		t.Error("expected private torrent")
+	}
+
+	// info dictionary which is built from struct loses unknown keys, so its hash is different
+	reencoded := *torrentFile
+	if err = reencoded.EncodeInfo(); err != nil {
+		t.Fatalf("failed to encode info: %v", err)
+	}
+	if reencoded.VerifyHash == torrentFile.VerifyHash {
+		t.Error("expected info hash of re-encoded struct to differ from hash of raw info")
+	}
+}
@@ -0,0 +1,137 @@
+package uploader
+
+import (
+	log "github.com/rs/zerolog/log"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+const (
+	rechokeInterval = 10 * time.Second
+	// regularUnchokeSlots is a count of interested peers with the best rates which are unchoked
+	regularUnchokeSlots = 3
+	// optimisticUnchokeRounds is a count of rechokes after which optimistic unchoke is moved to another peer
+	optimisticUnchokeRounds = 3
+)
+
+// Run rechokes peers periodically until stop is closed.
+func (u *Uploader) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(rechokeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			u.rechoke()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// updateRates calculates rates of the peer since previous rechoke.
+func (p *Peer) updateRates() {
+	downloaded, uploaded := p.client.Downloaded(), p.client.Uploaded()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.downloadRate = downloaded - p.lastDownloaded
+	p.uploadRate = uploaded - p.lastUploaded
+	p.lastDownloaded, p.lastUploaded = downloaded, uploaded
+}
+
+// rate is a rate which peer is ranked by: while we download it is how fast peer sends us data
+// (tit-for-tat), when we only seed it is how fast peer takes data from us.
+func (p *Peer) rate(seeding bool) int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if seeding {
+		return p.uploadRate
+	}
+	return p.downloadRate
+}
+
+func (p *Peer) isInterested() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.interested
+}
+
+func (p *Peer) isChoking() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.choking
+}
+
+// rechoke unchokes interested peers with the best rates and one optimistic peer, others are choked.
+func (u *Uploader) rechoke() {
+	seeding := u.pieces.IsComplete()
+
+	u.mu.Lock()
+	interested := make([]*Peer, 0, len(u.peers))
+	all := make([]*Peer, 0, len(u.peers))
+	for peer := range u.peers {
+		peer.updateRates()
+		all = append(all, peer)
+		if peer.isInterested() {
+			interested = append(interested, peer)
+		}
+	}
+	sort.Slice(interested, func(i, j int) bool {
+		return interested[i].rate(seeding) > interested[j].rate(seeding)
+	})
+
+	unchoke := make(map[*Peer]bool, regularUnchokeSlots+1)
+	for idx := 0; idx < len(interested) && idx < regularUnchokeSlots; idx++ {
+		unchoke[interested[idx]] = true
+	}
+
+	if u.round%optimisticUnchokeRounds == 0 || u.optimistic == nil || !u.optimistic.isInterested() {
+		u.optimistic = nil
+		candidates := make([]*Peer, 0, len(interested))
+		for _, peer := range interested {
+			if !unchoke[peer] {
+				candidates = append(candidates, peer)
+			}
+		}
+		if len(candidates) > 0 {
+			u.optimistic = candidates[rand.Intn(len(candidates))]
+		}
+	}
+	if u.optimistic != nil {
+		unchoke[u.optimistic] = true
+	}
+	u.round++
+	u.mu.Unlock()
+
+	for _, peer := range all {
+		var err error
+		if unchoke[peer] {
+			err = peer.Unchoke()
+		} else {
+			err = peer.Choke()
+		}
+		if err != nil {
+			log.Debug().Err(err).Msgf("failed to rechoke peer %s", peer.client.RemoteAddr())
+		}
+	}
+}
+
+// unchokeIfFreeSlot unchokes newly interested peer right away if not all slots are used,
+// so it doesn't wait for the next rechoke.
+func (u *Uploader) unchokeIfFreeSlot(peer *Peer) {
+	u.mu.Lock()
+	unchoked := 0
+	for other := range u.peers {
+		if !other.isChoking() {
+			unchoked++
+		}
+	}
+	u.mu.Unlock()
+
+	if unchoked >= regularUnchokeSlots+1 {
+		return
+	}
+	if err := peer.Unchoke(); err != nil {
+		log.Debug().Err(err).Msgf("failed to unchoke peer %s", peer.client.RemoteAddr())
+	}
+}
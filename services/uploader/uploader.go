@@ -0,0 +1,293 @@
+package uploader
+
+import (
+	"fmt"
+	"github.com/hihoak/torrent-cli/client/torrent"
+	"github.com/hihoak/torrent-cli/services/storage"
+	torrent_file_decoder "github.com/hihoak/torrent-cli/services/torrent-file-decoder"
+	log "github.com/rs/zerolog/log"
+	"net"
+	"sync"
+)
+
+const (
+	// maxRequestLength is the biggest block which peer may request, bigger requests close connection
+	maxRequestLength = 128 * 1024
+)
+
+// Pieces reports which pieces of the torrent we have and can upload.
+type Pieces interface {
+	HasPiece(id int) bool
+	IsComplete() bool
+}
+
+type request struct {
+	index  int
+	begin  int
+	length int
+}
+
+// Uploader serves blocks to peers from verified data on storage and decides which peers are unchoked.
+type Uploader struct {
+	torrentFile *torrent_file_decoder.TorrentFile
+	storage     storage.Storage
+	pieces      Pieces
+
+	mu    sync.Mutex
+	peers map[*Peer]struct{}
+	// optimistic is a peer which is unchoked regardless of its rate
+	optimistic *Peer
+	round      int
+}
+
+func NewUploader(torrentFile *torrent_file_decoder.TorrentFile, storage storage.Storage, pieces Pieces) *Uploader {
+	return &Uploader{
+		torrentFile: torrentFile,
+		storage:     storage,
+		pieces:      pieces,
+		peers:       make(map[*Peer]struct{}),
+	}
+}
+
+// Peer is an upload side of the connection with one peer. Requests are queued and served
+// in background, so reading of messages from peer isn't blocked by reading from storage.
+type Peer struct {
+	uploader *Uploader
+	client   *torrent.Client
+
+	mu         sync.Mutex
+	cond       *sync.Cond
+	interested bool
+	choking    bool
+	requests   []request
+	closed     bool
+	// allowedFast are pieces which peer may download while it is choked, they are used only
+	// with fast extension
+	allowedFast map[int]bool
+
+	// counters of the client at previous rechoke and rates since it
+	lastDownloaded int64
+	lastUploaded   int64
+	downloadRate   int64
+	uploadRate     int64
+}
+
+// AddPeer starts serving requests of the client. Peer must be closed when connection is finished.
+func (u *Uploader) AddPeer(client *torrent.Client) *Peer {
+	peer := &Peer{
+		uploader: u,
+		client:   client,
+		choking:  true,
+	}
+	peer.cond = sync.NewCond(&peer.mu)
+	if client.SupportsFastExtension() {
+		peer.sendAllowedFast()
+	}
+
+	u.mu.Lock()
+	u.peers[peer] = struct{}{}
+	u.mu.Unlock()
+
+	go peer.serve()
+	return peer
+}
+
+// sendAllowedFast tells peer which pieces of its allowed fast set we have.
+func (p *Peer) sendAllowedFast() {
+	addr, ok := p.client.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return
+	}
+	torrentFile := p.uploader.torrentFile
+	p.allowedFast = make(map[int]bool, torrent.AllowedFastSetSize)
+	for _, piece := range torrent.AllowedFastSet(addr.IP, torrentFile.VerifyHash, len(torrentFile.PieceHashes), torrent.AllowedFastSetSize) {
+		if !p.uploader.pieces.HasPiece(piece) {
+			continue
+		}
+		p.allowedFast[piece] = true
+		if err := p.client.SendAllowedFast(piece); err != nil {
+			log.Debug().Err(err).Msgf("failed to send allowed fast pieces to peer %s", p.client.RemoteAddr())
+			return
+		}
+	}
+}
+
+func (u *Uploader) removePeer(peer *Peer) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	delete(u.peers, peer)
+	if u.optimistic == peer {
+		u.optimistic = nil
+	}
+}
+
+// HandleMessage processes messages which are related to uploading. It returns false
+// if message must be handled by somebody else.
+func (p *Peer) HandleMessage(msg *torrent.Message) (bool, error) {
+	switch msg.ID {
+	case torrent.MsgInterested:
+		p.mu.Lock()
+		p.interested = true
+		p.mu.Unlock()
+		p.uploader.unchokeIfFreeSlot(p)
+	case torrent.MsgNotInterested:
+		p.mu.Lock()
+		p.interested = false
+		p.mu.Unlock()
+	case torrent.MsgRequest:
+		index, begin, length, err := msg.ParseRequest()
+		if err != nil {
+			return true, err
+		}
+		if err = p.uploader.validateRequest(index, begin, length); err != nil {
+			return true, err
+		}
+		p.enqueue(request{index: index, begin: begin, length: length})
+	case torrent.MsgCancel:
+		index, begin, length, err := msg.ParseRequest()
+		if err != nil {
+			return true, err
+		}
+		p.cancel(request{index: index, begin: begin, length: length})
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+func (u *Uploader) validateRequest(index, begin, length int) error {
+	if index < 0 || index >= len(u.torrentFile.PieceHashes) {
+		return fmt.Errorf("request of unknown piece %d", index)
+	}
+	if length <= 0 || length > maxRequestLength {
+		return fmt.Errorf("request of block with invalid length %d", length)
+	}
+	if begin < 0 || begin+length > u.torrentFile.PieceSize(index) {
+		return fmt.Errorf("request of block [%d, %d) out of piece %d", begin, begin+length, index)
+	}
+	return nil
+}
+
+func (p *Peer) enqueue(req request) {
+	if !p.uploader.pieces.HasPiece(req.index) {
+		log.Debug().Msgf("peer %s requested piece %d which we don't have", p.client.RemoteAddr(), req.index)
+		p.reject(req)
+		return
+	}
+	p.mu.Lock()
+	if (p.choking && !p.allowedFast[req.index]) || len(p.requests) >= torrent.LocalRequestQueueSize {
+		p.mu.Unlock()
+		p.reject(req)
+		return
+	}
+	p.requests = append(p.requests, req)
+	p.cond.Signal()
+	p.mu.Unlock()
+}
+
+// reject tells peer that request won't be served, without fast extension requests are dropped silently.
+func (p *Peer) reject(req request) {
+	if !p.client.SupportsFastExtension() {
+		return
+	}
+	if err := p.client.SendReject(req.index, req.begin, req.length); err != nil {
+		log.Debug().Err(err).Msgf("failed to reject request of peer %s", p.client.RemoteAddr())
+	}
+}
+
+// cancel drops queued request, with fast extension peer still expects the block or its rejection.
+func (p *Peer) cancel(req request) {
+	p.mu.Lock()
+	for idx, queued := range p.requests {
+		if queued == req {
+			p.requests = append(p.requests[:idx], p.requests[idx+1:]...)
+			p.mu.Unlock()
+			p.reject(req)
+			return
+		}
+	}
+	p.mu.Unlock()
+}
+
+func (p *Peer) nextRequest() (request, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for len(p.requests) == 0 && !p.closed {
+		p.cond.Wait()
+	}
+	if p.closed {
+		return request{}, false
+	}
+	req := p.requests[0]
+	p.requests = p.requests[1:]
+	return req, true
+}
+
+func (p *Peer) serve() {
+	for {
+		req, ok := p.nextRequest()
+		if !ok {
+			return
+		}
+		block := make([]byte, req.length)
+		offset := p.uploader.torrentFile.PieceOffset(req.index) + int64(req.begin)
+		if _, err := p.uploader.storage.ReadAt(block, offset); err != nil {
+			log.Error().Err(err).Msgf("failed to read block of piece %d from storage", req.index)
+			p.reject(req)
+			continue
+		}
+		if err := p.client.SendPiece(req.index, req.begin, block); err != nil {
+			log.Debug().Err(err).Msgf("failed to upload block to peer %s", p.client.RemoteAddr())
+			return
+		}
+	}
+}
+
+// Choke forbids peer to download from us, all its pending requests are dropped. With fast extension
+// requests of allowed fast pieces are kept and the others are rejected.
+func (p *Peer) Choke() error {
+	p.mu.Lock()
+	if p.choking {
+		p.mu.Unlock()
+		return nil
+	}
+	p.choking = true
+	var kept, dropped []request
+	for _, req := range p.requests {
+		if p.allowedFast[req.index] {
+			kept = append(kept, req)
+		} else {
+			dropped = append(dropped, req)
+		}
+	}
+	p.requests = kept
+	p.mu.Unlock()
+	if err := p.client.SendChoke(); err != nil {
+		return err
+	}
+	for _, req := range dropped {
+		p.reject(req)
+	}
+	return nil
+}
+
+func (p *Peer) Unchoke() error {
+	p.mu.Lock()
+	if !p.choking {
+		p.mu.Unlock()
+		return nil
+	}
+	p.choking = false
+	p.mu.Unlock()
+	return p.client.SendUnchoke()
+}
+
+// Close stops serving requests of the peer, connection itself isn't closed.
+func (p *Peer) Close() {
+	p.mu.Lock()
+	p.closed = true
+	p.requests = nil
+	p.cond.Broadcast()
+	p.mu.Unlock()
+	p.uploader.removePeer(p)
+}
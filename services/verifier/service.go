@@ -0,0 +1,139 @@
+package verifier
+
+import (
+	"errors"
+	"fmt"
+	"github.com/hihoak/torrent-cli/services/storage"
+	torrent_file_decoder "github.com/hihoak/torrent-cli/services/torrent-file-decoder"
+	"io"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+)
+
+type PieceStatus string
+
+const (
+	StatusGood    PieceStatus = "good"
+	StatusMissing PieceStatus = "missing"
+	StatusCorrupt PieceStatus = "corrupt"
+)
+
+type PieceResult struct {
+	Index  int         `json:"index"`
+	Status PieceStatus `json:"status"`
+	Files  []string    `json:"files"`
+}
+
+// Report contains counters for all pieces and details only about pieces which are not good.
+type Report struct {
+	Name        string        `json:"name"`
+	TotalPieces int           `json:"total_pieces"`
+	Good        int           `json:"good"`
+	Missing     int           `json:"missing"`
+	Corrupt     int           `json:"corrupt"`
+	BadPieces   []PieceResult `json:"bad_pieces"`
+}
+
+func (r *Report) IsComplete() bool {
+	return r.Good == r.TotalPieces
+}
+
+// Verify reads data of the torrent piece by piece from dataStorage and compares it with piece hashes.
+// Hashing is done by workers goroutines, if workers is not positive count of CPUs is used.
+func Verify(torrentFile *torrent_file_decoder.TorrentFile, dataStorage storage.Storage, workers int) (*Report, error) {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	idsChan := make(chan int)
+	resultsChan := make(chan PieceResult)
+	errChan := make(chan error, workers)
+	done := make(chan struct{})
+
+	wg := &sync.WaitGroup{}
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for id := range idsChan {
+				result, err := verifyPiece(torrentFile, dataStorage, id)
+				if err != nil {
+					errChan <- err
+					return
+				}
+				resultsChan <- result
+			}
+		}()
+	}
+
+	go func() {
+		defer close(idsChan)
+		for id := range torrentFile.PieceHashes {
+			select {
+			case idsChan <- id:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	go func() {
+		wg.Wait()
+		close(resultsChan)
+	}()
+
+	report := &Report{
+		Name:        torrentFile.Name,
+		TotalPieces: len(torrentFile.PieceHashes),
+		BadPieces:   []PieceResult{},
+	}
+	for result := range resultsChan {
+		switch result.Status {
+		case StatusGood:
+			report.Good++
+			continue
+		case StatusMissing:
+			report.Missing++
+		case StatusCorrupt:
+			report.Corrupt++
+		}
+		report.BadPieces = append(report.BadPieces, result)
+	}
+	close(done)
+	select {
+	case err := <-errChan:
+		return nil, err
+	default:
+	}
+
+	sort.Slice(report.BadPieces, func(i, j int) bool {
+		return report.BadPieces[i].Index < report.BadPieces[j].Index
+	})
+	return report, nil
+}
+
+func verifyPiece(torrentFile *torrent_file_decoder.TorrentFile, dataStorage storage.Storage, id int) (PieceResult, error) {
+	result := PieceResult{
+		Index: id,
+	}
+	buf := make([]byte, torrentFile.PieceSize(id))
+	_, err := dataStorage.ReadAt(buf, torrentFile.PieceOffset(id))
+	switch {
+	case err == nil && torrent_file_decoder.IsValidPiece(buf, torrentFile.PieceHashes[id]):
+		result.Status = StatusGood
+		return result, nil
+	case err == nil:
+		result.Status = StatusCorrupt
+	case errors.Is(err, storage.ErrMissingData) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+		result.Status = StatusMissing
+	default:
+		return PieceResult{}, fmt.Errorf("failed to read piece %d: %w", id, err)
+	}
+
+	for _, file := range torrentFile.FilesOfPiece(id) {
+		result.Files = append(result.Files, filepath.Join(file.Path...))
+	}
+	return result, nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"github.com/hihoak/torrent-cli/services/storage"
+	"github.com/hihoak/torrent-cli/services/verifier"
+	log "github.com/rs/zerolog/log"
+	"strings"
+)
+
+func runVerify(args []string) int {
+	flags, common := newFlagSet("verify", "[flags] <torrent file> <data directory>")
+	workers := flags.Int("workers", 0, "count of hashing workers, by default count of CPUs")
+	if code, ok := parseFlags(flags, common, args, 2); !ok {
+		return code
+	}
+
+	file, err := openTorrentFile(flags.Arg(0))
+	if err != nil {
+		log.Error().Err(err).Msg("failed to read torrent")
+		return exitFailure
+	}
+
+	dataStorage, err := storage.OpenFileStorage(file, flags.Arg(1))
+	if err != nil {
+		log.Error().Err(err).Msg("failed to open data")
+		return exitFailure
+	}
+	defer func() {
+		if closeErr := dataStorage.Close(); closeErr != nil {
+			log.Error().Err(closeErr).Msg("failed to close data")
+		}
+	}()
+
+	report, err := verifier.Verify(file, dataStorage, *workers)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to verify data")
+		return exitFailure
+	}
+
+	if common.output == outputJSON {
+		if code := printJSON(report); code != exitOK {
+			return code
+		}
+	} else {
+		printVerifyReport(report)
+	}
+
+	if !report.IsComplete() {
+		return exitFailure
+	}
+	return exitOK
+}
+
+func printVerifyReport(report *verifier.Report) {
+	fmt.Printf("%s: %d pieces, %d good, %d missing, %d corrupt\n", report.Name, report.TotalPieces, report.Good, report.Missing, report.Corrupt)
+	for _, piece := range report.BadPieces {
+		fmt.Printf("piece %d %s: %s\n", piece.Index, piece.Status, strings.Join(piece.Files, ", "))
+	}
+}